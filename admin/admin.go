@@ -0,0 +1,379 @@
+// Package admin provides an http.Handler for inspecting and revoking the sessions kept in redis.
+// It performs no authentication of its own: mount it behind your own.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/gbenroscience/webredis/sessions"
+)
+
+const defaultLimit = 100
+
+// Handler serves the following routes, relative to where it is mounted (use http.StripPrefix):
+//
+//	GET    /sessions?name=...|user=...[&offset=..&limit=..]  lists sessions, most recently accessed first
+//	DELETE /sessions?name=...|user=...                       revokes all sessions with that name, or of that user
+//	POST   /sessions/revoke                                  revokes the sessions whose handles are posted as {"handles": [...]}
+//	GET    /sessions/{handle}[?values=true]                  shows a session; its values only if Values is set
+//	DELETE /sessions/{handle}                                revokes a session
+//	GET    /audit[?user=..&type=..&from=..&to=..&limit=..]    lists the events of Audit, oldest first; from and to are RFC 3339 times
+//
+// Sessions are found through the webredis.SessionIndex of the session stores, so only indexed sessions can be listed or revoked.
+// They are named by their webredis.SessionHandle, never by their ID, which would let whoever sees it use the session.
+type Handler struct {
+	Index *webredis.SessionIndex
+	// Values reveals the decrypted values of a session. Leave nil to never reveal them
+	Values func(ctx context.Context, id string) (map[string]interface{}, error)
+	// Audit records the sessions revoked through the handler, and is served under /audit. Leave nil to disable
+	Audit *webredis.AuditLog
+	// Notices broadcasts the sessions revoked through the handler to every instance. Leave nil to disable
+	Notices *webredis.Topic[webredis.SessionNotice]
+	// Revocations revokes the JWTs of the sessions revoked through the handler. Leave nil if the sessions have no JWTs
+	Revocations *webredis.RevocationList
+	// Cache is the LocalCache of the session store, which is told of the sessions revoked through the handler,
+	// so no instance keeps serving them. Leave nil if the store has no cache
+	Cache *sessions.LocalCache
+}
+
+// NewHandler creates a Handler for the sessions in index which never reveals their values
+func NewHandler(index *webredis.SessionIndex) *Handler {
+	return &Handler{Index: index}
+}
+
+// session is how a webredis.SessionInfo is shown
+type session struct {
+	Handle     string                 `json:"handle"`
+	Name       string                 `json:"name"`
+	UserID     string                 `json:"user_id,omitempty"`
+	CreatedAt  *time.Time             `json:"created_at,omitempty"`
+	LastAccess *time.Time             `json:"last_access,omitempty"`
+	TTLSeconds int64                  `json:"ttl_seconds"`
+	Size       int64                  `json:"size"`
+	Values     map[string]interface{} `json:"values,omitempty"`
+}
+
+func newSession(info webredis.SessionInfo) session {
+	s := session{Handle: info.Handle, Name: info.Name, UserID: info.UserID, TTLSeconds: int64(info.TTL / time.Second), Size: info.Size}
+	if !info.CreatedAt.IsZero() {
+		s.CreatedAt = &info.CreatedAt
+	}
+	if !info.LastAccess.IsZero() {
+		s.LastAccess = &info.LastAccess
+	}
+	return s
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case path == "sessions" && r.Method == http.MethodGet:
+		h.list(w, r)
+	case path == "sessions" && r.Method == http.MethodDelete:
+		h.revokeAll(w, r)
+	case path == "sessions/revoke" && r.Method == http.MethodPost:
+		h.revokeIDs(w, r)
+	case strings.HasPrefix(path, "sessions/") && r.Method == http.MethodGet:
+		h.show(w, r, strings.TrimPrefix(path, "sessions/"))
+	case strings.HasPrefix(path, "sessions/") && r.Method == http.MethodDelete:
+		h.revoke(w, r, strings.TrimPrefix(path, "sessions/"))
+	case path == "audit" && r.Method == http.MethodGet:
+		h.audit(w, r)
+	case path == "sessions" || strings.HasPrefix(path, "sessions/") || path == "audit":
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// find lists the sessions selected by the name or user query parameters
+func (h *Handler) find(r *http.Request, offset int, limit int) ([]webredis.SessionInfo, bool, error) {
+	q := r.URL.Query()
+	if name := q.Get("name"); name != "" {
+		infos, err := h.Index.ByName(r.Context(), name, offset, limit)
+		return infos, true, err
+	}
+	if user := q.Get("user"); user != "" {
+		infos, err := h.Index.ByUser(r.Context(), user, offset, limit)
+		return infos, true, err
+	}
+	return nil, false, nil
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultLimit
+	}
+	if offset < 0 {
+		offset = 0
+	}
+
+	infos, ok, err := h.find(r, offset, limit)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "either the name or the user query parameter is required")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sessions := make([]session, len(infos))
+	for i, info := range infos {
+		sessions[i] = newSession(info)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"sessions": sessions, "offset": offset, "limit": limit})
+}
+
+// resolve returns the ID of the indexed session named by handle, or an empty string if there is none
+func (h *Handler) resolve(r *http.Request, handle string) (string, error) {
+	ids, err := h.Index.Resolve(r.Context(), []string{handle})
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[0], nil
+}
+
+func (h *Handler) show(w http.ResponseWriter, r *http.Request, handle string) {
+	id, err := h.resolve(r, handle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if id == "" {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	redisStat, info, err := h.Index.Info(r.Context(), id)
+	if redisStat == webredis.RedisRecordNotFound {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	s := newSession(*info)
+	if wantValues, _ := strconv.ParseBool(r.URL.Query().Get("values")); wantValues {
+		if h.Values == nil {
+			writeError(w, http.StatusForbidden, "revealing session values is not allowed")
+			return
+		}
+		if s.Values, err = h.Values(r.Context(), id); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (h *Handler) revoke(w http.ResponseWriter, r *http.Request, handle string) {
+	id, err := h.resolve(r, handle)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if id == "" {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	n, err := h.delete(r, []string{id})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if n == 0 {
+		writeError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"revoked": n})
+}
+
+func (h *Handler) revokeAll(w http.ResponseWriter, r *http.Request) {
+	infos, ok, err := h.find(r, 0, 0)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "either the name or the user query parameter is required")
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	ids := make([]string, len(infos))
+	for i, info := range infos {
+		ids[i] = info.ID
+	}
+	h.respondRevoked(w, r, ids)
+}
+
+func (h *Handler) revokeIDs(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Handles []string `json:"handles"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "the body must be a JSON object like {\"handles\": [...]}")
+		return
+	}
+	// only sessions in the index are revoked, so no other key can be deleted through the handler
+	ids, err := h.Index.Resolve(r.Context(), body.Handles)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	h.respondRevoked(w, r, ids)
+}
+
+func (h *Handler) respondRevoked(w http.ResponseWriter, r *http.Request, ids []string) {
+	n, err := h.delete(r, ids)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int64{"revoked": n})
+}
+
+// delete revokes the sessions and removes them from the index. It returns how many sessions existed.
+// ids must be those of indexed sessions
+func (h *Handler) delete(r *http.Request, ids []string) (int64, error) {
+	ctx := r.Context()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	res, err := h.Index.Store.DeleteMany(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	removed, err := h.Index.RemoveMany(ctx, ids)
+	if err != nil {
+		return 0, err
+	}
+	infos := make(map[string]webredis.SessionInfo, len(removed))
+	for _, info := range removed {
+		infos[info.ID] = info
+	}
+
+	if err := h.notify(ctx, res, infos); err != nil {
+		return 0, err
+	}
+	if err := h.revokeJWTs(ctx, res); err != nil {
+		return 0, err
+	}
+	if h.Cache != nil {
+		if err := h.Cache.Invalidate(ctx, h.Index.Store, ids...); err != nil {
+			return 0, err
+		}
+	}
+	var revoked int64
+	for _, deleted := range res {
+		if deleted.Err != nil {
+			return revoked, deleted.Err
+		}
+		if deleted.Status != webredis.RedisRecordFound {
+			continue
+		}
+		revoked++
+		info := infos[deleted.Key]
+		ev := webredis.AuditEvent{Type: webredis.AuditRevoked, SessionID: deleted.Key, Name: info.Name, UserID: info.UserID, Detail: "admin"}
+		if err := h.Audit.RecordRequest(ctx, r, ev); err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
+
+// notify broadcasts the revoked sessions through Notices, if any
+func (h *Handler) notify(ctx context.Context, res []webredis.BatchResult, infos map[string]webredis.SessionInfo) error {
+	if h.Notices == nil {
+		return nil
+	}
+	var notices []webredis.SessionNotice
+	for _, deleted := range res {
+		if deleted.Status == webredis.RedisRecordFound {
+			info := infos[deleted.Key]
+			notices = append(notices, webredis.SessionNotice{Kind: webredis.SessionDestroyed, SessionID: deleted.Key, Name: info.Name, UserID: info.UserID})
+		}
+	}
+	return h.Notices.Publish(ctx, notices...)
+}
+
+// revokeJWTs adds the revoked sessions to Revocations, if any
+func (h *Handler) revokeJWTs(ctx context.Context, res []webredis.BatchResult) error {
+	if h.Revocations == nil {
+		return nil
+	}
+	var ids []string
+	for _, deleted := range res {
+		if deleted.Status == webredis.RedisRecordFound {
+			ids = append(ids, webredis.JWTID(deleted.Key))
+		}
+	}
+	return h.Revocations.Revoke(ctx, ids...)
+}
+
+// auditEvent is how a webredis.AuditEvent is shown
+type auditEvent struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Type       string    `json:"type"`
+	Store      string    `json:"store,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	SessionID  string    `json:"session_id,omitempty"`
+	PreviousID string    `json:"previous_id,omitempty"`
+	UserID     string    `json:"user_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Detail     string    `json:"detail,omitempty"`
+}
+
+func (h *Handler) audit(w http.ResponseWriter, r *http.Request) {
+	if h.Audit == nil {
+		writeError(w, http.StatusNotFound, "there is no audit log")
+		return
+	}
+	params := r.URL.Query()
+	q := webredis.AuditQuery{UserID: params.Get("user"), Types: params["type"]}
+	for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+		if params.Get(name) == "" {
+			continue
+		}
+		var err error
+		if *t, err = time.Parse(time.RFC3339, params.Get(name)); err != nil {
+			writeError(w, http.StatusBadRequest, "the "+name+" query parameter must be an RFC 3339 time")
+			return
+		}
+	}
+	var err error
+	if q.Limit, err = strconv.Atoi(params.Get("limit")); err != nil || q.Limit <= 0 {
+		q.Limit = defaultLimit
+	}
+
+	events, err := h.Audit.Query(r.Context(), q)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	out := make([]auditEvent, len(events))
+	for i, ev := range events {
+		out[i] = auditEvent(ev)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": out})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
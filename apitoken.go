@@ -0,0 +1,241 @@
+package webredis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APITokenName is the Name of the sessions of a RedisTokenStore which are API tokens
+const APITokenName = "api_token"
+
+// TokenGrant describes an API token to issue
+type TokenGrant struct {
+	// Subject is who the token acts for, usually a user ID. It is the UserID of the token
+	Subject string
+	// Scopes are what the token may be used for
+	Scopes []string
+	// ClientID is the client the token is issued to
+	ClientID string
+	// TTL is how long the token lasts. Defaults to MaxAgeDefault seconds
+	TTL time.Duration
+	// RefreshTTL is how long the refresh tokens issued by IssueTokenPair last, each from when it is issued. Defaults to 30 days
+	RefreshTTL time.Duration
+}
+
+// Introspection is the state of an API token, shaped like the response of OAuth 2.0 token introspection (RFC 7662)
+type Introspection struct {
+	Active bool `json:"active"`
+	// Scope is the space separated list of the scopes of the token
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	// IssuedAt and ExpiresAt are in seconds since the epoch
+	IssuedAt  int64 `json:"iat,omitempty"`
+	ExpiresAt int64 `json:"exp,omitempty"`
+}
+
+// HasScope tells if the token is active and has the scope
+func (in *Introspection) HasScope(scope string) bool {
+	if in == nil || !in.Active {
+		return false
+	}
+	for _, s := range strings.Fields(in.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIToken makes an API token. Unlike session IDs, tokens are drawn from crypto/rand, as they are bearer credentials
+func newAPIToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken is what redis keeps of API and refresh tokens, so whoever reads the keys of redis cannot use them
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueToken creates an opaque API token for the grant, and saves it in redis like a session called APITokenName.
+// It returns the token, to be sent as "Authorization: Bearer <token>", and its session.
+// Only a hash of the token is kept in redis: it is the ID of the session, not the token itself
+func (rts *RedisTokenStore) IssueToken(ctx context.Context, grant TokenGrant) (string, *Session, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "IssueToken", AttrSessionName.String(APITokenName))
+	ttl := grant.TTL
+	if ttl <= 0 {
+		ttl = time.Duration(rts.MaxAgeDefault) * time.Second
+	}
+	token, err := newAPIToken()
+	if err != nil {
+		done(err)
+		return "", nil, err
+	}
+	now := time.Now()
+	s := &Session{
+		ID:        hashToken(token),
+		Name:      APITokenName,
+		Values:    make(map[string]interface{}),
+		MaxAge:    int(ttl / time.Second),
+		UserID:    grant.Subject,
+		CreatedAt: now.Unix(),
+		Scopes:    grant.Scopes,
+		ClientID:  grant.ClientID,
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	tkn, err := rts.token(s)
+	if err != nil {
+		done(err)
+		return "", nil, err
+	}
+	_, s.Version, err = rts.RedisClient.SetIfVersionContext(ctx, s.ID, tkn, 0, int64(s.MaxAge))
+	if err == nil {
+		rts.RedisClient.ObservePayload(ctx, tokenStoreName, "save", len(tkn))
+		rts.touch(ctx, s)
+		rts.audit(ctx, nil, AuditCreated, s, "", grant.ClientID)
+		rts.fire(ctx, SessionSaved, s, "")
+	}
+	LogSave(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
+	done(err)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, s, nil
+}
+
+// Introspect describes an API token. Tokens which do not exist, expired or are not API tokens are inactive.
+// An error is only returned if redis could not tell
+func (rts *RedisTokenStore) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "Introspect", AttrSessionName.String(APITokenName))
+	s, redisStat, err := rts.load(ctx, hashToken(token))
+	switch {
+	case redisStat == RedisRecordNotFound || redisStat == RedisRecordUnmarshalError:
+		done(nil)
+		return &Introspection{}, nil
+	case err != nil:
+		done(err)
+		return nil, err
+	}
+	done(nil)
+	if s.Name != APITokenName || time.Now().Unix() >= s.ExpiresAt {
+		return &Introspection{}, nil
+	}
+	return &Introspection{
+		Active:    true,
+		Scope:     strings.Join(s.Scopes, " "),
+		ClientID:  s.ClientID,
+		Subject:   s.UserID,
+		TokenType: "Bearer",
+		IssuedAt:  s.CreatedAt,
+		ExpiresAt: s.ExpiresAt,
+	}, nil
+}
+
+// RevokeToken deletes an API token before it expires. It returns false if there was no such token
+func (rts *RedisTokenStore) RevokeToken(ctx context.Context, token string) (bool, error) {
+	s, redisStat, err := rts.load(ctx, hashToken(token))
+	if redisStat == RedisRecordNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if s.Name != APITokenName {
+		return false, nil
+	}
+	n, err := rts.Delete(s)
+	return n > 0, err
+}
+
+type introspectionKey struct{}
+
+// IntrospectionFromContext returns the API token of the request, as set by RequireScopes, or nil
+func IntrospectionFromContext(ctx context.Context) *Introspection {
+	in, _ := ctx.Value(introspectionKey{}).(*Introspection)
+	return in
+}
+
+// bearerToken returns the token of the Authorization header of r, if any
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// RequireScopes passes to next only the requests carrying an active API token, as "Authorization: Bearer <token>",
+// which has all of scopes. Others are answered 401 Unauthorized, or 403 Forbidden if the token lacks scopes, as in RFC 6750.
+// next finds the token with IntrospectionFromContext
+func (rts *RedisTokenStore) RequireScopes(next http.Handler, scopes ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := bearerToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		in, err := rts.Introspect(r.Context(), token)
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		if !in.Active {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		for _, scope := range scopes {
+			if !in.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), introspectionKey{}, in)))
+	})
+}
+
+// IntrospectionHandler answers token introspection requests as in RFC 7662: a POST with the form field token,
+// answered with the Introspection of the token as JSON. It performs no authentication of its own: mount it behind your own
+func (rts *RedisTokenStore) IntrospectionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		token := r.PostFormValue("token")
+		if token == "" {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request")
+			return
+		}
+		in, err := rts.Introspect(r.Context(), token)
+		if err != nil {
+			writeTokenError(w, http.StatusServiceUnavailable, "temporarily_unavailable")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(in)
+	})
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
@@ -0,0 +1,246 @@
+package webredis
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultAuditStream is the redis stream an AuditLog appends to, unless told otherwise
+const DefaultAuditStream = "webredis:audit"
+
+// The types of the events in an AuditLog
+const (
+	// AuditCreated is recorded when a new session is saved for the first time
+	AuditCreated = "created"
+	// AuditRegenerated is recorded when a session is given a new ID
+	AuditRegenerated = "regenerated"
+	// AuditRevoked is recorded when a session is deleted before it expires
+	AuditRevoked = "revoked"
+	// AuditFingerprintMismatch is recorded when a session is presented by a client which does not match its fingerprint
+	AuditFingerprintMismatch = "fingerprint_mismatch"
+	// AuditDecryptFailure is recorded when a session cannot be decrypted
+	AuditDecryptFailure = "decrypt_failure"
+	// AuditRemembered is recorded when a session is signed in from a remember-me token
+	AuditRemembered = "remembered"
+	// AuditRememberTheft is recorded when a replaced remember-me token is presented, and its series revoked
+	AuditRememberTheft = "remember_theft"
+	// AuditRefreshReuse is recorded when a refresh token is presented again, and its family revoked
+	AuditRefreshReuse = "refresh_reuse"
+)
+
+// AuditEvent is an entry of an AuditLog. Session IDs are recorded redacted, as by RedactID,
+// so the log can be read without giving away live sessions, yet events of the same session can still be matched
+type AuditEvent struct {
+	// ID is the ID of the entry in the stream. It is set by Record
+	ID   string
+	Time time.Time
+	Type string
+	// Store is the store the session belongs to, e.g. "session" or "token"
+	Store     string
+	Name      string
+	SessionID string
+	// PreviousID is the ID a regenerated session had before
+	PreviousID string
+	UserID     string
+	// RemoteAddr and UserAgent are those of the request which caused the event, if any
+	RemoteAddr string
+	UserAgent  string
+	// Detail says more about the event, e.g. why a session was created or who revoked it
+	Detail string
+}
+
+// AuditLog is an append-only log of session security events, kept in a redis stream
+type AuditLog struct {
+	Store *RedisStore
+	// Stream is the key of the redis stream. Defaults to DefaultAuditStream
+	Stream string
+	// MaxLen caps the number of events kept, dropping the oldest as new ones are recorded. 0 keeps them all.
+	// The stream is trimmed approximately, so it may hold a few more
+	MaxLen int64
+	// MaxAge is how long events are kept by Trim. 0 keeps them forever
+	MaxAge time.Duration
+}
+
+// NewAuditLog creates an AuditLog appending to DefaultAuditStream
+func NewAuditLog(store *RedisStore) *AuditLog {
+	return &AuditLog{Store: store, Stream: DefaultAuditStream}
+}
+
+func (a *AuditLog) stream() string {
+	if a.Stream == "" {
+		return DefaultAuditStream
+	}
+	return a.Stream
+}
+
+// Record appends the event to the log. The session IDs of the event are redacted first.
+// It does nothing on a nil AuditLog
+func (a *AuditLog) Record(ctx context.Context, ev AuditEvent) error {
+	if a == nil {
+		return nil
+	}
+	values := []interface{}{"type", ev.Type, "store", ev.Store, "name", ev.Name}
+	if ev.SessionID != "" {
+		values = append(values, "session", RedactID(ev.SessionID))
+	}
+	for _, field := range [][2]string{
+		{"previous", redactIfSet(ev.PreviousID)},
+		{"user", ev.UserID},
+		{"addr", ev.RemoteAddr},
+		{"ua", ev.UserAgent},
+		{"detail", ev.Detail},
+	} {
+		if field[1] != "" {
+			values = append(values, field[0], field[1])
+		}
+	}
+	return a.Store.Conn.XAdd(ctx, &redis.XAddArgs{
+		Stream: a.stream(),
+		MaxLen: a.MaxLen,
+		Approx: true,
+		Values: values,
+	}).Err()
+}
+
+// RecordRequest is Record for an event caused by r, whose remote address and user agent are recorded with it
+func (a *AuditLog) RecordRequest(ctx context.Context, r *http.Request, ev AuditEvent) error {
+	if r != nil {
+		ev.RemoteAddr = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			ev.RemoteAddr = host
+		}
+		ev.UserAgent = r.UserAgent()
+	}
+	return a.Record(ctx, ev)
+}
+
+func redactIfSet(id string) string {
+	if id == "" {
+		return ""
+	}
+	return RedactID(id)
+}
+
+// AuditQuery picks the events returned by AuditLog.Query. Zero fields match everything
+type AuditQuery struct {
+	UserID string
+	Types  []string
+	// From and To bound the time of the events, both inclusive
+	From time.Time
+	To   time.Time
+	// Limit is the most events returned. 0 means no limit
+	Limit int
+}
+
+// auditBatch is how many events Query reads from the stream at a time
+const auditBatch = 500
+
+// Query returns the events matching q, oldest first.
+// The stream is read in time order, so the time range is cheap, but matching the user and the types
+// means reading every event in the range: narrow it down with From and To on large logs
+func (a *AuditLog) Query(ctx context.Context, q AuditQuery) ([]AuditEvent, error) {
+	start, end := "-", "+"
+	if !q.From.IsZero() {
+		start = strconv.FormatInt(q.From.UnixMilli(), 10)
+	}
+	if !q.To.IsZero() {
+		end = strconv.FormatInt(q.To.UnixMilli(), 10)
+	}
+
+	var events []AuditEvent
+	for {
+		msgs, err := a.Store.Conn.XRangeN(ctx, a.stream(), start, end, auditBatch).Result()
+		if err != nil {
+			return events, err
+		}
+		for _, msg := range msgs {
+			ev := auditEvent(msg)
+			if q.matches(ev) {
+				events = append(events, ev)
+				if q.Limit > 0 && len(events) >= q.Limit {
+					return events, nil
+				}
+			}
+		}
+		if len(msgs) < auditBatch {
+			return events, nil
+		}
+		start = nextStreamID(msgs[len(msgs)-1].ID)
+	}
+}
+
+func (q *AuditQuery) matches(ev AuditEvent) bool {
+	if q.UserID != "" && ev.UserID != q.UserID {
+		return false
+	}
+	if len(q.Types) == 0 {
+		return true
+	}
+	for _, typ := range q.Types {
+		if ev.Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStreamID is the smallest stream ID after id, to continue reading a stream from where a range stopped
+func nextStreamID(id string) string {
+	ms, seq, _ := strings.Cut(id, "-")
+	n, _ := strconv.ParseUint(seq, 10, 64)
+	return fmt.Sprintf("%s-%d", ms, n+1)
+}
+
+func auditEvent(msg redis.XMessage) AuditEvent {
+	field := func(name string) string {
+		s, _ := msg.Values[name].(string)
+		return s
+	}
+	ev := AuditEvent{
+		ID:         msg.ID,
+		Type:       field("type"),
+		Store:      field("store"),
+		Name:       field("name"),
+		SessionID:  field("session"),
+		PreviousID: field("previous"),
+		UserID:     field("user"),
+		RemoteAddr: field("addr"),
+		UserAgent:  field("ua"),
+		Detail:     field("detail"),
+	}
+	if ms, _, ok := strings.Cut(msg.ID, "-"); ok {
+		if n, err := strconv.ParseInt(ms, 10, 64); err == nil {
+			ev.Time = time.UnixMilli(n)
+		}
+	}
+	return ev
+}
+
+// Trim drops the events older than MaxAge, and those beyond MaxLen. Run it periodically.
+// It returns how many events were dropped
+func (a *AuditLog) Trim(ctx context.Context) (int64, error) {
+	var dropped int64
+	if a.MaxAge > 0 {
+		minID := strconv.FormatInt(time.Now().Add(-a.MaxAge).UnixMilli(), 10)
+		n, err := a.Store.Conn.XTrimMinID(ctx, a.stream(), minID).Result()
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	if a.MaxLen > 0 {
+		n, err := a.Store.Conn.XTrimMaxLen(ctx, a.stream(), a.MaxLen).Result()
+		if err != nil {
+			return dropped, err
+		}
+		dropped += n
+	}
+	return dropped, nil
+}
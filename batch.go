@@ -0,0 +1,526 @@
+package webredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// BatchResult is the outcome of one key of a batch operation
+type BatchResult struct {
+	Key string
+	// Status is one of the status codes, e.g. RedisRecordFound or RedisRecordConflict
+	Status int
+	// Version is the version of the record read or written, if it is versioned
+	Version int64
+	Err     error
+}
+
+// failAll gives every key of the batch the same status and error
+func failAll(keys []string, status int, err error) []BatchResult {
+	res := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		res[i] = BatchResult{Key: key, Status: status, Err: err}
+	}
+	return res
+}
+
+// GetMany fetches the values of keys with a single MGET, and decodes each into the pointer at the same index of dests.
+// Values written by SetIfVersion are decoded like GetVersioned does, and have their version in the result.
+// The error is only set when the whole batch failed
+func (rds *RedisStore) GetMany(ctx context.Context, keys []string, dests []interface{}) ([]BatchResult, error) {
+	if len(keys) != len(dests) {
+		err := errors.New("`keys` and `dests` must have the same length")
+		return failAll(keys, RedisInvalidArgsError, err), err
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var vals []interface{}
+	err := rds.Retry.Do(ctx, func() (err error) {
+		vals, err = rds.Conn.MGet(ctx, keys...).Result()
+		return err
+	})
+	if err != nil {
+		return failAll(keys, RedisRecordFetchError, err), err
+	}
+
+	res := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		res[i].Key = key
+		switch {
+		case !isPointer(dests[i]):
+			res[i].Status, res[i].Err = RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+		case vals[i] == nil:
+			res[i].Status, res[i].Err = RedisRecordNotFound, redis.Nil
+		default:
+			text, _ := vals[i].(string)
+			version, err := decodeVersioned([]byte(text), dests[i])
+			if err != nil {
+				res[i].Status, res[i].Err = RedisRecordUnmarshalError, err
+			} else {
+				res[i].Status, res[i].Version = RedisRecordFound, version
+			}
+		}
+	}
+	return res, nil
+}
+
+// HashGetManyVersioned is HashGetVersioned for many hashes at once, in a single pipeline.
+// The fields of each hash are at the same index as its key
+func (rds *RedisStore) HashGetManyVersioned(ctx context.Context, keys []string, fields ...string) ([]map[string]string, []BatchResult, error) {
+	if len(keys) == 0 {
+		return nil, nil, nil
+	}
+	args := append([]string{HashVersionField}, fields...)
+
+	var cmds []redis.Cmder
+	err := rds.Retry.Do(ctx, func() (err error) {
+		cmds, err = rds.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, key := range keys {
+				pipe.HMGet(ctx, key, args...)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil && IsUnavailable(err) {
+		return make([]map[string]string, len(keys)), failAll(keys, RedisRecordFetchError, err), err
+	}
+
+	maps := make([]map[string]string, len(keys))
+	res := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		res[i].Key = key
+		vals, err := cmds[i].(*redis.SliceCmd).Result()
+		if err != nil {
+			res[i].Status, res[i].Err = RedisRecordFetchError, err
+			continue
+		}
+		if vals[0] == nil {
+			res[i].Status, res[i].Err = RedisRecordNotFound, redis.Nil
+			continue
+		}
+		version, err := strconv.ParseInt(vals[0].(string), 10, 64)
+		if err != nil {
+			res[i].Status, res[i].Err = RedisRecordUnmarshalError, err
+			continue
+		}
+		m := make(map[string]string, len(fields))
+		for j, field := range fields {
+			if val, ok := vals[j+1].(string); ok {
+				m[field] = val
+			}
+		}
+		maps[i] = m
+		res[i].Status, res[i].Version = RedisRecordFound, version
+	}
+	return maps, res, nil
+}
+
+// DeleteMany removes keys in a single pipeline, using UNLINK so redis frees their memory in the background.
+// Each result is RedisRecordFound if the key was removed, or RedisRecordNotFound if it did not exist.
+// The error is only set when the whole batch failed
+func (rds *RedisStore) DeleteMany(ctx context.Context, keys []string) ([]BatchResult, error) {
+	return rds.pipelineEach(ctx, keys, RedisRecordFound, func(pipe redis.Pipeliner, key string) redis.Cmder {
+		return pipe.Unlink(ctx, key)
+	})
+}
+
+// TouchMany sets the expiry of keys, in seconds, in a single pipeline. An expiryDuration of 0 makes them never expire.
+// Each result is RedisRecordUpdated, or RedisRecordNotFound if the key did not exist.
+// The error is only set when the whole batch failed
+func (rds *RedisStore) TouchMany(ctx context.Context, keys []string, expiryDuration int64) ([]BatchResult, error) {
+	return rds.pipelineEach(ctx, keys, RedisRecordUpdated, func(pipe redis.Pipeliner, key string) redis.Cmder {
+		if expiryDuration > 0 {
+			return pipe.Expire(ctx, key, time.Duration(expiryDuration)*time.Second)
+		}
+		// PERSIST also answers 0 for keys which exist without an expiry
+		pipe.Persist(ctx, key)
+		return pipe.Exists(ctx, key)
+	})
+}
+
+// pipelineEach sends the command made by fn for each key in a single pipeline. The command returned by fn
+// tells the outcome for its key: a true or positive reply gives the key the status done, otherwise RedisRecordNotFound
+func (rds *RedisStore) pipelineEach(ctx context.Context, keys []string, done int, fn func(pipe redis.Pipeliner, key string) redis.Cmder) ([]BatchResult, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	outcomes := make([]redis.Cmder, len(keys))
+	_, err := rds.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			outcomes[i] = fn(pipe, key)
+		}
+		return nil
+	})
+	if err != nil && IsUnavailable(err) {
+		return failAll(keys, RedisRecordUpdateError, err), err
+	}
+
+	res := make([]BatchResult, len(keys))
+	for i, key := range keys {
+		res[i] = BatchResult{Key: key, Status: RedisRecordNotFound}
+		var ok bool
+		switch cmd := outcomes[i].(type) {
+		case *redis.IntCmd:
+			ok = cmd.Val() > 0
+		case *redis.BoolCmd:
+			ok = cmd.Val()
+		}
+		if err := outcomes[i].Err(); err != nil {
+			res[i].Status, res[i].Err = RedisRecordUpdateError, err
+		} else if ok {
+			res[i].Status = done
+		}
+	}
+	return res, nil
+}
+
+// VersionedWrite is a value saved by SetManyIfVersion
+type VersionedWrite struct {
+	Key   string
+	Value interface{}
+	// Version is the version the record must still have in redis, as for SetIfVersion
+	Version int64
+	// ExpiryDuration is in seconds. 0 means the record never expires
+	ExpiryDuration int64
+}
+
+// HashWrite is a change of a hash made by HashSetManyIfVersion
+type HashWrite struct {
+	Key string
+	// Version is the version the hash must still have in redis, as for HashSetIfVersion
+	Version int64
+	Set     map[string]string
+	Del     []string
+	// ExpiryDuration is in seconds. 0 means the hash never expires
+	ExpiryDuration int64
+}
+
+var (
+	// setIfVersionScript is SetIfVersion in a script, so that many can be pipelined.
+	// A value which is not a versioned record has version 0, as in decodeVersioned
+	setIfVersionScript = redis.NewScript(`
+local current = 0
+local value = redis.call('GET', KEYS[1])
+if value then
+	local ok, rec = pcall(cjson.decode, value)
+	if ok and type(rec) == 'table' and rec.data ~= nil and tonumber(rec['webredis:version']) then
+		current = tonumber(rec['webredis:version'])
+	end
+end
+if current ~= tonumber(ARGV[2]) then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[3])
+else
+	redis.call('SET', KEYS[1], ARGV[1])
+end
+return 1`)
+	// hashSetIfVersionScript is HashSetIfVersion in a script, so that many can be pipelined.
+	// ARGV holds the version field, the version, the expiry, the number of fields to delete, those fields, then the pairs to set
+	hashSetIfVersionScript = redis.NewScript(`
+local current = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0') or 0
+if current ~= tonumber(ARGV[2]) then
+	return 0
+end
+local del = tonumber(ARGV[4])
+if del > 0 then
+	redis.call('HDEL', KEYS[1], unpack(ARGV, 5, 4 + del))
+end
+redis.call('HSET', KEYS[1], unpack(ARGV, 5 + del))
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1`)
+)
+
+// SetManyIfVersion is SetIfVersion for many records at once, in a single pipeline.
+// Each result is RedisRecordUpdated with the new version, RedisRecordConflict with ErrConflict,
+// or the error which kept the record from being saved. The error is only set when the whole batch failed
+func (rds *RedisStore) SetManyIfVersion(ctx context.Context, writes []VersionedWrite) ([]BatchResult, error) {
+	keys := make([]string, len(writes))
+	args := make([][]interface{}, len(writes))
+	res := make([]BatchResult, len(writes))
+	for i, wr := range writes {
+		keys[i] = wr.Key
+		data, err := json.Marshal(wr.Value)
+		if err == nil {
+			var p []byte
+			p, err = marshalVersioned(wr.Version+1, data)
+			args[i] = []interface{}{p, wr.Version, wr.ExpiryDuration}
+		}
+		if err != nil {
+			res[i].Status, res[i].Err = RedisMarshalUpdateError, err
+		}
+	}
+	return rds.runVersioned(ctx, setIfVersionScript, keys, args, versionsOf(writes), res)
+}
+
+// HashSetManyIfVersion is HashSetIfVersion for many hashes at once, in a single pipeline.
+// Results are those of SetManyIfVersion
+func (rds *RedisStore) HashSetManyIfVersion(ctx context.Context, writes []HashWrite) ([]BatchResult, error) {
+	keys := make([]string, len(writes))
+	args := make([][]interface{}, len(writes))
+	versions := make([]int64, len(writes))
+	for i, wr := range writes {
+		keys[i], versions[i] = wr.Key, wr.Version
+		a := make([]interface{}, 0, 4+len(wr.Del)+2*len(wr.Set)+2)
+		a = append(a, HashVersionField, wr.Version, wr.ExpiryDuration, len(wr.Del))
+		for _, field := range wr.Del {
+			a = append(a, field)
+		}
+		for field, val := range wr.Set {
+			a = append(a, field, val)
+		}
+		args[i] = append(a, HashVersionField, wr.Version+1)
+	}
+	return rds.runVersioned(ctx, hashSetIfVersionScript, keys, args, versions, make([]BatchResult, len(writes)))
+}
+
+func versionsOf(writes []VersionedWrite) []int64 {
+	versions := make([]int64, len(writes))
+	for i, wr := range writes {
+		versions[i] = wr.Version
+	}
+	return versions
+}
+
+// runVersioned pipelines a compare-and-set script for each key whose result is not set yet.
+// Scripts redis does not have cached yet are loaded, and the keys they were sent for are tried again
+func (rds *RedisStore) runVersioned(ctx context.Context, script *redis.Script, keys []string, args [][]interface{}, versions []int64, res []BatchResult) ([]BatchResult, error) {
+	pending := make([]int, 0, len(keys))
+	for i, key := range keys {
+		res[i].Key = key
+		if res[i].Status == 0 {
+			pending = append(pending, i)
+		}
+	}
+
+	for loaded := false; len(pending) > 0; loaded = true {
+		cmds := make([]*redis.Cmd, len(pending))
+		_, err := rds.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for j, i := range pending {
+				cmds[j] = script.EvalSha(ctx, pipe, []string{keys[i]}, args[i]...)
+			}
+			return nil
+		})
+		if err != nil && IsUnavailable(err) {
+			for _, i := range pending {
+				res[i].Status, res[i].Err = RedisRecordUpdateError, err
+			}
+			return res, err
+		}
+
+		var retry []int
+		for j, i := range pending {
+			n, err := cmds[j].Int64()
+			switch {
+			case err != nil && !loaded && strings.HasPrefix(err.Error(), "NOSCRIPT"):
+				retry = append(retry, i)
+			case err != nil:
+				res[i].Status, res[i].Err = RedisRecordUpdateError, err
+			case n == 0:
+				res[i].Status, res[i].Err = RedisRecordConflict, ErrConflict
+			default:
+				res[i].Status, res[i].Version = RedisRecordUpdated, versions[i]+1
+			}
+		}
+		if len(retry) > 0 {
+			if err := script.Load(ctx, rds.Conn).Err(); err != nil {
+				for _, i := range retry {
+					res[i].Status, res[i].Err = RedisRecordUpdateError, err
+				}
+				return res, nil
+			}
+		}
+		pending = retry
+	}
+	return res, nil
+}
+
+// GetMany loads the sessions saved under ids in a single round trip, e.g. for an admin screen.
+// The session at each index is nil unless the result at the same index is RedisRecordFound.
+// Loading sessions this way is not an access: it fires no hooks and does not touch the Index
+func (rts *RedisTokenStore) GetMany(ctx context.Context, ids []string) ([]*Session, []BatchResult, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "GetMany", AttrBackend.String("string"))
+	texts := make([]string, len(ids))
+	dests := make([]interface{}, len(ids))
+	for i := range texts {
+		dests[i] = &texts[i]
+	}
+	sessions := make([]*Session, len(ids))
+	res, err := rts.RedisClient.GetMany(ctx, ids, dests)
+	for i := range res {
+		if res[i].Status != RedisRecordFound {
+			continue
+		}
+		if sessions[i], res[i].Err = rts.fromStored(ctx, texts[i], res[i].Version); res[i].Err != nil {
+			sessions[i], res[i].Status = nil, RedisRecordUnmarshalError
+		}
+	}
+	done(err)
+	return sessions, res, err
+}
+
+// DeleteMany deletes the sessions saved under ids in a single round trip, e.g. to revoke all sessions of a user.
+// The result of a session which was deleted is RedisRecordFound. Each deleted session is recorded as revoked
+// in the Audit log and fires SessionDestroyed; their name and user are only known if the store has an Index
+func (rts *RedisTokenStore) DeleteMany(ctx context.Context, ids []string) ([]BatchResult, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "DeleteMany")
+	res, err := rts.RedisClient.DeleteMany(ctx, ids)
+	if err == nil {
+		removed := make(map[string]SessionInfo)
+		if rts.Index != nil {
+			infos, err := rts.Index.RemoveMany(ctx, ids)
+			for _, info := range infos {
+				removed[info.ID] = info
+			}
+			if err != nil {
+				LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, "", ids[0], err)
+			}
+		}
+		var deleted []*Session
+		var deletedIDs []string
+		for _, r := range res {
+			if r.Status == RedisRecordFound {
+				info := removed[r.Key]
+				s := &Session{ID: r.Key, Name: info.Name, UserID: info.UserID}
+				rts.audit(ctx, nil, AuditRevoked, s, "", "")
+				rts.fire(ctx, SessionDestroyed, s, "")
+				deleted = append(deleted, s)
+				deletedIDs = append(deletedIDs, s.ID)
+			}
+		}
+		rts.notify(ctx, SessionDestroyed, "", deleted...)
+		rts.revokeJWTs(ctx, "", deletedIDs...)
+	}
+	done(err)
+	return res, err
+}
+
+// TouchMany renews the sessions in redis for another MaxAge, in as many round trips as there are distinct MaxAges,
+// and records the access in the Index. The result of a session which no longer exists is RedisRecordNotFound
+func (rts *RedisTokenStore) TouchMany(ctx context.Context, sessions []*Session) ([]BatchResult, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "TouchMany")
+	byAge := make(map[int][]int)
+	for i, s := range sessions {
+		byAge[s.MaxAge] = append(byAge[s.MaxAge], i)
+	}
+	res := make([]BatchResult, len(sessions))
+	var err error
+	for age, indexes := range byAge {
+		ids := make([]string, len(indexes))
+		for j, i := range indexes {
+			ids[j] = sessions[i].ID
+		}
+		var touched []BatchResult
+		touched, err = rts.RedisClient.TouchMany(ctx, ids, int64(age))
+		for j, i := range indexes {
+			res[i] = touched[j]
+		}
+		if err != nil {
+			break
+		}
+	}
+	for i, s := range sessions {
+		if res[i].Status == 0 {
+			// left out after a group failed as a whole
+			res[i] = BatchResult{Key: s.ID, Status: RedisRecordUpdateError, Err: err}
+		}
+	}
+
+	var infos []SessionInfo
+	for i, s := range sessions {
+		if res[i].Status == RedisRecordUpdated {
+			infos = append(infos, s.info())
+		}
+	}
+	rts.touchMany(ctx, infos)
+	done(err)
+	return res, err
+}
+
+// SaveMany saves the sessions in a single round trip, e.g. from a bulk job. No header is written.
+// Sessions which were saved by someone else since they were loaded are not merged with OnConflict:
+// their result is RedisRecordConflict, and they can be loaded, changed and saved again one by one.
+// The result of each saved session is RedisRecordUpdated, and its Version is updated
+func (rts *RedisTokenStore) SaveMany(ctx context.Context, sessions []*Session) ([]BatchResult, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "SaveMany", AttrBackend.String("string"))
+	res := make([]BatchResult, len(sessions))
+	created := make([]bool, len(sessions))
+	var indexes []int
+	var writes []VersionedWrite
+	for i, s := range sessions {
+		res[i].Key = s.ID
+		created[i] = s.IsNew
+		if s.Degraded {
+			if err := rts.restoreVersion(ctx, s); err != nil {
+				res[i].Status, res[i].Err = RedisRecordUpdateError, err
+				continue
+			}
+		}
+		tkn, err := rts.token(s)
+		if err != nil {
+			res[i].Status, res[i].Err = RedisMarshalUpdateError, err
+			continue
+		}
+		writes = append(writes, VersionedWrite{Key: s.ID, Value: tkn, Version: s.Version, ExpiryDuration: int64(s.MaxAge)})
+		indexes = append(indexes, i)
+	}
+
+	written, err := rts.RedisClient.SetManyIfVersion(ctx, writes)
+	var infos []SessionInfo
+	for j, i := range indexes {
+		res[i] = written[j]
+		s := sessions[i]
+		if res[i].Status != RedisRecordUpdated {
+			LogSave(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, res[i].Err)
+			continue
+		}
+		rts.RedisClient.ObservePayload(ctx, tokenStoreName, "save", len(writes[j].Value.(string)))
+		s.Version, s.Degraded, s.IsNew = res[i].Version, false, false
+		infos = append(infos, s.info())
+	}
+	rts.touchMany(ctx, infos)
+	for _, i := range indexes {
+		if res[i].Status == RedisRecordUpdated {
+			if created[i] {
+				rts.audit(ctx, nil, AuditCreated, sessions[i], "", "")
+			}
+			rts.fire(ctx, SessionSaved, sessions[i], "")
+		}
+	}
+	done(err)
+	return res, err
+}
+
+// info describes the session as it is recorded in the Index
+func (s *Session) info() SessionInfo {
+	return SessionInfo{
+		ID:        s.ID,
+		Name:      s.Name,
+		UserID:    s.UserID,
+		CreatedAt: time.Unix(s.CreatedAt, 0),
+		TTL:       time.Duration(s.MaxAge) * time.Second,
+	}
+}
+
+// touchMany records the access to the sessions in the Index, if there is one
+func (rts *RedisTokenStore) touchMany(ctx context.Context, infos []SessionInfo) {
+	if rts.Index == nil || len(infos) == 0 {
+		return
+	}
+	err := rts.Index.TouchMany(ctx, infos)
+	LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, infos[0].Name, infos[0].ID, err)
+}
@@ -0,0 +1,227 @@
+package webredis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCircuitOpen is returned for the commands which are not sent to redis because the circuit breaker is open
+var ErrCircuitOpen = errors.New("redis is unavailable: the circuit breaker is open")
+
+// BreakerState is the state of a CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed means commands are sent to redis
+	BreakerClosed BreakerState = iota
+	// BreakerOpen means commands fail at once with ErrCircuitOpen, while redis is probed in the background
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	if s == BreakerOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// CircuitBreaker stops sending commands to redis after it failed to answer a number of them in a row,
+// so requests fail fast instead of each waiting for redis to time out. While it is open, redis is pinged
+// every ProbeInterval, and the breaker closes again as soon as redis answers.
+// Only failures to reach redis count: errors replied by redis, such as redis.Nil, do not
+type CircuitBreaker struct {
+	// FailureThreshold is how many commands in a row must fail to open the breaker. Defaults to 5
+	FailureThreshold int
+	// ProbeInterval is how often redis is pinged while the breaker is open. Defaults to 1 second
+	ProbeInterval time.Duration
+	// OnStateChange, if set, is called whenever the breaker opens or closes
+	OnStateChange func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+}
+
+// NewCircuitBreaker creates a CircuitBreaker which opens after threshold failures in a row,
+// and probes redis every probeInterval while open
+func NewCircuitBreaker(threshold int, probeInterval time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{FailureThreshold: threshold, ProbeInterval: probeInterval}
+}
+
+// State returns whether the breaker is open or closed. A nil breaker is always closed
+func (b *CircuitBreaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) threshold() int {
+	if b.FailureThreshold <= 0 {
+		return 5
+	}
+	return b.FailureThreshold
+}
+
+func (b *CircuitBreaker) probeInterval() time.Duration {
+	if b.ProbeInterval <= 0 {
+		return time.Second
+	}
+	return b.ProbeInterval
+}
+
+// record counts the outcome of a command, and tells if it made the breaker open
+func (b *CircuitBreaker) record(err error) bool {
+	if err == ErrCircuitOpen {
+		// the command was not sent, so it tells nothing about redis
+		return false
+	}
+	b.mu.Lock()
+	if !IsUnavailable(err) {
+		b.failures = 0
+		b.mu.Unlock()
+		return false
+	}
+	b.failures++
+	if b.state == BreakerOpen || b.failures < b.threshold() {
+		b.mu.Unlock()
+		return false
+	}
+	b.state = BreakerOpen
+	b.mu.Unlock()
+	b.changed(BreakerClosed, BreakerOpen)
+	return true
+}
+
+func (b *CircuitBreaker) close() {
+	b.mu.Lock()
+	b.failures = 0
+	if b.state == BreakerClosed {
+		b.mu.Unlock()
+		return
+	}
+	b.state = BreakerClosed
+	b.mu.Unlock()
+	b.changed(BreakerOpen, BreakerClosed)
+}
+
+func (b *CircuitBreaker) changed(from, to BreakerState) {
+	if b.OnStateChange != nil {
+		b.OnStateChange(from, to)
+	}
+}
+
+// IsUnavailable tells if err means that redis could not be reached, rather than being an answer of redis.
+// ErrCircuitOpen is one of them
+func IsUnavailable(err error) bool {
+	if err == nil || err == redis.Nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var replied redis.Error
+	return !errors.As(err, &replied)
+}
+
+// probing marks the context of the pings sent by the breaker, which are let through while it is open
+type probing struct{}
+
+// probe pings redis until it answers, then closes the breaker
+func (b *CircuitBreaker) probe(rds *RedisStore) {
+	for b.State() == BreakerOpen {
+		time.Sleep(b.probeInterval())
+		ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), probing{}, true), b.probeInterval())
+		err := rds.Conn.Ping(ctx).Err()
+		cancel()
+		if err == nil {
+			b.close()
+		}
+	}
+}
+
+// EnableCircuitBreaker puts the breaker in front of every command rds sends to redis.
+// Its state changes are logged by the Logger of rds. Calling it again replaces b
+func (rds *RedisStore) EnableCircuitBreaker(b *CircuitBreaker) {
+	rds.Breaker = b
+	if !rds.breakerHooked {
+		rds.breakerHooked = true
+		rds.Conn.AddHook(breakerHook{rds: rds})
+	}
+}
+
+// breakerHook keeps the commands of a redis.Client from being sent while the Breaker of rds is open
+type breakerHook struct {
+	rds *RedisStore
+}
+
+func (h breakerHook) allow(ctx context.Context) error {
+	if ctx.Value(probing{}) != nil || h.rds.Breaker.State() == BreakerClosed {
+		return nil
+	}
+	return ErrCircuitOpen
+}
+
+func (h breakerHook) after(ctx context.Context, err error) {
+	b := h.rds.Breaker
+	if ctx.Value(probing{}) != nil || b == nil {
+		return
+	}
+	if b.record(err) {
+		h.rds.LoggerOrNop().LogAttrs(ctx, h.rds.LogLevelsOrDefault().RedisError,
+			"webredis: redis is unavailable, the circuit breaker opened", slog.String("cause", err.Error()))
+		go func() {
+			b.probe(h.rds)
+			h.rds.LoggerOrNop().LogAttrs(context.Background(), slog.LevelInfo,
+				"webredis: redis is available again, the circuit breaker closed")
+		}()
+	}
+}
+
+func (h breakerHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, h.allow(ctx)
+}
+
+func (h breakerHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.after(ctx, cmd.Err())
+	return nil
+}
+
+func (h breakerHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, h.allow(ctx)
+}
+
+func (h breakerHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if IsUnavailable(cmd.Err()) {
+			err = cmd.Err()
+			break
+		}
+	}
+	h.after(ctx, err)
+	return nil
+}
+
+// RequireRedis answers 503 Service Unavailable, with a Retry-After header, to the requests which come
+// while the circuit breaker of rds is open, instead of passing them to next
+func (rds *RedisStore) RequireRedis(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rds.Breaker.State() == BreakerOpen {
+			retry := int(rds.Breaker.probeInterval() / time.Second)
+			if retry < 1 {
+				retry = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
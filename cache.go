@@ -0,0 +1,238 @@
+package webredis
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrCacheMiss is returned by Cache.Get for keys which are not in the cache
+var ErrCacheMiss = errors.New("the key is not in the cache")
+
+// ErrNotFound is returned by the loaders of Cache.GetOrLoad for values which do not exist.
+// The Cache remembers it for NegativeTTL, and returns it without calling the loader meanwhile
+var ErrNotFound = errors.New("the value does not exist")
+
+// Codec encodes the values of a Cache for redis
+type Codec[T any] interface {
+	Marshal(v T) ([]byte, error)
+	Unmarshal(data []byte) (T, error)
+}
+
+// JSONCodec encodes values as JSON. It is the default Codec of a Cache
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Marshal(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec encodes values with encoding/gob, which is more compact than JSON and keeps Go types such as integer map keys
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Marshal(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+
+func (GobCodec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// StringCodec keeps strings as they are, rather than quoted as JSON
+type StringCodec struct{}
+
+func (StringCodec) Marshal(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Unmarshal(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// The first byte of the entries of a Cache tells a value from a remembered ErrNotFound
+const (
+	cacheValue    = 'v'
+	cacheNotFound = 'n'
+)
+
+// Cache is a typed cache of values in redis, e.g. for the state of an application shared by its instances.
+// The zero value is not usable: create it with NewCache
+type Cache[T any] struct {
+	Store *RedisStore
+	// Prefix is prepended to the keys of the cache in redis, so several caches can share a database
+	Prefix string
+	// TTL is how long Set and GetOrLoad keep values. 0 keeps them until they are deleted
+	TTL time.Duration
+	// NegativeTTL is how long GetOrLoad remembers that its loader returned ErrNotFound. 0 does not remember it
+	NegativeTTL time.Duration
+	// Codec encodes the values. Defaults to JSONCodec
+	Codec Codec[T]
+
+	mu    sync.Mutex
+	calls map[string]*cacheCall[T]
+}
+
+// cacheCall is a load of GetOrLoad, which the callers asking for the same key at the same time wait for
+type cacheCall[T any] struct {
+	done chan struct{}
+	val  T
+	err  error
+}
+
+// NewCache creates a Cache keeping its values under prefix for ttl
+func NewCache[T any](store *RedisStore, prefix string, ttl time.Duration) *Cache[T] {
+	return &Cache[T]{Store: store, Prefix: prefix, TTL: ttl}
+}
+
+func (c *Cache[T]) codec() Codec[T] {
+	if c.Codec == nil {
+		return JSONCodec[T]{}
+	}
+	return c.Codec
+}
+
+// Get returns the value cached under key. It returns ErrCacheMiss if there is none,
+// and ErrNotFound if GetOrLoad remembers that the value does not exist
+func (c *Cache[T]) Get(ctx context.Context, key string) (T, error) {
+	var zero T
+	var data []byte
+	err := c.Store.Retry.Do(ctx, func() (err error) {
+		data, err = c.Store.Conn.Get(ctx, c.Prefix+key).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return zero, ErrCacheMiss
+	} else if err != nil {
+		return zero, err
+	}
+	if len(data) == 0 {
+		return zero, ErrCacheMiss
+	}
+	switch data[0] {
+	case cacheNotFound:
+		return zero, ErrNotFound
+	case cacheValue:
+		return c.codec().Unmarshal(data[1:])
+	}
+	return zero, ErrCacheMiss
+}
+
+// Set caches the value under key for TTL
+func (c *Cache[T]) Set(ctx context.Context, key string, v T) error {
+	return c.SetTTL(ctx, key, v, c.TTL)
+}
+
+// SetTTL caches the value under key for ttl. A ttl of 0 keeps it until it is deleted
+func (c *Cache[T]) SetTTL(ctx context.Context, key string, v T, ttl time.Duration) error {
+	data, err := c.codec().Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.put(ctx, key, append([]byte{cacheValue}, data...), ttl)
+}
+
+func (c *Cache[T]) put(ctx context.Context, key string, data []byte, ttl time.Duration) error {
+	return c.Store.Retry.Do(ctx, func() error {
+		return c.Store.Conn.Set(ctx, c.Prefix+key, data, ttl).Err()
+	})
+}
+
+// Delete removes the value cached under key, and forgets that it does not exist
+func (c *Cache[T]) Delete(ctx context.Context, key string) error {
+	_, err := c.Store.DeleteContext(ctx, c.Prefix+key)
+	return err
+}
+
+// GetOrLoad returns the value cached under key, or calls load to get it, and caches it for TTL.
+// Callers of the same Cache asking for the same key at the same time share a single call of load.
+// If load returns ErrNotFound, or an error wrapping it, it is remembered for NegativeTTL. Other errors of load are returned,
+// and not cached; so is a panic of load, as an error.
+// If redis cannot be reached, or the cached value cannot be decoded, the value is loaded all the same
+func (c *Cache[T]) GetOrLoad(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	return c.GetOrLoadTTL(ctx, key, func(ctx context.Context) (T, time.Duration, error) {
+		v, err := load(ctx)
+		return v, c.TTL, err
+	})
+}
+
+// GetOrLoadTTL is GetOrLoad with a loader which also tells how long to cache the value it returns
+func (c *Cache[T]) GetOrLoadTTL(ctx context.Context, key string, load func(ctx context.Context) (T, time.Duration, error)) (T, error) {
+	v, err := c.Get(ctx, key)
+	if err == nil || errors.Is(err, ErrNotFound) || errors.Is(err, context.Canceled) {
+		return v, err
+	}
+	// missing, unreadable or undecodable: load it
+
+	c.mu.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]*cacheCall[T])
+	}
+	call, loading := c.calls[key]
+	if !loading {
+		call = &cacheCall[T]{done: make(chan struct{})}
+		c.calls[key] = call
+		// the load goes on for the others waiting for it if this caller gives up
+		go c.load(context.WithoutCancel(ctx), key, call, load)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.val, call.err
+	case <-ctx.Done():
+		var zero T
+		return zero, ctx.Err()
+	}
+}
+
+func (c *Cache[T]) load(ctx context.Context, key string, call *cacheCall[T], load func(ctx context.Context) (T, time.Duration, error)) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	var ttl time.Duration
+	call.val, ttl, call.err = callLoader(ctx, load)
+	var err error
+	switch {
+	case call.err == nil:
+		err = c.SetTTL(ctx, key, call.val, ttl)
+	case errors.Is(call.err, ErrNotFound) && c.NegativeTTL > 0:
+		err = c.put(ctx, key, []byte{cacheNotFound}, c.NegativeTTL)
+	}
+	if err != nil {
+		// the value was loaded all the same
+		c.Store.LoggerOrNop().LogAttrs(ctx, c.Store.LogLevelsOrDefault().RedisError, "webredis: value could not be cached",
+			slog.String("key", c.Prefix+key), slog.String("cause", err.Error()))
+	}
+}
+
+// callLoader calls load, turning a panic into an error: the load runs on its own goroutine,
+// where a panic would bring down the process rather than reach the callers waiting for it
+func callLoader[T any](ctx context.Context, load func(ctx context.Context) (T, time.Duration, error)) (val T, ttl time.Duration, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("webredis: the loader panicked: %v", r)
+		}
+	}()
+	return load(ctx)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+func runList(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	match := fs.String("match", "*", "only list the keys matching this pattern")
+	fs.Parse(args)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tLAYOUT\tVERSION\tTTL")
+	err := c.store.ScanSessionRecords(ctx, *match, func(rec *webredis.SessionRecord) error {
+		ttl := "none"
+		if rec.TTL > 0 {
+			ttl = rec.TTL.Round(time.Second).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", rec.ID, rec.Layout, rec.Version, ttl)
+		return nil
+	})
+	tw.Flush()
+	return err
+}
+
+func runShow(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("show", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: webredis show <id>")
+	}
+
+	rec, doc, err := c.open(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	out := map[string]interface{}{
+		"id":          rec.ID,
+		"layout":      rec.Layout,
+		"version":     rec.Version,
+		"ttl_seconds": int64(rec.TTL / time.Second),
+		"session":     doc,
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
+
+// keyValues collects the repeated -set key=value flags of edit
+type keyValues map[string]interface{}
+
+func (kv keyValues) String() string { return fmt.Sprint(map[string]interface{}(kv)) }
+
+// Set stores the value as JSON if it is valid JSON, and as a string otherwise
+func (kv keyValues) Set(s string) error {
+	key, text, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("%q is not of the form key=value", s)
+	}
+	var val interface{}
+	if json.Unmarshal([]byte(text), &val) != nil {
+		val = text
+	}
+	kv[key] = val
+	return nil
+}
+
+// keyList collects the repeated -unset key flags of edit
+type keyList []string
+
+func (kl *keyList) String() string { return strings.Join(*kl, ",") }
+
+func (kl *keyList) Set(s string) error {
+	*kl = append(*kl, s)
+	return nil
+}
+
+func runEdit(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	set := keyValues{}
+	var unset keyList
+	fs.Var(set, "set", "stores a value, as key=value. The value is parsed as JSON if it can be. May be repeated")
+	fs.Var(&unset, "unset", "deletes the value stored under key. May be repeated")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return errors.New("usage: webredis edit [-set key=value]... [-unset key]... <id>")
+	}
+
+	rec, doc, err := c.open(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	values, _ := doc["value"].(map[string]interface{})
+	if values == nil {
+		values = make(map[string]interface{})
+	}
+	for key, val := range set {
+		values[key] = val
+	}
+	for _, key := range unset {
+		delete(values, key)
+	}
+	doc["value"] = values
+
+	if err := write(ctx, c.store, rec, c.key, doc); err != nil {
+		return err
+	}
+	fmt.Printf("saved %s\n", rec.ID)
+	return nil
+}
+
+func runDelete(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		return errors.New("usage: webredis delete <id>...")
+	}
+
+	for _, id := range fs.Args() {
+		n, err := c.store.DeleteContext(ctx, id)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Printf("%s not found\n", id)
+		} else {
+			fmt.Printf("deleted %s\n", id)
+		}
+	}
+	return nil
+}
+
+func runRekey(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ExitOnError)
+	newKey := fs.String("new-key", "", "the 32 byte key to re-encrypt the sessions with")
+	match := fs.String("match", "*", "only re-encrypt the sessions whose keys match this pattern")
+	fs.Parse(args)
+	if *newKey == "" || c.key == "" {
+		return errors.New("rekey needs both -key and -new-key")
+	}
+
+	done, failed := 0, 0
+	err := c.store.ScanSessionRecords(ctx, *match, func(rec *webredis.SessionRecord) error {
+		doc, err := decrypt(rec, c.key)
+		if err == nil {
+			err = write(ctx, c.store, rec, *newKey, doc)
+		}
+		if err != nil {
+			// sessions which cannot be decrypted, or which were saved concurrently, are reported and skipped
+			fmt.Fprintf(os.Stderr, "%s: %v\n", rec.ID, err)
+			failed++
+			return nil
+		}
+		done++
+		return nil
+	})
+	fmt.Printf("re-encrypted %d sessions, %d failed\n", done, failed)
+	return err
+}
+
+func runExport(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	match := fs.String("match", "*", "only export the sessions whose keys match this pattern")
+	out := fs.String("o", "-", "the file to write to, - for stdout")
+	resume := fs.Bool("resume", false, "continue the interrupted export in the file given by -o, instead of starting over")
+	fs.Parse(args)
+
+	var cursor uint64
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+		if *resume {
+			f, err := os.Open(*out)
+			if err != nil {
+				return err
+			}
+			point, err := webredis.ResumeCursor(f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			if point.Complete {
+				return fmt.Errorf("the export in %s is complete", *out)
+			}
+			if err := os.Truncate(*out, point.Offset); err != nil {
+				return err
+			}
+			cursor = point.Cursor
+			flags = os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(*out, flags, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	} else if *resume {
+		return errors.New("-resume needs -o")
+	}
+
+	n := 0
+	cursor, err := c.store.ExportSessionRecords(ctx, w, webredis.ExportOptions{
+		Match:  *match,
+		Cursor: cursor,
+		Accept: func(rec *webredis.SessionRecord) bool {
+			n++
+			return true
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("exported %d sessions, stopped at cursor %d: %w", n, cursor, err)
+	}
+	fmt.Fprintf(os.Stderr, "exported %d sessions\n", n)
+	return nil
+}
+
+func runImport(ctx context.Context, c *cli, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	in := fs.String("i", "-", "the file to read from, - for stdin")
+	replace := fs.Bool("replace", false, "overwrite sessions which already exist")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, skipped, err := c.store.ImportSessionRecords(ctx, r, webredis.ImportOptions{Replace: *replace})
+	fmt.Fprintf(os.Stderr, "imported %d sessions, skipped %d which already exist or have expired\n", imported, skipped)
+	return err
+}
+
+// open fetches and decrypts the session saved under id
+func (c *cli) open(ctx context.Context, id string) (*webredis.SessionRecord, map[string]interface{}, error) {
+	if c.key == "" {
+		return nil, nil, errors.New("the sessions cannot be decrypted without -key")
+	}
+	redisStat, rec, err := c.store.ReadSessionRecord(ctx, id)
+	if redisStat == webredis.RedisRecordNotFound {
+		return nil, nil, fmt.Errorf("%s not found", id)
+	} else if err != nil {
+		return nil, nil, err
+	}
+	doc, err := decrypt(rec, c.key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s could not be decrypted: %w", id, err)
+	}
+	return rec, doc, nil
+}
@@ -0,0 +1,111 @@
+// Command webredis inspects and manages the sessions which webredis keeps in redis.
+//
+// Usage:
+//
+//	webredis [global flags] <command> [command flags] [arguments]
+//
+// The global flags are:
+//
+//	-addr      address of the redis server (default $WEBREDIS_ADDR, or 127.0.0.1:6379)
+//	-password  password of the redis server (default $WEBREDIS_PASSWORD)
+//	-db        redis database (default $WEBREDIS_DB, or 0)
+//	-key       the 32 byte key the sessions are encrypted with (default $WEBREDIS_KEY)
+//
+// The commands are:
+//
+//	list    [-match pattern]                      lists the session keys with their TTLs
+//	show    <id>                                  decrypts a session and prints it as JSON
+//	edit    [-set key=value]... [-unset key]... <id>  changes the values of a session
+//	delete  <id>...                               deletes sessions
+//	rekey   -new-key key [-match pattern]         re-encrypts all sessions under a new key
+//	export  [-match pattern] [-o file]            writes sessions as JSON lines, still encrypted
+//	import  [-i file] [-replace]                  restores sessions written by export
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/go-redis/redis/v8"
+)
+
+type command struct {
+	run   func(ctx context.Context, c *cli, args []string) error
+	usage string
+}
+
+var commands = map[string]command{
+	"list":   {runList, "list [-match pattern]"},
+	"show":   {runShow, "show <id>"},
+	"edit":   {runEdit, "edit [-set key=value]... [-unset key]... <id>"},
+	"delete": {runDelete, "delete <id>..."},
+	"rekey":  {runRekey, "rekey -new-key key [-match pattern]"},
+	"export": {runExport, "export [-match pattern] [-o file]"},
+	"import": {runImport, "import [-i file] [-replace]"},
+}
+
+// cli holds what all commands share
+type cli struct {
+	store *webredis.RedisStore
+	key   string
+}
+
+func main() {
+	global := flag.NewFlagSet("webredis", flag.ExitOnError)
+	addr := global.String("addr", env("WEBREDIS_ADDR", "127.0.0.1:6379"), "address of the redis server")
+	password := global.String("password", os.Getenv("WEBREDIS_PASSWORD"), "password of the redis server")
+	db := global.Int("db", envInt("WEBREDIS_DB", 0), "redis database")
+	key := global.String("key", os.Getenv("WEBREDIS_KEY"), "the 32 byte key the sessions are encrypted with")
+	global.Usage = usage(global)
+	global.Parse(os.Args[1:])
+
+	if global.NArg() == 0 {
+		global.Usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[global.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "webredis: unknown command %q\n", global.Arg(0))
+		global.Usage()
+		os.Exit(2)
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: *addr, Password: *password, DB: *db})
+	c := &cli{store: &webredis.RedisStore{Conn: client}, key: *key}
+	defer c.store.Close()
+
+	if err := cmd.run(context.Background(), c, global.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "webredis:", err)
+		os.Exit(1)
+	}
+}
+
+func usage(global *flag.FlagSet) func() {
+	return func() {
+		fmt.Fprintln(os.Stderr, "usage: webredis [global flags] <command> [command flags] [arguments]")
+		fmt.Fprintln(os.Stderr, "\nglobal flags:")
+		global.PrintDefaults()
+		fmt.Fprintln(os.Stderr, "\ncommands:")
+		for _, name := range []string{"list", "show", "edit", "delete", "rekey", "export", "import"} {
+			fmt.Fprintln(os.Stderr, "  "+commands[name].usage)
+		}
+	}
+}
+
+func env(name string, def string) string {
+	if val := os.Getenv(name); val != "" {
+		return val
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	if val, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return val
+	}
+	return def
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/gbenroscience/webredis/utils"
+)
+
+// The hash fields used by sessions saved with sessions.LayoutHash
+const (
+	metaField   = "_meta"
+	valuePrefix = "v:"
+)
+
+// decrypt returns the decrypted session as a JSON document
+func decrypt(rec *webredis.SessionRecord, key string) (map[string]interface{}, error) {
+	k, err := utils.NewKryptik(key, utils.ModeCBC)
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]interface{})
+	if err := decryptJSON(k, rec.EncryptedMeta(), &doc); err != nil {
+		return nil, err
+	}
+	if rec.Layout == "string" {
+		return doc, nil
+	}
+
+	values := make(map[string]interface{})
+	for field, text := range rec.Fields {
+		if !strings.HasPrefix(field, valuePrefix) {
+			continue
+		}
+		var val interface{}
+		if err := decryptJSON(k, text, &val); err != nil {
+			return nil, fmt.Errorf("value %q: %w", strings.TrimPrefix(field, valuePrefix), err)
+		}
+		values[strings.TrimPrefix(field, valuePrefix)] = val
+	}
+	doc["value"] = values
+	return doc, nil
+}
+
+func decryptJSON(k *utils.Kryptik, text string, dest interface{}) error {
+	jsn, err := k.Decrypt(text)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(jsn), dest)
+}
+
+// write encrypts doc with key and saves it in place of the record, keeping its layout and TTL.
+// It fails with webredis.ErrConflict if the session was saved by someone else since it was read
+func write(ctx context.Context, rds *webredis.RedisStore, rec *webredis.SessionRecord, key string, doc map[string]interface{}) error {
+	k, err := utils.NewKryptik(key, utils.ModeCBC)
+	if err != nil {
+		return err
+	}
+	if rec.Layout == "string" {
+		text, err := k.Encrypt(utils.Stringify(doc))
+		if err != nil {
+			return err
+		}
+		_, _, err = rds.SetIfVersionContext(ctx, rec.ID, text, rec.Version, rec.ExpirySecs())
+		return err
+	}
+
+	meta := make(map[string]interface{}, len(doc))
+	for name, val := range doc {
+		meta[name] = val
+	}
+	values, _ := doc["value"].(map[string]interface{})
+	meta["value"] = nil
+
+	set := make(map[string]string, len(values)+1)
+	if set[metaField], err = k.Encrypt(utils.Stringify(meta)); err != nil {
+		return err
+	}
+	for name, val := range values {
+		if set[valuePrefix+name], err = k.Encrypt(utils.Stringify(val)); err != nil {
+			return err
+		}
+	}
+	var del []string
+	for field := range rec.Fields {
+		if _, ok := set[field]; !ok && strings.HasPrefix(field, valuePrefix) {
+			del = append(del, field)
+		}
+	}
+	_, _, err = rds.HashSetIfVersionContext(ctx, rec.ID, rec.Version, set, del, rec.ExpirySecs())
+	return err
+}
@@ -20,4 +20,7 @@ const (
 
 	// The user supplied an invalid interface to decode the redis record into
 	RedisInvalidArgsError = 8
+
+	// The record was changed in redis after it was read, so it was not updated
+	RedisRecordConflict = 9
 )
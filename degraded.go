@@ -0,0 +1,159 @@
+package webredis
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DegradedMode is what a session store does when redis is unavailable, e.g. while its circuit breaker is open
+type DegradedMode int
+
+const (
+	// DegradeNewSession hands out a new, empty session in place of the one which could not be loaded. This is the default
+	DegradeNewSession DegradedMode = iota
+	// DegradeFailClosed makes Get and Save return the error of redis, e.g. ErrCircuitOpen, so the request can be refused.
+	// See RedisStore.RequireRedis
+	DegradeFailClosed
+	// DegradeStateless keeps sessions which cannot be saved in redis in the cookie (or header) itself, encrypted and signed,
+	// and flags them as Degraded. Such cookies are only accepted while the circuit breaker of the store is open, so it needs
+	// one (see EnableCircuitBreaker): once redis is back, a new session is handed out in their place.
+	// Sessions which were saved in redis before it became unavailable cannot be loaded until it is back,
+	// so a new session is handed out in their place
+	DegradeStateless
+)
+
+// StatelessPrefix starts the cookie and header values which hold a whole session instead of its ID
+const StatelessPrefix = "s."
+
+// MaxStatelessSize is the largest cookie or header value written for a stateless session. Browsers keep cookies up to 4096 bytes
+const MaxStatelessSize = 4000
+
+// StatelessTTL is how long the stateless value of a session which does not expire is accepted
+const StatelessTTL = time.Hour
+
+// ErrSessionTooLarge is returned by Save when a session is too large to be kept in a cookie or header while redis is unavailable
+var ErrSessionTooLarge = errors.New("the session is too large to be kept without redis")
+
+// ErrInvalidStateless is returned for stateless values which were not sealed with the keys of the store, or were changed since
+var ErrInvalidStateless = errors.New("the stateless session is not signed by this store")
+
+// IsStateless tells if the value of a session cookie or header holds a whole session rather than its ID
+func IsStateless(value string) bool {
+	return strings.HasPrefix(value, StatelessPrefix)
+}
+
+// SealStateless makes the stateless value of an encrypted session, which is accepted by OpenStateless until ttl has passed.
+// The value is signed with a key derived from keys, so it cannot be forged or changed. A ttl of 0 or less means StatelessTTL.
+// It returns ErrSessionTooLarge if the value would be larger than MaxStatelessSize
+func SealStateless(keys string, token string, ttl time.Duration) (string, error) {
+	if ttl <= 0 {
+		ttl = StatelessTTL
+	}
+	body := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + "." + token
+	value := StatelessPrefix + body + "." + statelessMAC(keys, body)
+	if len(value) > MaxStatelessSize {
+		return "", ErrSessionTooLarge
+	}
+	return value, nil
+}
+
+// OpenStateless returns the encrypted session held by a value made by SealStateless.
+// Stateless values are only accepted while redis is unavailable: RedisRecordNotFound and redis.Nil are returned
+// if the circuit breaker is not open, or if the value has expired.
+// RedisRecordUnmarshalError and ErrInvalidStateless are returned if the value was not sealed with keys
+func (rds *RedisStore) OpenStateless(keys string, value string) (int, string, error) {
+	if rds.Breaker.State() != BreakerOpen {
+		return RedisRecordNotFound, "", redis.Nil
+	}
+	body := strings.TrimPrefix(value, StatelessPrefix)
+	i := strings.LastIndexByte(body, '.')
+	if i < 0 || !hmac.Equal([]byte(body[i+1:]), []byte(statelessMAC(keys, body[:i]))) {
+		return RedisRecordUnmarshalError, "", ErrInvalidStateless
+	}
+	body = body[:i]
+	i = strings.IndexByte(body, '.')
+	if i < 0 {
+		return RedisRecordUnmarshalError, "", ErrInvalidStateless
+	}
+	expiry, err := strconv.ParseInt(body[:i], 10, 64)
+	if err != nil {
+		return RedisRecordUnmarshalError, "", ErrInvalidStateless
+	}
+	if time.Now().Unix() >= expiry {
+		return RedisRecordNotFound, "", redis.Nil
+	}
+	return RedisRecordFound, body[i+1:], nil
+}
+
+// statelessMAC signs the body of a stateless value with a key derived from keys, so it differs from the encryption key
+func statelessMAC(keys string, body string) string {
+	derive := hmac.New(sha256.New, []byte(keys))
+	derive.Write([]byte("webredis stateless"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// stateless encodes the session as the value of its header
+func (rts *RedisTokenStore) stateless(s *Session) (string, error) {
+	tkn, err := rts.token(s)
+	if err != nil {
+		return "", err
+	}
+	return SealStateless(rts.Keys, tkn, time.Duration(s.MaxAge)*time.Second)
+}
+
+// lookup is loadSession, which also decodes the sessions kept in the header while redis is unavailable
+func (rts *RedisTokenStore) lookup(ctx context.Context, value string) (*Session, int, error) {
+	if !IsStateless(value) {
+		return rts.loadSession(ctx, value)
+	}
+	redisStat, tkn, err := rts.RedisClient.OpenStateless(rts.Keys, value)
+	if err != nil {
+		return nil, redisStat, err
+	}
+	s, err := rts.fromToken(tkn)
+	if err != nil {
+		return nil, RedisRecordUnmarshalError, err
+	}
+	s.IsNew = false
+	s.Degraded = true
+	return s, RedisRecordFound, nil
+}
+
+// saveStateless sends the whole session in the response header, as redis is unavailable
+func (rts *RedisTokenStore) saveStateless(s *Session, w http.ResponseWriter) error {
+	value, err := rts.stateless(s)
+	if err != nil {
+		return err
+	}
+	s.Degraded = true
+	w.Header().Set(s.Name, value)
+	return nil
+}
+
+// restoreVersion prepares a session kept without redis to be saved in redis again, over its copy in redis.
+// A session which is no longer in redis, e.g. because it was deleted meanwhile, is not brought back: ErrConflict is returned.
+// Sessions created while redis was unavailable have no copy, and are saved as new
+func (rts *RedisTokenStore) restoreVersion(ctx context.Context, s *Session) error {
+	var stored json.RawMessage
+	redisStat, version, err := rts.RedisClient.GetVersionedContext(ctx, s.ID, &stored)
+	if redisStat == RedisRecordNotFound && !s.IsNew {
+		return ErrConflict
+	}
+	if redisStat != RedisRecordFound && redisStat != RedisRecordNotFound && redisStat != RedisRecordUnmarshalError {
+		return err
+	}
+	s.Version = version
+	return nil
+}
@@ -0,0 +1,404 @@
+package webredis
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ExportFormat names the format written by ExportSessionRecords
+const ExportFormat = "webredis-sessions"
+
+// ExportVersion is the version of the format written by ExportSessionRecords.
+// ImportSessionRecords reads every version up to this one.
+// Version 2 records when each session expires rather than the TTL it had left when exported
+const ExportVersion = 2
+
+// ErrNotSession is returned for keys which do not hold a session
+var ErrNotSession = errors.New("the key does not hold a session")
+
+// sessionMetaField is the hash field holding a session saved as a hash, without its values
+const sessionMetaField = "_meta"
+
+// SessionRecord is a session as it is kept in redis, still encrypted
+type SessionRecord struct {
+	ID string
+	// Layout is "string" for sessions saved as one value, and "hash" for sessions saved as a hash
+	Layout  string
+	Version int64
+	// TTL is the time left before the session expires. 0 means it never expires
+	TTL time.Duration
+	// Text is the encrypted session, for the string layout
+	Text string
+	// Fields are the encrypted fields of the hash, for the hash layout
+	Fields map[string]string
+}
+
+// ExpirySecs is the TTL of the record, rounded up to whole seconds. 0 means it never expires
+func (rec *SessionRecord) ExpirySecs() int64 {
+	return int64((rec.TTL + time.Second - 1) / time.Second)
+}
+
+// EncryptedMeta is the part of the record holding the encrypted session: all of it for the string layout,
+// and the session without its values for the hash layout
+func (rec *SessionRecord) EncryptedMeta() string {
+	if rec.Layout == "hash" {
+		return rec.Fields[sessionMetaField]
+	}
+	return rec.Text
+}
+
+// ReadSessionRecord fetches the session saved under id, whichever store and layout saved it.
+// It returns RedisRecordNotFound if there is no such key, and RedisRecordUnmarshalError and ErrNotSession
+// if the key holds something else
+func (rds *RedisStore) ReadSessionRecord(ctx context.Context, id string) (int, *SessionRecord, error) {
+	typ, err := rds.Conn.Type(ctx, id).Result()
+	if err != nil {
+		return RedisRecordFetchError, nil, err
+	}
+	rec := &SessionRecord{ID: id}
+	switch typ {
+	case "string":
+		rec.Layout = "string"
+		redisStat, version, err := rds.GetVersionedContext(ctx, id, &rec.Text)
+		if err == redis.Nil || redisStat == RedisRecordFetchError {
+			return redisStat, nil, err
+		} else if err != nil {
+			return RedisRecordUnmarshalError, nil, ErrNotSession
+		}
+		rec.Version = version
+	case "hash":
+		rec.Layout = "hash"
+		rec.Fields, err = rds.Conn.HGetAll(ctx, id).Result()
+		if err != nil {
+			return RedisRecordFetchError, nil, err
+		}
+		if _, ok := rec.Fields[sessionMetaField]; !ok {
+			return RedisRecordUnmarshalError, nil, ErrNotSession
+		}
+		rec.Version, _ = strconv.ParseInt(rec.Fields[HashVersionField], 10, 64)
+		delete(rec.Fields, HashVersionField)
+	case "none":
+		return RedisRecordNotFound, nil, redis.Nil
+	default:
+		return RedisRecordUnmarshalError, nil, ErrNotSession
+	}
+
+	ttl, err := rds.Conn.PTTL(ctx, id).Result()
+	if err != nil {
+		return RedisRecordFetchError, nil, err
+	}
+	if ttl > 0 {
+		rec.TTL = ttl
+	}
+	return RedisRecordFound, rec, nil
+}
+
+// WriteSessionRecord saves a record read by ReadSessionRecord, with its version and TTL.
+// Unless replace is set, a session which already exists is left alone and RedisRecordConflict is returned
+func (rds *RedisStore) WriteSessionRecord(ctx context.Context, rec *SessionRecord, replace bool) (int, error) {
+	if rec.Layout == "string" {
+		data, err := json.Marshal(rec.Text)
+		if err != nil {
+			return RedisMarshalUpdateError, err
+		}
+		p, err := marshalVersioned(rec.Version, data)
+		if err != nil {
+			return RedisMarshalUpdateError, err
+		}
+		if replace {
+			err = rds.Conn.Set(ctx, rec.ID, p, rec.TTL).Err()
+		} else {
+			var ok bool
+			ok, err = rds.Conn.SetNX(ctx, rec.ID, p, rec.TTL).Result()
+			if err == nil && !ok {
+				return RedisRecordConflict, nil
+			}
+		}
+		if err != nil {
+			return RedisRecordUpdateError, err
+		}
+		return RedisRecordUpdated, nil
+	} else if rec.Layout != "hash" {
+		return RedisInvalidArgsError, fmt.Errorf("unknown session layout %q", rec.Layout)
+	}
+
+	fields := make(map[string]interface{}, len(rec.Fields)+1)
+	for field, text := range rec.Fields {
+		fields[field] = text
+	}
+	fields[HashVersionField] = strconv.FormatInt(rec.Version, 10)
+
+	conflict := false
+	err := rds.Conn.Watch(ctx, func(tx *redis.Tx) error {
+		if !replace {
+			n, err := tx.Exists(ctx, rec.ID).Result()
+			if err != nil {
+				return err
+			}
+			if n > 0 {
+				conflict = true
+				return nil
+			}
+		}
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, rec.ID)
+			pipe.HSet(ctx, rec.ID, fields)
+			if rec.TTL > 0 {
+				pipe.PExpire(ctx, rec.ID, rec.TTL)
+			}
+			return nil
+		})
+		return err
+	}, rec.ID)
+
+	if err == redis.TxFailedErr || (err == nil && conflict) {
+		return RedisRecordConflict, nil
+	} else if err != nil {
+		return RedisRecordUpdateError, err
+	}
+	return RedisRecordUpdated, nil
+}
+
+// ScanSessionRecords calls fn for every session whose key matches pattern. Keys which do not hold sessions are skipped
+func (rds *RedisStore) ScanSessionRecords(ctx context.Context, pattern string, fn func(rec *SessionRecord) error) error {
+	_, err := rds.scanSessionRecords(ctx, pattern, 0, fn, nil)
+	return err
+}
+
+// scanSessionRecords scans from cursor, and calls batchDone with the cursor reached after each batch of keys
+func (rds *RedisStore) scanSessionRecords(ctx context.Context, pattern string, cursor uint64,
+	fn func(rec *SessionRecord) error, batchDone func(cursor uint64) error) (uint64, error) {
+	for {
+		keys, next, err := rds.Conn.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			return cursor, err
+		}
+		for _, key := range keys {
+			redisStat, rec, err := rds.ReadSessionRecord(ctx, key)
+			if redisStat == RedisRecordNotFound || err == ErrNotSession {
+				continue
+			} else if err != nil {
+				return cursor, err
+			}
+			if err := fn(rec); err != nil {
+				return cursor, err
+			}
+		}
+		cursor = next
+		if batchDone != nil {
+			if err := batchDone(cursor); err != nil {
+				return cursor, err
+			}
+		}
+		if cursor == 0 {
+			return 0, nil
+		}
+	}
+}
+
+// exportLine is one line of an export. The first line of an export is a header naming the format,
+// then come the sessions, each followed by the SCAN cursor reached once its batch of keys is done.
+// The last cursor of a complete export is 0
+type exportLine struct {
+	Format        string `json:"format,omitempty"`
+	FormatVersion int    `json:"format_version,omitempty"`
+	Store         string `json:"store,omitempty"`
+	ExportedAt    int64  `json:"exported_at,omitempty"`
+
+	Cursor *uint64 `json:"cursor,omitempty"`
+
+	ID      string `json:"id,omitempty"`
+	Layout  string `json:"layout,omitempty"`
+	Version int64  `json:"version,omitempty"`
+	// TTLMs is what version 1 exports record: the TTL left when the session was exported
+	TTLMs int64 `json:"ttl_ms,omitempty"`
+	// ExpiresAtMs is when the session expires, in milliseconds since the epoch. 0 means it never expires
+	ExpiresAtMs int64             `json:"expires_at_ms,omitempty"`
+	Text        string            `json:"text,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+// ttl is the time left before the exported session expires, or -1 if it already has.
+// exportedAt is the ExportedAt of the header of its export
+func (line *exportLine) ttl(exportedAt int64) time.Duration {
+	expiresAt := line.ExpiresAtMs
+	if expiresAt == 0 && line.TTLMs > 0 {
+		expiresAt = exportedAt*1000 + line.TTLMs
+	}
+	if expiresAt == 0 {
+		return 0
+	}
+	ttl := time.Until(time.UnixMilli(expiresAt))
+	if ttl < time.Millisecond {
+		return -1
+	}
+	return ttl
+}
+
+// ExportOptions choose what ExportSessionRecords exports
+type ExportOptions struct {
+	// Store is written in the header of the export
+	Store string
+	// Match is the SCAN pattern of the keys to export. Defaults to "*"
+	Match string
+	// Cursor resumes an export which was interrupted. Use ResumeCursor to find it
+	Cursor uint64
+	// Accept, if set, picks the sessions to export
+	Accept func(rec *SessionRecord) bool
+}
+
+// ExportSessionRecords writes the sessions to w as JSON lines, still encrypted and with the time they expire.
+// The keys are walked with SCAN, so redis keeps serving requests, but sessions saved during the export
+// may or may not be included, and a session may be written more than once.
+// The header is only written when opts.Cursor is 0, so a resumed export can be appended to the one it resumes.
+// It returns the SCAN cursor it reached: 0 once all keys were exported
+func (rds *RedisStore) ExportSessionRecords(ctx context.Context, w io.Writer, opts ExportOptions) (uint64, error) {
+	if opts.Match == "" {
+		opts.Match = "*"
+	}
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	if opts.Cursor == 0 {
+		err := enc.Encode(exportLine{Format: ExportFormat, FormatVersion: ExportVersion, Store: opts.Store, ExportedAt: time.Now().Unix()})
+		if err != nil {
+			return opts.Cursor, err
+		}
+	}
+
+	cursor, err := rds.scanSessionRecords(ctx, opts.Match, opts.Cursor, func(rec *SessionRecord) error {
+		if opts.Accept != nil && !opts.Accept(rec) {
+			return nil
+		}
+		line := exportLine{
+			ID:      rec.ID,
+			Layout:  rec.Layout,
+			Version: rec.Version,
+			Text:    rec.Text,
+			Fields:  rec.Fields,
+		}
+		if rec.TTL > 0 {
+			line.ExpiresAtMs = time.Now().Add(rec.TTL).UnixMilli()
+		}
+		return enc.Encode(line)
+	}, func(cursor uint64) error {
+		if err := enc.Encode(exportLine{Cursor: &cursor}); err != nil {
+			return err
+		}
+		// the cursor is only worth resuming from once everything before it is written
+		return bw.Flush()
+	})
+	if err != nil {
+		bw.Flush()
+		return cursor, err
+	}
+	return cursor, bw.Flush()
+}
+
+// ResumePoint is where an interrupted export can be resumed
+type ResumePoint struct {
+	// Cursor is the last SCAN cursor written to the export. Pass it as ExportOptions.Cursor to export the rest of the keys
+	Cursor uint64
+	// Offset is the size of the export up to that cursor. Anything after it is a partial batch, to be truncated
+	// before the rest of the keys are appended
+	Offset int64
+	// Complete is set if the export needs no resuming
+	Complete bool
+}
+
+// ResumeCursor reads an export and finds where it can be resumed
+func ResumeCursor(r io.Reader) (ResumePoint, error) {
+	var point ResumePoint
+	dec := json.NewDecoder(r)
+	for {
+		var line exportLine
+		err := dec.Decode(&line)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// an interrupted export may end with a partial line
+			return point, nil
+		} else if err != nil {
+			return point, err
+		}
+		if line.Cursor != nil {
+			point.Cursor = *line.Cursor
+			// the newline ending the line belongs to it
+			point.Offset = dec.InputOffset() + 1
+			point.Complete = point.Cursor == 0
+		}
+	}
+}
+
+// ImportOptions choose how ImportSessionRecords imports
+type ImportOptions struct {
+	// Replace overwrites sessions which already exist. By default they are kept, as they are newer than the export
+	Replace bool
+	// Accept, if set, picks the sessions to import
+	Accept func(rec *SessionRecord) bool
+	// Imported, if set, is called after each session is imported
+	Imported func(ctx context.Context, rec *SessionRecord)
+}
+
+// ImportSessionRecords restores the sessions written by ExportSessionRecords, to expire when they would have.
+// Several exports, e.g. an export followed by the export which resumed it, may be read one after the other.
+// It returns how many sessions were imported, and how many were skipped because they already exist, have expired
+// since the export or were not accepted
+func (rds *RedisStore) ImportSessionRecords(ctx context.Context, r io.Reader, opts ImportOptions) (int, int, error) {
+	imported, skipped := 0, 0
+	dec := json.NewDecoder(bufio.NewReader(r))
+	headerSeen, exportedAt := false, int64(0)
+	for {
+		var line exportLine
+		if err := dec.Decode(&line); err == io.EOF {
+			return imported, skipped, nil
+		} else if err != nil {
+			return imported, skipped, err
+		}
+
+		switch {
+		case line.Format != "":
+			if line.Format != ExportFormat || line.FormatVersion < 1 || line.FormatVersion > ExportVersion {
+				return imported, skipped, fmt.Errorf("cannot import format %s version %d", line.Format, line.FormatVersion)
+			}
+			headerSeen, exportedAt = true, line.ExportedAt
+		case !headerSeen:
+			return imported, skipped, errors.New("the export does not start with a header")
+		case line.ID != "":
+			ttl := line.ttl(exportedAt)
+			if ttl < 0 {
+				skipped++
+				continue
+			}
+			rec := &SessionRecord{
+				ID:      line.ID,
+				Layout:  line.Layout,
+				Version: line.Version,
+				TTL:     ttl,
+				Text:    line.Text,
+				Fields:  line.Fields,
+			}
+			if opts.Accept != nil && !opts.Accept(rec) {
+				skipped++
+				continue
+			}
+			redisStat, err := rds.WriteSessionRecord(ctx, rec, opts.Replace)
+			if err != nil {
+				return imported, skipped, fmt.Errorf("%s: %w", rec.ID, err)
+			}
+			if redisStat == RedisRecordConflict {
+				skipped++
+				continue
+			}
+			imported++
+			if opts.Imported != nil {
+				opts.Imported(ctx, rec)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package webredis
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// FingerprintAttribute identifies a property of the client that a session can be bound to
+type FingerprintAttribute string
+
+const (
+	// FingerprintUserAgent binds a session to a hash of the User-Agent header
+	FingerprintUserAgent FingerprintAttribute = "user_agent"
+	// FingerprintIPSubnet binds a session to the subnet of the client's IP address.
+	// The size of the subnet is set using SessionBinding.IPv4PrefixBits and SessionBinding.IPv6PrefixBits
+	FingerprintIPSubnet FingerprintAttribute = "ip_subnet"
+	// FingerprintTLS binds a session to the TLS channel. If the client presented a certificate,
+	// the hash of that certificate is used, else the negotiated protocol version, cipher suite and server name.
+	FingerprintTLS FingerprintAttribute = "tls"
+)
+
+// FingerprintPolicy is the action taken when an attribute recorded on a session no longer matches the client
+type FingerprintPolicy int
+
+const (
+	// FingerprintMatched is returned by SessionBinding.Verify when no action needs to be taken
+	FingerprintMatched FingerprintPolicy = iota
+	// FingerprintWarn accepts the session, but reports the mismatch to SessionBinding.OnMismatch
+	FingerprintWarn
+	// FingerprintRegenerate hands the client a brand new session. The bound session is left untouched,
+	// since it most likely still belongs to its legitimate owner.
+	FingerprintRegenerate
+	// FingerprintReject fails the lookup with ErrFingerprintMismatch
+	FingerprintReject
+)
+
+const (
+	defaultIPv4PrefixBits = 24
+	defaultIPv6PrefixBits = 64
+)
+
+// ErrFingerprintMismatch is returned by the stores when a session is presented by a client whose
+// fingerprint does not match the one recorded when the session was created, and the policy is FingerprintReject
+var ErrFingerprintMismatch = errors.New("the session does not belong to this client")
+
+// SessionBinding binds sessions to attributes of the client that created them. The attributes are recorded
+// when the session is created and re-checked whenever the session is loaded from a request.
+// Sessions which were created before an attribute was bound are not checked against that attribute.
+type SessionBinding struct {
+	// Policies maps every bound attribute to the action taken when it does not match
+	Policies map[FingerprintAttribute]FingerprintPolicy
+	// IPv4PrefixBits is the size of the IPv4 subnet used by FingerprintIPSubnet. Defaults to 24
+	IPv4PrefixBits int
+	// IPv6PrefixBits is the size of the IPv6 subnet used by FingerprintIPSubnet. Defaults to 64
+	IPv6PrefixBits int
+	// ClientIP extracts the client's IP address from the request. Defaults to the host part of r.RemoteAddr.
+	// Set this if your application runs behind a proxy.
+	ClientIP func(r *http.Request) string
+	// OnMismatch is called for every mismatched attribute (whatever its policy), e.g. to log it.
+	OnMismatch func(r *http.Request, sessionID string, attr FingerprintAttribute, policy FingerprintPolicy)
+}
+
+// Fingerprint computes the hashes of all bound attributes for the client making the request
+func (b *SessionBinding) Fingerprint(r *http.Request) map[string]string {
+	if b == nil || len(b.Policies) == 0 {
+		return nil
+	}
+	fp := make(map[string]string, len(b.Policies))
+	for attr := range b.Policies {
+		fp[string(attr)] = b.hash(r, attr)
+	}
+	return fp
+}
+
+// Verify checks the client making the request against the recorded fingerprint of a session.
+// It returns the most severe policy among the mismatched attributes, or FingerprintMatched
+func (b *SessionBinding) Verify(r *http.Request, sessionID string, recorded map[string]string) FingerprintPolicy {
+	result := FingerprintMatched
+	if b == nil {
+		return result
+	}
+	for attr, policy := range b.Policies {
+		want, ok := recorded[string(attr)]
+		if !ok {
+			continue
+		}
+		if want == b.hash(r, attr) {
+			continue
+		}
+		if b.OnMismatch != nil {
+			b.OnMismatch(r, sessionID, attr, policy)
+		}
+		if policy > result {
+			result = policy
+		}
+	}
+	return result
+}
+
+func (b *SessionBinding) hash(r *http.Request, attr FingerprintAttribute) string {
+	var raw string
+	switch attr {
+	case FingerprintUserAgent:
+		raw = r.UserAgent()
+	case FingerprintIPSubnet:
+		raw = b.subnet(r)
+	case FingerprintTLS:
+		raw = tlsChannel(r.TLS)
+	}
+	sum := sha256.Sum256([]byte(string(attr) + ":" + raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *SessionBinding) subnet(r *http.Request) string {
+	var addr string
+	if b.ClientIP != nil {
+		addr = b.ClientIP(r)
+	} else {
+		addr = r.RemoteAddr
+		if host, _, err := net.SplitHostPort(addr); err == nil {
+			addr = host
+		}
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		bits := b.IPv4PrefixBits
+		if bits <= 0 || bits > 32 {
+			bits = defaultIPv4PrefixBits
+		}
+		return ip4.Mask(net.CIDRMask(bits, 32)).String() + "/" + strconv.Itoa(bits)
+	}
+	bits := b.IPv6PrefixBits
+	if bits <= 0 || bits > 128 {
+		bits = defaultIPv6PrefixBits
+	}
+	return ip.Mask(net.CIDRMask(bits, 128)).String() + "/" + strconv.Itoa(bits)
+}
+
+func tlsChannel(state *tls.ConnectionState) string {
+	if state == nil {
+		return ""
+	}
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		return "cert:" + hex.EncodeToString(sum[:])
+	}
+	return "conn:" + strconv.Itoa(int(state.Version)) + ":" + strconv.Itoa(int(state.CipherSuite)) + ":" + state.ServerName
+}
@@ -1,11 +1,15 @@
 module github.com/gbenroscience/webredis
 
-go 1.17
+go 1.21
 
 require (
 	github.com/go-redis/redis/v8 v8.11.5
+	github.com/oklog/ulid v1.3.1
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
 )
 
 require (
-
+	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 )
@@ -0,0 +1,167 @@
+package webredis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// SessionEventKind tells what happened to a session
+type SessionEventKind int
+
+const (
+	// SessionCreated fires when a store creates a new session, before it is saved
+	SessionCreated SessionEventKind = iota
+	// SessionLoaded fires when a store loads a session from redis
+	SessionLoaded
+	// SessionSaved fires when a store has saved a session
+	SessionSaved
+	// SessionDestroyed fires when a session is deleted through its store
+	SessionDestroyed
+	// SessionRegenerated fires when a session was given a new ID. PreviousID holds the old one
+	SessionRegenerated
+	// SessionExpired fires when redis expires a session. Only the SessionID of the event is set. See Hooks.ListenExpired
+	SessionExpired
+)
+
+func (k SessionEventKind) String() string {
+	switch k {
+	case SessionCreated:
+		return "created"
+	case SessionLoaded:
+		return "loaded"
+	case SessionSaved:
+		return "saved"
+	case SessionDestroyed:
+		return "destroyed"
+	case SessionRegenerated:
+		return "regenerated"
+	case SessionExpired:
+		return "expired"
+	}
+	return fmt.Sprintf("SessionEventKind(%d)", int(k))
+}
+
+// SessionEvent describes what happened to a session
+type SessionEvent struct {
+	Kind SessionEventKind
+	// Store is the store the session belongs to, e.g. "session" or "token"
+	Store     string
+	SessionID string
+	// PreviousID is the ID the session had before it was regenerated
+	PreviousID string
+	Name       string
+	UserID     string
+	// Session is the *Session of RedisTokenStore or the *sessions.Session of RedisSessionStore
+	Session interface{}
+}
+
+// HookFunc is called with the events it was registered for
+type HookFunc func(ctx context.Context, ev SessionEvent)
+
+// Hooks is a registry of functions called when sessions are created, loaded, saved, destroyed, regenerated or expire.
+// Give it to the stores using their Hooks field. The zero value is ready to use, and one Hooks may be shared by several stores.
+// Hooks are called synchronously by the store, on the goroutine of the request, so they should be quick
+type Hooks struct {
+	mu    sync.RWMutex
+	funcs map[SessionEventKind][]HookFunc
+}
+
+// On registers fn to be called on every event of the given kind
+func (h *Hooks) On(kind SessionEventKind, fn HookFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.funcs == nil {
+		h.funcs = make(map[SessionEventKind][]HookFunc)
+	}
+	h.funcs[kind] = append(h.funcs[kind], fn)
+}
+
+// OnCreated registers fn to be called when a store creates a session
+func (h *Hooks) OnCreated(fn HookFunc) { h.On(SessionCreated, fn) }
+
+// OnLoaded registers fn to be called when a store loads a session
+func (h *Hooks) OnLoaded(fn HookFunc) { h.On(SessionLoaded, fn) }
+
+// OnSaved registers fn to be called when a store has saved a session
+func (h *Hooks) OnSaved(fn HookFunc) { h.On(SessionSaved, fn) }
+
+// OnDestroyed registers fn to be called when a session is deleted through its store
+func (h *Hooks) OnDestroyed(fn HookFunc) { h.On(SessionDestroyed, fn) }
+
+// OnRegenerated registers fn to be called when a session is given a new ID
+func (h *Hooks) OnRegenerated(fn HookFunc) { h.On(SessionRegenerated, fn) }
+
+// OnExpired registers fn to be called with the ID of every session which expires in redis. See ListenExpired
+func (h *Hooks) OnExpired(fn func(ctx context.Context, sessionID string)) {
+	h.On(SessionExpired, func(ctx context.Context, ev SessionEvent) {
+		fn(ctx, ev.SessionID)
+	})
+}
+
+// Fire calls the functions registered for the kind of the event. It does nothing on nil Hooks
+func (h *Hooks) Fire(ctx context.Context, ev SessionEvent) {
+	if h == nil {
+		return
+	}
+	h.mu.RLock()
+	funcs := h.funcs[ev.Kind]
+	h.mu.RUnlock()
+	for _, fn := range funcs {
+		fn(ctx, ev)
+	}
+}
+
+// ListenExpired fires SessionExpired events for the sessions which expire in the database of rds, until ctx is done.
+// It relies on redis keyspace notifications, which must have the expired events ("Ex" of notify-keyspace-events) turned on,
+// either in the configuration of the server or with EnableExpiredEvents.
+// Redis sends the notification when it removes the expired key, which may be a while after its TTL ran out.
+// Notifications sent while the listener is disconnected are lost.
+// Only keys which look like session IDs fire events; others, such as locks and rate limits, are ignored
+func (h *Hooks) ListenExpired(ctx context.Context, rds *RedisStore) error {
+	channel := fmt.Sprintf("__keyevent@%d__:expired", rds.Conn.Options().DB)
+	pubsub := rds.Conn.Subscribe(ctx, channel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return err
+	}
+
+	msgs := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-msgs:
+			if !ok {
+				return nil
+			}
+			if IsSessionID(msg.Payload) {
+				h.Fire(ctx, SessionEvent{Kind: SessionExpired, SessionID: msg.Payload})
+			}
+		}
+	}
+}
+
+// EnableExpiredEvents turns on the expired events needed by ListenExpired, with CONFIG SET, keeping the other
+// notify-keyspace-events flags already set. It fails on servers which forbid CONFIG, e.g. most managed ones
+func EnableExpiredEvents(ctx context.Context, rds *RedisStore) error {
+	cfg, err := rds.Conn.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		return err
+	}
+	flags := ""
+	if len(cfg) == 2 {
+		flags, _ = cfg[1].(string)
+	}
+	if strings.Contains(flags, "E") && (strings.Contains(flags, "x") || strings.Contains(flags, "A")) {
+		return nil
+	}
+	if !strings.Contains(flags, "E") {
+		flags += "E"
+	}
+	if !strings.Contains(flags, "x") && !strings.Contains(flags, "A") {
+		flags += "x"
+	}
+	return rds.Conn.ConfigSet(ctx, "notify-keyspace-events", flags).Err()
+}
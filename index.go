@@ -0,0 +1,319 @@
+package webredis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultIndexPrefix is prepended to the keys of a SessionIndex which does not set its own Prefix
+const DefaultIndexPrefix = "webredis:index:"
+
+// SessionInfo describes a saved session without revealing its values
+type SessionInfo struct {
+	ID string `json:"id"`
+	// Handle names the session without giving it away. See SessionHandle
+	Handle     string        `json:"handle"`
+	Name       string        `json:"name"`
+	UserID     string        `json:"user_id,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	LastAccess time.Time     `json:"last_access"`
+	TTL        time.Duration `json:"ttl"`
+	// Size is the memory used by the session in redis, in bytes. It is 0 if redis does not support MEMORY USAGE
+	Size int64 `json:"size"`
+}
+
+// SessionIndex keeps track of the sessions saved by a session store, so they can be listed by name or by user.
+// The stores update it whenever a session is saved or successfully loaded.
+// Entries of sessions which expired are removed the next time they are listed
+type SessionIndex struct {
+	Store *RedisStore
+	// Prefix is prepended to the keys of the index in redis. Defaults to DefaultIndexPrefix
+	Prefix string
+}
+
+// NewSessionIndex creates an index of sessions kept in the given store
+func NewSessionIndex(store *RedisStore) *SessionIndex {
+	return &SessionIndex{Store: store, Prefix: DefaultIndexPrefix}
+}
+
+func (idx *SessionIndex) prefix() string {
+	if idx.Prefix == "" {
+		return DefaultIndexPrefix
+	}
+	return idx.Prefix
+}
+
+// SessionHandle names a session in admin tools without giving away its ID, which would let whoever sees it use the session.
+// It is a hash of the ID, which starts with the RedactID of the session, as found in the logs and the audit log
+func SessionHandle(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "sha256:" + hex.EncodeToString(sum[:16])
+}
+
+func (idx *SessionIndex) handleKey(handle string) string {
+	return idx.prefix() + "handle:" + handle
+}
+
+func (idx *SessionIndex) metaKey(id string) string {
+	return idx.prefix() + "meta:" + id
+}
+
+func (idx *SessionIndex) nameKey(name string) string {
+	return idx.prefix() + "name:" + name
+}
+
+func (idx *SessionIndex) userKey(userID string) string {
+	return idx.prefix() + "user:" + userID
+}
+
+// Touch records that the session was accessed now. ttl is how long the session lives in redis; 0 means forever
+func (idx *SessionIndex) Touch(ctx context.Context, id string, name string, userID string, createdAt time.Time, ttl time.Duration) error {
+	now := time.Now()
+	score := float64(now.UnixMilli())
+	_, err := idx.Store.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		meta := idx.metaKey(id)
+		pipe.HSet(ctx, meta, "name", name, "user", userID,
+			"created", createdAt.UnixMilli(), "accessed", now.UnixMilli())
+		pipe.Set(ctx, idx.handleKey(SessionHandle(id)), id, ttl)
+		if ttl > 0 {
+			pipe.Expire(ctx, meta, ttl)
+		} else {
+			pipe.Persist(ctx, meta)
+		}
+		pipe.ZAdd(ctx, idx.nameKey(name), &redis.Z{Score: score, Member: id})
+		if userID != "" {
+			pipe.ZAdd(ctx, idx.userKey(userID), &redis.Z{Score: score, Member: id})
+		}
+		return nil
+	})
+	return err
+}
+
+// Remove removes a session from the index
+func (idx *SessionIndex) Remove(ctx context.Context, id string) error {
+	meta, err := idx.Store.Conn.HMGet(ctx, idx.metaKey(id), "name", "user").Result()
+	if err != nil {
+		return err
+	}
+	_, err = idx.Store.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		if name, ok := meta[0].(string); ok {
+			pipe.ZRem(ctx, idx.nameKey(name), id)
+		}
+		if user, ok := meta[1].(string); ok && user != "" {
+			pipe.ZRem(ctx, idx.userKey(user), id)
+		}
+		pipe.Del(ctx, idx.metaKey(id), idx.handleKey(SessionHandle(id)))
+		return nil
+	})
+	return err
+}
+
+// TouchMany is Touch for many sessions at once, in a single transaction.
+// The ID, Name, UserID, CreatedAt and TTL of each SessionInfo are recorded
+func (idx *SessionIndex) TouchMany(ctx context.Context, sessions []SessionInfo) error {
+	if len(sessions) == 0 {
+		return nil
+	}
+	now := time.Now()
+	score := float64(now.UnixMilli())
+	_, err := idx.Store.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, s := range sessions {
+			meta := idx.metaKey(s.ID)
+			pipe.HSet(ctx, meta, "name", s.Name, "user", s.UserID,
+				"created", s.CreatedAt.UnixMilli(), "accessed", now.UnixMilli())
+			pipe.Set(ctx, idx.handleKey(SessionHandle(s.ID)), s.ID, s.TTL)
+			if s.TTL > 0 {
+				pipe.Expire(ctx, meta, s.TTL)
+			} else {
+				pipe.Persist(ctx, meta)
+			}
+			pipe.ZAdd(ctx, idx.nameKey(s.Name), &redis.Z{Score: score, Member: s.ID})
+			if s.UserID != "" {
+				pipe.ZAdd(ctx, idx.userKey(s.UserID), &redis.Z{Score: score, Member: s.ID})
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// RemoveMany is Remove for many sessions at once. It returns the ID, Name and UserID
+// of the sessions which were in the index, so their removal can be reported
+func (idx *SessionIndex) RemoveMany(ctx context.Context, ids []string) ([]SessionInfo, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	cmds, err := idx.Store.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.HMGet(ctx, idx.metaKey(id), "name", "user")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []SessionInfo
+	_, err = idx.Store.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			meta := cmds[i].(*redis.SliceCmd).Val()
+			name, ok := meta[0].(string)
+			if !ok {
+				continue
+			}
+			user, _ := meta[1].(string)
+			removed = append(removed, SessionInfo{ID: id, Handle: SessionHandle(id), Name: name, UserID: user})
+			pipe.ZRem(ctx, idx.nameKey(name), id)
+			if user != "" {
+				pipe.ZRem(ctx, idx.userKey(user), id)
+			}
+			pipe.Del(ctx, idx.metaKey(id), idx.handleKey(SessionHandle(id)))
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// ByName lists the sessions called name, most recently accessed first. A limit of 0 or less lists them all
+func (idx *SessionIndex) ByName(ctx context.Context, name string, offset int, limit int) ([]SessionInfo, error) {
+	return idx.list(ctx, idx.nameKey(name), offset, limit)
+}
+
+// ByUser lists the sessions of a user, most recently accessed first. A limit of 0 or less lists them all
+func (idx *SessionIndex) ByUser(ctx context.Context, userID string, offset int, limit int) ([]SessionInfo, error) {
+	return idx.list(ctx, idx.userKey(userID), offset, limit)
+}
+
+// Info describes a single session. Returns RedisRecordNotFound and redis.Nil if the session does not exist
+func (idx *SessionIndex) Info(ctx context.Context, id string) (int, *SessionInfo, error) {
+	infos, err := idx.describe(ctx, []string{id})
+	if err != nil {
+		return RedisRecordFetchError, nil, err
+	}
+	if len(infos) == 0 {
+		return RedisRecordNotFound, nil, redis.Nil
+	}
+	return RedisRecordFound, &infos[0], nil
+}
+
+// Resolve returns the IDs of the indexed sessions named by handles, as returned by SessionHandle.
+// Handles of sessions which are not in the index are left out
+func (idx *SessionIndex) Resolve(ctx context.Context, handles []string) ([]string, error) {
+	if len(handles) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(handles))
+	for i, handle := range handles {
+		keys[i] = idx.handleKey(handle)
+	}
+	vals, err := idx.Store.Conn.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, val := range vals {
+		if id, ok := val.(string); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+func (idx *SessionIndex) list(ctx context.Context, key string, offset int, limit int) ([]SessionInfo, error) {
+	stop := int64(-1)
+	if limit > 0 {
+		stop = int64(offset + limit - 1)
+	}
+	ids, err := idx.Store.Conn.ZRevRange(ctx, key, int64(offset), stop).Result()
+	if err != nil {
+		return nil, err
+	}
+	infos, err := idx.describe(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	// prune the entries of sessions which no longer exist, or which have changed hands
+	listed := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		if key == idx.nameKey(info.Name) || key == idx.userKey(info.UserID) {
+			listed[info.ID] = true
+		}
+	}
+	var stale []interface{}
+	res := infos[:0]
+	for _, info := range infos {
+		if listed[info.ID] {
+			res = append(res, info)
+		}
+	}
+	for _, id := range ids {
+		if !listed[id] {
+			stale = append(stale, id)
+		}
+	}
+	if len(stale) > 0 {
+		idx.Store.Conn.ZRem(ctx, key, stale...)
+	}
+	return res, nil
+}
+
+// describe fetches the SessionInfo of the sessions which still exist among ids
+func (idx *SessionIndex) describe(ctx context.Context, ids []string) ([]SessionInfo, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	metas := make([]*redis.SliceCmd, len(ids))
+	ttls := make([]*redis.DurationCmd, len(ids))
+	sizes := make([]*redis.IntCmd, len(ids))
+	_, err := idx.Store.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			metas[i] = pipe.HMGet(ctx, idx.metaKey(id), "name", "user", "created", "accessed")
+			ttls[i] = pipe.PTTL(ctx, id)
+			sizes[i] = pipe.MemoryUsage(ctx, id)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		// MEMORY USAGE fails on servers which do not support it, without failing the other commands
+		for _, cmd := range ttls {
+			if cmd.Err() != nil {
+				return nil, cmd.Err()
+			}
+		}
+	}
+
+	infos := make([]SessionInfo, 0, len(ids))
+	for i, id := range ids {
+		ttl := ttls[i].Val()
+		meta := metas[i].Val()
+		if ttl == -2 || meta[0] == nil {
+			// the session, or its entry in the index, has expired
+			continue
+		}
+		info := SessionInfo{ID: id, Handle: SessionHandle(id), Size: sizes[i].Val()}
+		if ttl > 0 {
+			info.TTL = ttl
+		}
+		info.Name, _ = meta[0].(string)
+		info.UserID, _ = meta[1].(string)
+		info.CreatedAt = millis(meta[2])
+		info.LastAccess = millis(meta[3])
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func millis(v interface{}) time.Time {
+	s, _ := v.(string)
+	ms, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
@@ -0,0 +1,360 @@
+package webredis
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The algorithms JWTs can be signed with
+const (
+	JWTHS256 = "HS256"
+	JWTRS256 = "RS256"
+	JWTEdDSA = "EdDSA"
+)
+
+const defaultJWTTTL = 15 * time.Minute
+
+// ErrInvalidJWT is returned for JWTs which are malformed, signed by an unknown key or with a wrong signature,
+// or issued by or for someone else
+var ErrInvalidJWT = errors.New("webredis: the JWT is invalid")
+
+// ErrJWTExpired is returned for JWTs which expired
+var ErrJWTExpired = errors.New("webredis: the JWT expired")
+
+// ErrJWTRevoked is returned for JWTs whose session was revoked
+var ErrJWTRevoked = errors.New("webredis: the JWT was revoked")
+
+// ErrNoJWT is returned by the JWT methods of a RedisTokenStore which has no JWT config
+var ErrNoJWT = errors.New("webredis: the store has no JWT config")
+
+// JWTKey is a key JWTs are signed or verified with
+type JWTKey struct {
+	// ID is the kid of the key, which tells verifiers which key signed a JWT
+	ID string
+	// Algorithm is JWTHS256, JWTRS256 or JWTEdDSA. JWTs which claim another algorithm are not verified with the key
+	Algorithm string
+	// Secret is the key of JWTHS256
+	Secret []byte
+	// PrivateKey signs with JWTRS256 (an *rsa.PrivateKey) or JWTEdDSA (an ed25519.PrivateKey). Leave nil to only verify
+	PrivateKey crypto.Signer
+	// PublicKey verifies JWTRS256 or JWTEdDSA. Defaults to the public key of PrivateKey
+	PublicKey crypto.PublicKey
+}
+
+// NewHS256Key creates a key signing with HMAC SHA-256. The secret should be at least 32 random bytes
+func NewHS256Key(id string, secret []byte) JWTKey {
+	return JWTKey{ID: id, Algorithm: JWTHS256, Secret: secret}
+}
+
+// NewRS256Key creates a key signing with RSA PKCS #1 v1.5 and SHA-256
+func NewRS256Key(id string, key *rsa.PrivateKey) JWTKey {
+	return JWTKey{ID: id, Algorithm: JWTRS256, PrivateKey: key}
+}
+
+// NewEdDSAKey creates a key signing with Ed25519
+func NewEdDSAKey(id string, key ed25519.PrivateKey) JWTKey {
+	return JWTKey{ID: id, Algorithm: JWTEdDSA, PrivateKey: key}
+}
+
+func (k *JWTKey) publicKey() crypto.PublicKey {
+	if k.PublicKey == nil && k.PrivateKey != nil {
+		return k.PrivateKey.Public()
+	}
+	return k.PublicKey
+}
+
+func (k *JWTKey) sign(input []byte) ([]byte, error) {
+	switch {
+	case k.Algorithm == JWTHS256 && len(k.Secret) > 0:
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case k.Algorithm == JWTRS256 && k.PrivateKey != nil:
+		digest := sha256.Sum256(input)
+		return k.PrivateKey.Sign(rand.Reader, digest[:], crypto.SHA256)
+	case k.Algorithm == JWTEdDSA && k.PrivateKey != nil:
+		return k.PrivateKey.Sign(rand.Reader, input, crypto.Hash(0))
+	}
+	return nil, fmt.Errorf("webredis: the JWT key %q cannot sign with %q", k.ID, k.Algorithm)
+}
+
+func (k *JWTKey) verify(input []byte, signature []byte) bool {
+	switch k.Algorithm {
+	case JWTHS256:
+		if len(k.Secret) == 0 {
+			return false
+		}
+		mac := hmac.New(sha256.New, k.Secret)
+		mac.Write(input)
+		return hmac.Equal(signature, mac.Sum(nil))
+	case JWTRS256:
+		pub, ok := k.publicKey().(*rsa.PublicKey)
+		if !ok {
+			return false
+		}
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) == nil
+	case JWTEdDSA:
+		pub, ok := k.publicKey().(ed25519.PublicKey)
+		return ok && ed25519.Verify(pub, input, signature)
+	}
+	return false
+}
+
+// JWTClaims are the claims of the JWTs of a RedisTokenStore
+type JWTClaims struct {
+	// ID is the JWTID of the session the JWT was issued for
+	ID        string `json:"jti"`
+	Subject   string `json:"sub,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	// Scope is the space separated list of the scopes of the session
+	Scope    string `json:"scope,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+}
+
+// HasScope tells if the JWT has the scope
+func (c *JWTClaims) HasScope(scope string) bool {
+	if c == nil {
+		return false
+	}
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// JWTConfig signs and verifies JWTs. Verifying needs no redis, but for checking the Revocations of the JWTs
+// which may have been revoked
+type JWTConfig struct {
+	// Keys are the keys JWTs are verified with. The first one signs: to rotate keys, put the new key first
+	// and drop the old one once the JWTs it signed expired
+	Keys []JWTKey
+	// Issuer is the iss of the JWTs, and the only one accepted if set
+	Issuer string
+	// Audience is the aud of the JWTs, and the only one accepted if set
+	Audience string
+	// TTL is how long JWTs last. Defaults to 15 minutes
+	TTL time.Duration
+	// Leeway is how far the clocks of the instances may drift apart
+	Leeway time.Duration
+	// Revocations is the list of revoked sessions, whose JWTs are not verified. Its TTL must be at least TTL.
+	// Leave nil to let JWTs be valid until they expire, whatever happens to their session
+	Revocations *RevocationList
+}
+
+func (c *JWTConfig) ttl() time.Duration {
+	if c.TTL <= 0 {
+		return defaultJWTTTL
+	}
+	return c.TTL
+}
+
+// Sign signs claims with the first of the Keys
+func (c *JWTConfig) Sign(claims JWTClaims) (string, error) {
+	if len(c.Keys) == 0 {
+		return "", errors.New("webredis: the JWT config has no keys")
+	}
+	key := &c.Keys[0]
+	header, err := json.Marshal(jwtHeader{Algorithm: key.Algorithm, Type: "JWT", KeyID: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// key finds the key of a JWT by its kid, or the only key if the JWT has no kid
+func (c *JWTConfig) key(header jwtHeader) *JWTKey {
+	for i := range c.Keys {
+		if c.Keys[i].ID == header.KeyID || header.KeyID == "" && len(c.Keys) == 1 {
+			return &c.Keys[i]
+		}
+	}
+	return nil
+}
+
+// Verify checks the signature and the claims of a JWT, then that it was not revoked.
+// It returns ErrInvalidJWT, ErrJWTExpired or ErrJWTRevoked for JWTs which are not valid,
+// and another error only if the Revocations could not tell
+func (c *JWTConfig) Verify(ctx context.Context, token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+	var header jwtHeader
+	if !decodeJWTPart(parts[0], &header) {
+		return nil, ErrInvalidJWT
+	}
+	key := c.key(header)
+	// the key, not the JWT, tells which algorithm to verify with, so an RSA public key is never taken for an HMAC secret
+	if key == nil || header.Algorithm != key.Algorithm {
+		return nil, ErrInvalidJWT
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return nil, ErrInvalidJWT
+	}
+	claims := new(JWTClaims)
+	if !decodeJWTPart(parts[1], claims) || claims.ID == "" {
+		return nil, ErrInvalidJWT
+	}
+
+	now := time.Now()
+	if claims.IssuedAt > now.Add(c.Leeway).Unix() ||
+		c.Issuer != "" && claims.Issuer != c.Issuer ||
+		c.Audience != "" && claims.Audience != c.Audience {
+		return nil, ErrInvalidJWT
+	}
+	if claims.ExpiresAt <= now.Add(-c.Leeway).Unix() {
+		return nil, ErrJWTExpired
+	}
+	if c.Revocations != nil {
+		revoked, err := c.Revocations.IsRevoked(ctx, claims.ID, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrJWTRevoked
+		}
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) bool {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	return err == nil && json.Unmarshal(b, v) == nil
+}
+
+// JWK is a public key, as in RFC 7517
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid,omitempty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N and E are the modulus and exponent of RSA keys
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and X are the curve and public key of Ed25519 keys
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKSet is a set of public keys, as in RFC 7517
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys of the Keys, for others to verify the JWTs with. JWTHS256 keys are secret, so they are left out
+func (c *JWTConfig) JWKS() JWKSet {
+	set := JWKSet{Keys: []JWK{}}
+	for i := range c.Keys {
+		key := &c.Keys[i]
+		switch pub := key.publicKey().(type) {
+		case *rsa.PublicKey:
+			if key.Algorithm == JWTRS256 {
+				set.Keys = append(set.Keys, JWK{KeyType: "RSA", KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm,
+					N: base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+					E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())})
+			}
+		case ed25519.PublicKey:
+			if key.Algorithm == JWTEdDSA {
+				set.Keys = append(set.Keys, JWK{KeyType: "OKP", KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm,
+					Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(pub)})
+			}
+		}
+	}
+	return set
+}
+
+// JWKSHandler serves the JWKS as JSON, usually under /.well-known/jwks.json
+func (c *JWTConfig) JWKSHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(c.JWKS())
+	})
+}
+
+// JWTID is the jti of the JWTs of a session, which the RevocationList of the JWT config revokes.
+// It is a hash of the ID of the session, so the JWT, which is not encrypted, does not give the session away
+func JWTID(sessionID string) string {
+	sum := sha256.Sum256([]byte(sessionID))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssueJWT signs a JWT for the session, with the JWTID of the session as jti. It expires after the TTL of the JWT config,
+// or with the session if it is an API token which expires before
+func (rts *RedisTokenStore) IssueJWT(ctx context.Context, s *Session) (string, error) {
+	if rts.JWT == nil {
+		return "", ErrNoJWT
+	}
+	now := time.Now()
+	expiresAt := now.Add(rts.JWT.ttl()).Unix()
+	if s.ExpiresAt > 0 && s.ExpiresAt < expiresAt {
+		expiresAt = s.ExpiresAt
+	}
+	return rts.JWT.Sign(JWTClaims{
+		ID:        JWTID(s.ID),
+		Subject:   s.UserID,
+		Issuer:    rts.JWT.Issuer,
+		Audience:  rts.JWT.Audience,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt,
+		Scope:     strings.Join(s.Scopes, " "),
+		ClientID:  s.ClientID,
+	})
+}
+
+// VerifyJWT verifies a JWT issued by IssueJWT. See JWTConfig.Verify
+func (rts *RedisTokenStore) VerifyJWT(ctx context.Context, token string) (*JWTClaims, error) {
+	if rts.JWT == nil {
+		return nil, ErrNoJWT
+	}
+	return rts.JWT.Verify(ctx, token)
+}
+
+// revokeJWTs adds the sessions to the Revocations of the JWT config, if any, so the JWTs issued for them are no longer verified
+func (rts *RedisTokenStore) revokeJWTs(ctx context.Context, name string, ids ...string) {
+	if rts.JWT == nil || rts.JWT.Revocations == nil || len(ids) == 0 {
+		return
+	}
+	jtis := make([]string, len(ids))
+	for i, id := range ids {
+		jtis[i] = JWTID(id)
+	}
+	err := rts.JWT.Revocations.Revoke(ctx, jtis...)
+	LogRevocation(ctx, rts.logger(), rts.logLevels(), tokenStoreName, name, ids[0], err)
+}
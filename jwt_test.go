@@ -0,0 +1,209 @@
+package webredis
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signWith signs claims with key, under the given header, whatever the header claims
+func signWith(t *testing.T, key JWTKey, header jwtHeader, claims JWTClaims) string {
+	t.Helper()
+	h, _ := json.Marshal(header)
+	p, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(p)
+	signature, err := key.sign([]byte(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifyKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	hs := NewHS256Key("hs", []byte("0123456789abcdef0123456789abcdef"))
+	rs := NewRS256Key("rs", rsaKey)
+	ed := NewEdDSAKey("ed", edKey)
+	claims := JWTClaims{ID: JWTID("session"), Subject: "42", IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Minute).Unix()}
+
+	// the public key of rs, taken for an HMAC secret
+	rsPublic := NewHS256Key("rs", rsaKey.PublicKey.N.Bytes())
+
+	tests := []struct {
+		name   string
+		keys   []JWTKey
+		signer JWTKey
+		header jwtHeader
+		want   error
+	}{
+		{"hs256", []JWTKey{hs}, hs, jwtHeader{Algorithm: JWTHS256, KeyID: "hs"}, nil},
+		{"rs256", []JWTKey{rs}, rs, jwtHeader{Algorithm: JWTRS256, KeyID: "rs"}, nil},
+		{"eddsa", []JWTKey{ed}, ed, jwtHeader{Algorithm: JWTEdDSA, KeyID: "ed"}, nil},
+		{"second key", []JWTKey{hs, ed}, ed, jwtHeader{Algorithm: JWTEdDSA, KeyID: "ed"}, nil},
+		{"only key without kid", []JWTKey{ed}, ed, jwtHeader{Algorithm: JWTEdDSA}, nil},
+		{"no kid among several keys", []JWTKey{hs, ed}, ed, jwtHeader{Algorithm: JWTEdDSA}, ErrInvalidJWT},
+		{"unknown kid", []JWTKey{ed}, ed, jwtHeader{Algorithm: JWTEdDSA, KeyID: "other"}, ErrInvalidJWT},
+		{"kid of another key", []JWTKey{hs, ed}, ed, jwtHeader{Algorithm: JWTEdDSA, KeyID: "hs"}, ErrInvalidJWT},
+		{"alg none", []JWTKey{hs}, hs, jwtHeader{Algorithm: "none", KeyID: "hs"}, ErrInvalidJWT},
+		{"alg of another key type", []JWTKey{rs}, rsPublic, jwtHeader{Algorithm: JWTHS256, KeyID: "rs"}, ErrInvalidJWT},
+		{"signed by an unknown key", []JWTKey{NewHS256Key("hs", []byte("another secret of 32 bytes......"))}, hs,
+			jwtHeader{Algorithm: JWTHS256, KeyID: "hs"}, ErrInvalidJWT},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &JWTConfig{Keys: tt.keys}
+			got, err := c.Verify(context.Background(), signWith(t, tt.signer, tt.header, claims))
+			if err != tt.want {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && got.ID != claims.ID {
+				t.Fatalf("Verify() jti = %q, want %q", got.ID, claims.ID)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyTimes(t *testing.T) {
+	key := NewHS256Key("hs", []byte("0123456789abcdef0123456789abcdef"))
+	now := time.Now()
+	tests := []struct {
+		name      string
+		leeway    time.Duration
+		issuedAt  time.Time
+		expiresAt time.Time
+		want      error
+	}{
+		{"valid", 0, now, now.Add(time.Minute), nil},
+		{"expired", 0, now.Add(-time.Hour), now.Add(-30 * time.Second), ErrJWTExpired},
+		{"expired within the leeway", time.Minute, now.Add(-time.Hour), now.Add(-30 * time.Second), nil},
+		{"expired beyond the leeway", time.Minute, now.Add(-time.Hour), now.Add(-2 * time.Minute), ErrJWTExpired},
+		{"issued in the future", 0, now.Add(30 * time.Second), now.Add(time.Hour), ErrInvalidJWT},
+		{"issued in the future within the leeway", time.Minute, now.Add(30 * time.Second), now.Add(time.Hour), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &JWTConfig{Keys: []JWTKey{key}, Leeway: tt.leeway}
+			token, err := c.Sign(JWTClaims{ID: JWTID("session"), IssuedAt: tt.issuedAt.Unix(), ExpiresAt: tt.expiresAt.Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := c.Verify(context.Background(), token); err != tt.want {
+				t.Fatalf("Verify() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// publicKey rebuilds the public key published in a JWK
+func publicKey(t *testing.T, jwk JWK) JWTKey {
+	t.Helper()
+	decode := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	key := JWTKey{ID: jwk.KeyID, Algorithm: jwk.Algorithm}
+	switch jwk.KeyType {
+	case "RSA":
+		key.PublicKey = &rsa.PublicKey{N: new(big.Int).SetBytes(decode(jwk.N)), E: int(new(big.Int).SetBytes(decode(jwk.E)).Int64())}
+	case "OKP":
+		key.PublicKey = ed25519.PublicKey(decode(jwk.X))
+	default:
+		t.Fatalf("unexpected key type %q", jwk.KeyType)
+	}
+	return key
+}
+
+func TestJWKSRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	tests := []struct {
+		name string
+		key  JWTKey
+	}{
+		{"rs256", NewRS256Key("rs", rsaKey)},
+		{"eddsa", NewEdDSAKey("ed", edKey)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer := &JWTConfig{Keys: []JWTKey{tt.key, NewHS256Key("hs", []byte("0123456789abcdef0123456789abcdef"))}}
+			jsn, err := json.Marshal(issuer.JWKS())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var set JWKSet
+			if err := json.Unmarshal(jsn, &set); err != nil {
+				t.Fatal(err)
+			}
+			if len(set.Keys) != 1 {
+				t.Fatalf("JWKS() has %d keys, want 1: HS256 secrets are left out", len(set.Keys))
+			}
+
+			verifier := &JWTConfig{Keys: []JWTKey{publicKey(t, set.Keys[0])}}
+			token, err := issuer.Sign(JWTClaims{ID: JWTID("session"), IssuedAt: time.Now().Unix(), ExpiresAt: time.Now().Add(time.Minute).Unix()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := verifier.Verify(context.Background(), token); err != nil {
+				t.Fatalf("Verify() with the published key error = %v", err)
+			}
+			if _, err := verifier.Sign(JWTClaims{}); err == nil {
+				t.Fatal("Sign() with a published key succeeded")
+			}
+		})
+	}
+}
+
+func TestBloomFilterHasNoFalseNegatives(t *testing.T) {
+	tests := []struct {
+		name  string
+		size  int
+		added int
+	}{
+		{"empty", 1000, 0},
+		{"below capacity", 1000, 500},
+		{"at capacity", 1000, 1000},
+		{"over capacity", 100, 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newBloomFilter(tt.size)
+			for i := 0; i < tt.added; i++ {
+				f.add(JWTID(strconv.Itoa(i)))
+			}
+			for i := 0; i < tt.added; i++ {
+				if !f.mayContain(JWTID(strconv.Itoa(i))) {
+					t.Fatalf("the filter lost ID %d", i)
+				}
+			}
+			if tt.added > tt.size {
+				return
+			}
+			falsePositives := 0
+			for i := tt.added; i < tt.added+10000; i++ {
+				if f.mayContain(JWTID(strconv.Itoa(i))) {
+					falsePositives++
+				}
+			}
+			if falsePositives > 300 {
+				t.Fatalf("%d false positives in 10000, want about 1%%", falsePositives)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package webredis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrLockNotObtained is returned by TryLock when the lock is held by someone else
+var ErrLockNotObtained = errors.New("the lock is held by someone else")
+
+// ErrLockNotHeld is returned when releasing or refreshing a lock which has expired or was taken over by someone else
+var ErrLockNotHeld = errors.New("the lock is no longer held")
+
+// ErrInvalidLockTTL is returned when a lock is asked to be held for less than a millisecond, the least redis can expire it after
+var ErrInvalidLockTTL = errors.New("the ttl of a lock must be at least a millisecond")
+
+const (
+	lockKeyPrefix       = "lock:"
+	lockMinRetryBackoff = 8 * time.Millisecond
+	lockMaxRetryBackoff = 256 * time.Millisecond
+)
+
+// The scripts only touch the lock if it still holds the token of its owner, so a lock which expired and
+// was obtained by someone else is never released or extended by its previous owner
+var (
+	releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+	refreshLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+)
+
+// Lock is a distributed mutual exclusion lock held in redis. Obtain one using RedisStore.Lock or RedisStore.TryLock
+type Lock struct {
+	rds   *RedisStore
+	key   string
+	token string
+}
+
+// TryLock obtains the lock called `name`, which is held until it is released or until ttl elapses.
+// If the lock is held by someone else, it returns ErrLockNotObtained without waiting
+func (rds *RedisStore) TryLock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if ttl < time.Millisecond {
+		return nil, ErrInvalidLockTTL
+	}
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+
+	key := lockKeyPrefix + name
+	ok, err := rds.Conn.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, ErrLockNotObtained
+	}
+	return &Lock{rds: rds, key: key, token: token}, nil
+}
+
+// Lock obtains the lock called `name`, which is held until it is released or until ttl elapses.
+// If the lock is held by someone else, it waits until it is released or the context is done
+func (rds *RedisStore) Lock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	if ttl < time.Millisecond {
+		return nil, ErrInvalidLockTTL
+	}
+	backoff := lockMinRetryBackoff
+	for {
+		lock, err := rds.TryLock(ctx, name, ttl)
+		if err != ErrLockNotObtained {
+			return lock, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		if backoff *= 2; backoff > lockMaxRetryBackoff {
+			backoff = lockMaxRetryBackoff
+		}
+	}
+}
+
+// Release releases the lock. Returns ErrLockNotHeld if the lock had expired already
+func (l *Lock) Release(ctx context.Context) error {
+	n, err := releaseLockScript.Run(ctx, l.rds.Conn, []string{l.key}, l.token).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// Refresh extends the lock so it is held for ttl from now. Returns ErrLockNotHeld if the lock had expired already
+func (l *Lock) Refresh(ctx context.Context, ttl time.Duration) error {
+	if ttl < time.Millisecond {
+		return ErrInvalidLockTTL
+	}
+	n, err := refreshLockScript.Run(ctx, l.rds.Conn, []string{l.key}, l.token, ttl.Milliseconds()).Int64()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrLockNotHeld
+	}
+	return nil
+}
+
+// KeepAlive refreshes the lock every ttl/2 until the context is done, so work which outlasts ttl keeps the lock.
+// It stops early if the lock is lost, and at once if ttl is less than a millisecond
+func (l *Lock) KeepAlive(ctx context.Context, ttl time.Duration) {
+	if ttl < time.Millisecond {
+		return
+	}
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Refresh(ctx, ttl); err == ErrLockNotHeld {
+				return
+			}
+		}
+	}
+}
+
+// WithLock serializes the requests handled by next which share the same lock name, as returned by `name`.
+// Requests for which `name` returns an empty string are not serialized.
+// The lock is held for ttl, and kept alive for as long as next is running.
+// If the lock cannot be obtained before the request is cancelled, it responds with 503 Service Unavailable.
+// A ttl of less than a millisecond is a mistake: every request which would be serialized is answered 500 Internal Server Error
+func WithLock(rds *RedisStore, name func(r *http.Request) string, ttl time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lockName := name(r)
+		if lockName == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		lock, err := rds.Lock(r.Context(), lockName, ttl)
+		if err == ErrInvalidLockTTL {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		go lock.KeepAlive(ctx, ttl)
+		defer func() {
+			cancel()
+			lock.Release(context.Background())
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func lockToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
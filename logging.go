@@ -0,0 +1,216 @@
+package webredis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// LogLevels sets the level at which each kind of event is logged. See DefaultLogLevels
+type LogLevels struct {
+	// RedisError is the level of failed redis commands, and of lookups and saves which failed because of them
+	RedisError slog.Level
+	// DecryptFailure is the level of sessions which were found, but could not be decrypted
+	DecryptFailure slog.Level
+	// FingerprintMismatch is the level of sessions presented by a client other than the one they are bound to
+	FingerprintMismatch slog.Level
+	// Expired is the level of sessions which were not found in redis
+	Expired slog.Level
+	// Conflict is the level of saves which lost to a concurrent save of the same session
+	Conflict slog.Level
+	// Warning is the level of trouble which does not fail a request: jobs which failed, pub/sub messages which were
+	// dropped or could not be decoded, and refresh or remember-me tokens which were used again after they were replaced
+	Warning slog.Level
+}
+
+// DefaultLogLevels are the levels used when no LogLevels were set
+var DefaultLogLevels = LogLevels{
+	RedisError:          slog.LevelError,
+	DecryptFailure:      slog.LevelWarn,
+	FingerprintMismatch: slog.LevelWarn,
+	Expired:             slog.LevelDebug,
+	Conflict:            slog.LevelInfo,
+	Warning:             slog.LevelWarn,
+}
+
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler drops all records
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// EnableLogging makes the store log the redis commands which fail, and sets the logger which the session stores
+// using it fall back to. Only the names of failed commands are logged, never their arguments, which may hold secrets.
+// levels may be nil to use DefaultLogLevels. Calling it again replaces logger and levels
+func (rds *RedisStore) EnableLogging(logger *slog.Logger, levels *LogLevels) {
+	rds.Logger = logger
+	rds.LogLevels = levels
+	if !rds.loggingHooked {
+		rds.loggingHooked = true
+		rds.Conn.AddHook(loggingHook{rds: rds})
+	}
+}
+
+// LoggerOrNop returns the logger set with EnableLogging, or one which discards everything
+func (rds *RedisStore) LoggerOrNop() *slog.Logger {
+	if rds.Logger == nil {
+		return discardLogger
+	}
+	return rds.Logger
+}
+
+// LogLevelsOrDefault returns the levels set with EnableLogging, or DefaultLogLevels
+func (rds *RedisStore) LogLevelsOrDefault() *LogLevels {
+	if rds.LogLevels == nil {
+		return &DefaultLogLevels
+	}
+	return rds.LogLevels
+}
+
+// RedactID turns a session ID into a value which identifies the session in logs, but cannot be used to hijack it
+func RedactID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// LogLookup logs why the session with the given ID, looked up by a session store, could not be used.
+// Lookups with OutcomeHit or OutcomeMiss are not logged
+func LogLookup(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, outcome string, err error) {
+	var level slog.Level
+	var msg string
+	switch outcome {
+	case OutcomeError:
+		level, msg = levels.RedisError, "webredis: session could not be fetched from redis; a new one was created"
+	case OutcomeDecryptFailure:
+		level, msg = levels.DecryptFailure, "webredis: session could not be decrypted; a new one was created"
+	case OutcomeFingerprintMismatch:
+		level, msg = levels.FingerprintMismatch, "webredis: session was presented by a client other than its owner"
+	case OutcomeExpired:
+		level, msg = levels.Expired, "webredis: session was not found in redis; a new one was created"
+	default:
+		return
+	}
+	logSession(ctx, logger, level, msg, store, name, sessionID, err)
+}
+
+// LogValue logs why a value of the session with the given ID, read for the first time, could not be fetched:
+// outcome is OutcomeError if redis failed, or OutcomeDecryptFailure
+func LogValue(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, outcome string, err error) {
+	level, msg := levels.RedisError, "webredis: session value could not be fetched from redis"
+	if outcome == OutcomeDecryptFailure {
+		level, msg = levels.DecryptFailure, "webredis: session value could not be decrypted"
+	}
+	logSession(ctx, logger, level, msg, store, name, sessionID, err)
+}
+
+// LogSave logs a failed save of a session by a session store
+func LogSave(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	level, msg := levels.RedisError, "webredis: session could not be saved"
+	if err == ErrConflict {
+		level, msg = levels.Conflict, "webredis: session was saved concurrently by another request"
+	}
+	logSession(ctx, logger, level, msg, store, name, sessionID, err)
+}
+
+// LogIndex logs a failed update of the SessionIndex of a session store
+func LogIndex(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	logSession(ctx, logger, levels.RedisError, "webredis: session index could not be updated", store, name, sessionID, err)
+}
+
+// LogAudit logs a failed write to the AuditLog of a session store
+func LogAudit(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	logSession(ctx, logger, levels.RedisError, "webredis: session audit event could not be recorded", store, name, sessionID, err)
+}
+
+// LogInvalidation logs a failure to tell the other instances that a session changed
+func LogInvalidation(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	logSession(ctx, logger, levels.RedisError, "webredis: session cache invalidation could not be sent", store, name, sessionID, err)
+}
+
+// LogNotice logs a failure to broadcast a SessionNotice
+func LogNotice(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	logSession(ctx, logger, levels.RedisError, "webredis: session notice could not be sent", store, name, sessionID, err)
+}
+
+// LogRevocation logs a failure to add a session to the revocation list of the JWTs issued for it
+func LogRevocation(ctx context.Context, logger *slog.Logger, levels *LogLevels, store string, name string, sessionID string, err error) {
+	if err == nil {
+		return
+	}
+	logSession(ctx, logger, levels.RedisError, "webredis: session JWTs could not be revoked", store, name, sessionID, err)
+}
+
+func logSession(ctx context.Context, logger *slog.Logger, level slog.Level, msg string, store string, name string, sessionID string, err error) {
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("store", store),
+		slog.String("session", name),
+		slog.String("id", RedactID(sessionID)),
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("cause", err.Error()))
+	}
+	logger.LogAttrs(ctx, level, msg, attrs...)
+}
+
+// loggingHook logs the commands of a redis.Client which fail
+type loggingHook struct {
+	rds *RedisStore
+}
+
+func (h loggingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h loggingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	h.log(ctx, cmd)
+	return nil
+}
+
+func (h loggingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h loggingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	for _, cmd := range cmds {
+		h.log(ctx, cmd)
+	}
+	return nil
+}
+
+func (h loggingHook) log(ctx context.Context, cmd redis.Cmder) {
+	err := commandErr(cmd)
+	// the breaker logs when it opens and closes, not every command it refuses meanwhile
+	if err == nil || err == redis.TxFailedErr || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	h.rds.LoggerOrNop().LogAttrs(ctx, h.rds.LogLevelsOrDefault().RedisError, "webredis: redis command failed",
+		slog.String("command", strings.ToLower(cmd.Name())),
+		slog.String("cause", err.Error()))
+}
@@ -0,0 +1,115 @@
+package webredis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Outcomes of looking up a session, as reported to Metrics.ObserveLookup. All but OutcomeHit and OutcomeCacheHit
+// are also the reasons reported to Metrics.ObserveSessionCreated when a new session is handed out instead
+const (
+	// OutcomeHit means the session was found and decrypted
+	OutcomeHit = "hit"
+	// OutcomeCacheHit means the session was served from the local cache of the store, without asking redis
+	OutcomeCacheHit = "cache_hit"
+	// OutcomeMiss means the request did not carry a session
+	OutcomeMiss = "miss"
+	// OutcomeExpired means the session was not found in redis, most likely because it expired
+	OutcomeExpired = "expired"
+	// OutcomeDecryptFailure means the session was found, but could not be decrypted
+	OutcomeDecryptFailure = "decrypt_failure"
+	// OutcomeError means redis could not be reached
+	OutcomeError = "error"
+	// OutcomeFingerprintMismatch means the session was presented by a client other than the one it is bound to
+	OutcomeFingerprintMismatch = "fingerprint_mismatch"
+)
+
+// Metrics receives measurements of the work done by a RedisStore and the session stores using it.
+// Enable it with RedisStore.Instrument. Implementations must be safe for concurrent use.
+// See the metrics package for one which exports the measurements to Prometheus
+type Metrics interface {
+	// ObserveCommand is called after every redis command is processed, and once for every pipeline, as command "pipeline"
+	ObserveCommand(command string, duration time.Duration, err error)
+	// ObserveOperation is called after every Get, Save and Delete of a session store, e.g. store "session" and op "get"
+	ObserveOperation(store string, op string, duration time.Duration, err error)
+	// ObserveLookup is called with the outcome whenever a session store looks up the session of a request
+	ObserveLookup(store string, outcome string)
+	// ObserveSessionCreated is called whenever a session store creates a new session, with the reason why
+	ObserveSessionCreated(store string, reason string)
+	// ObservePayloadSize is called with the size in bytes of every encrypted session read from or written to redis
+	ObservePayloadSize(store string, op string, bytes int)
+}
+
+// NopMetrics discards all measurements. It is what the stores report to when no Metrics were set
+type NopMetrics struct{}
+
+func (NopMetrics) ObserveCommand(string, time.Duration, error)           {}
+func (NopMetrics) ObserveOperation(string, string, time.Duration, error) {}
+func (NopMetrics) ObserveLookup(string, string)                          {}
+func (NopMetrics) ObserveSessionCreated(string, string)                  {}
+func (NopMetrics) ObservePayloadSize(string, string, int)                {}
+
+// Instrument makes the store, and the session stores using it, report their measurements to m.
+// Calling it again replaces m
+func (rds *RedisStore) Instrument(m Metrics) {
+	rds.Metrics = m
+	if !rds.metricsHooked {
+		rds.metricsHooked = true
+		rds.Conn.AddHook(metricsHook{rds: rds})
+	}
+}
+
+// MetricsOrNop returns the Metrics set with Instrument, or NopMetrics if there are none
+func (rds *RedisStore) MetricsOrNop() Metrics {
+	if rds.Metrics == nil {
+		return NopMetrics{}
+	}
+	return rds.Metrics
+}
+
+type commandStartKey struct{}
+
+// metricsHook times the commands sent by a redis.Client, and reports them to the Metrics of rds
+type metricsHook struct {
+	rds *RedisStore
+}
+
+func (h metricsHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+func (h metricsHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if start, ok := ctx.Value(commandStartKey{}).(time.Time); ok {
+		h.rds.MetricsOrNop().ObserveCommand(strings.ToLower(cmd.Name()), time.Since(start), commandErr(cmd))
+	}
+	return nil
+}
+
+func (h metricsHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return context.WithValue(ctx, commandStartKey{}, time.Now()), nil
+}
+
+func (h metricsHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	if start, ok := ctx.Value(commandStartKey{}).(time.Time); ok {
+		// the commands of a pipeline are not timed one by one, so the whole pipeline is observed once
+		var err error
+		for _, cmd := range cmds {
+			if err = commandErr(cmd); err != nil {
+				break
+			}
+		}
+		h.rds.MetricsOrNop().ObserveCommand("pipeline", time.Since(start), err)
+	}
+	return nil
+}
+
+// commandErr is the error of a command, not counting redis.Nil which only means a key was not found
+func commandErr(cmd redis.Cmder) error {
+	if err := cmd.Err(); err != nil && err != redis.Nil {
+		return err
+	}
+	return nil
+}
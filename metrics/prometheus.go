@@ -0,0 +1,219 @@
+// Package metrics provides a webredis.Metrics which exports its measurements in the Prometheus text format.
+// It has no dependency on the Prometheus client libraries: mount the collector on your metrics endpoint
+// and scrape it like any other target.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds, in seconds, of the latency histograms
+var DefaultLatencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+
+// DefaultSizeBuckets are the upper bounds, in bytes, of the payload size histograms
+var DefaultSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// Prometheus collects the measurements of a webredis.RedisStore and the session stores using it,
+// and serves them in the Prometheus text exposition format. Create one with NewPrometheus
+type Prometheus struct {
+	commands   *histogramVec
+	operations *histogramVec
+	payloads   *histogramVec
+	lookups    *counterVec
+	created    *counterVec
+}
+
+// NewPrometheus creates a collector whose metric names all start with namespace, e.g. "webredis"
+func NewPrometheus(namespace string) *Prometheus {
+	return &Prometheus{
+		commands: newHistogramVec(namespace+"_redis_command_duration_seconds",
+			"Time taken by redis commands.", DefaultLatencyBuckets, "command", "status"),
+		operations: newHistogramVec(namespace+"_store_operation_duration_seconds",
+			"Time taken by the Get, Save and Delete operations of the session stores.", DefaultLatencyBuckets, "store", "op", "status"),
+		payloads: newHistogramVec(namespace+"_session_payload_bytes",
+			"Size of the encrypted sessions read from and written to redis.", DefaultSizeBuckets, "store", "op"),
+		lookups: newCounterVec(namespace+"_session_lookups_total",
+			"Session lookups by outcome.", "store", "outcome"),
+		created: newCounterVec(namespace+"_sessions_created_total",
+			"New sessions by the reason they were created.", "store", "reason"),
+	}
+}
+
+func status(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (p *Prometheus) ObserveCommand(command string, duration time.Duration, err error) {
+	p.commands.observe(duration.Seconds(), command, status(err))
+}
+
+func (p *Prometheus) ObserveOperation(store string, op string, duration time.Duration, err error) {
+	p.operations.observe(duration.Seconds(), store, op, status(err))
+}
+
+func (p *Prometheus) ObserveLookup(store string, outcome string) {
+	p.lookups.inc(store, outcome)
+}
+
+func (p *Prometheus) ObserveSessionCreated(store string, reason string) {
+	p.created.inc(store, reason)
+}
+
+func (p *Prometheus) ObservePayloadSize(store string, op string, bytes int) {
+	p.payloads.observe(float64(bytes), store, op)
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format
+func (p *Prometheus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	p.commands.write(bw)
+	p.operations.write(bw)
+	p.payloads.write(bw)
+	p.lookups.write(bw)
+	p.created.write(bw)
+	bw.Flush()
+}
+
+// labelKey joins label values into a map key. \xff cannot appear in valid UTF-8 label values
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func formatLabels(names []string, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names)+1)
+	for i, name := range names {
+		pairs = append(pairs, name+"=\""+escape(values[i])+"\"")
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+"=\""+extra[i+1]+"\"")
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*counter
+}
+
+type counter struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]*counter)}
+}
+
+func (cv *counterVec) inc(labels ...string) {
+	key := labelKey(labels)
+	cv.mu.Lock()
+	c, ok := cv.values[key]
+	if !ok {
+		c = &counter{labels: labels}
+		cv.values[key] = c
+	}
+	c.value++
+	cv.mu.Unlock()
+}
+
+func (cv *counterVec) write(w *bufio.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name)
+	keys := make([]string, 0, len(cv.values))
+	for key := range cv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		c := cv.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", cv.name, formatLabels(cv.labels, c.labels), formatFloat(c.value))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (hv *histogramVec) observe(v float64, labels ...string) {
+	key := labelKey(labels)
+	hv.mu.Lock()
+	h, ok := hv.values[key]
+	if !ok {
+		h = &histogram{labels: labels, counts: make([]uint64, len(hv.buckets))}
+		hv.values[key] = h
+	}
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	hv.mu.Unlock()
+}
+
+func (hv *histogramVec) write(w *bufio.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	keys := make([]string, 0, len(hv.values))
+	for key := range hv.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		h := hv.values[key]
+		for i, upper := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, h.labels, "le", formatFloat(upper)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, h.labels, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", hv.name, formatLabels(hv.labels, h.labels), formatFloat(h.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, formatLabels(hv.labels, h.labels), h.count)
+	}
+}
@@ -0,0 +1,331 @@
+package webredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultSessionChannel is the pub/sub channel on which the stores broadcast the sessions they revoke and regenerate
+const DefaultSessionChannel = "webredis:sessions"
+
+// SessionNotice tells the instances of an application that a session can no longer be used,
+// e.g. so servers holding websocket connections opened with it can close them
+type SessionNotice struct {
+	// Kind is SessionDestroyed when the session was revoked or logged out, or SessionRegenerated
+	Kind SessionEventKind `json:"kind"`
+	// Store is the store the session belongs to, e.g. "session" or "token"
+	Store     string `json:"store"`
+	SessionID string `json:"id"`
+	// PreviousID is the ID a regenerated session had before, which can no longer be used
+	PreviousID string `json:"previous_id,omitempty"`
+	Name       string `json:"name,omitempty"`
+	UserID     string `json:"user_id,omitempty"`
+}
+
+// NewSessionTopic creates the Topic of the notices of the stores, on DefaultSessionChannel
+func NewSessionTopic(store *RedisStore) *Topic[SessionNotice] {
+	return NewTopic[SessionNotice](store, DefaultSessionChannel)
+}
+
+// Topic is a redis pub/sub channel carrying messages of type T
+type Topic[T any] struct {
+	Store *RedisStore
+	// Channel is the redis pub/sub channel
+	Channel string
+	// Codec encodes the messages. Defaults to JSONCodec
+	Codec Codec[T]
+}
+
+// NewTopic creates a Topic on channel
+func NewTopic[T any](store *RedisStore, channel string) *Topic[T] {
+	return &Topic[T]{Store: store, Channel: channel}
+}
+
+func (t *Topic[T]) codec() Codec[T] {
+	if t.Codec == nil {
+		return JSONCodec[T]{}
+	}
+	return t.Codec
+}
+
+// Publish sends the messages to the subscribers of every instance, in a single round trip.
+// Redis does not keep the messages: subscribers which are disconnected when they are sent never get them
+func (t *Topic[T]) Publish(ctx context.Context, msgs ...T) error {
+	payloads := make([][]byte, len(msgs))
+	for i, msg := range msgs {
+		var err error
+		if payloads[i], err = t.codec().Marshal(msg); err != nil {
+			return err
+		}
+	}
+	switch len(payloads) {
+	case 0:
+		return nil
+	case 1:
+		return t.Store.Conn.Publish(ctx, t.Channel, payloads[0]).Err()
+	}
+	_, err := t.Store.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, p := range payloads {
+			pipe.Publish(ctx, t.Channel, p)
+		}
+		return nil
+	})
+	return err
+}
+
+// Subscribe has bus call fn with every message of the topic. Messages which cannot be decoded are logged and skipped
+func (t *Topic[T]) Subscribe(bus *EventBus, fn func(ctx context.Context, msg T)) {
+	codec, channel := t.codec(), t.Channel
+	bus.Handle(channel, func(ctx context.Context, payload []byte) {
+		msg, err := codec.Unmarshal(payload)
+		if err != nil {
+			bus.Store.LoggerOrNop().LogAttrs(ctx, bus.Store.LogLevelsOrDefault().Warning, "webredis: pub/sub message could not be decoded",
+				slog.String("channel", channel), slog.String("cause", err.Error()))
+			return
+		}
+		fn(ctx, msg)
+	})
+}
+
+// BusStatus tells the subscribers of an EventBus whether they may have missed messages
+type BusStatus int
+
+const (
+	// BusSubscribed is sent when the bus subscribed to a channel: when it starts, after a reconnection,
+	// and when a handler is added for a new channel
+	BusSubscribed BusStatus = iota
+	// BusDisconnected is sent when the connection is lost, and when Run returns.
+	// The messages sent until the next BusSubscribed are lost
+	BusDisconnected
+	// BusDropped is sent for every message dropped because the handlers fell behind. See EventBus.Block
+	BusDropped
+)
+
+func (s BusStatus) String() string {
+	switch s {
+	case BusSubscribed:
+		return "subscribed"
+	case BusDisconnected:
+		return "disconnected"
+	case BusDropped:
+		return "dropped"
+	}
+	return fmt.Sprintf("BusStatus(%d)", int(s))
+}
+
+const (
+	defaultBusBufferSize = 1024
+	// busHealthCheck is how long the bus waits for a message before it pings redis to check the connection
+	busHealthCheck       = 30 * time.Second
+	busMaxReconnectDelay = 5 * time.Second
+)
+
+// EventBus receives the messages of several pub/sub channels on a single redis connection, and hands them to handlers.
+// The messages wait in a buffer, and are handed over one at a time, in the order they were received, on a goroutine of their own.
+// When the handlers fall behind and the buffer is full, new messages are dropped, unless Block is set.
+// A lost connection is reestablished, and the channels subscribed again; the messages sent meanwhile are lost.
+// Subscribers which must not miss any, e.g. caches, learn about it through OnStatus.
+// The zero value is not usable: create it with NewEventBus
+type EventBus struct {
+	Store *RedisStore
+	// BufferSize is how many messages may wait for the handlers. Defaults to 1024
+	BufferSize int
+	// Block makes the bus stop reading messages when the buffer is full, rather than drop them.
+	// Redis then buffers them itself, until they exceed its client-output-buffer-limit for pubsub and it closes the connection
+	Block bool
+
+	mu       sync.Mutex
+	handlers map[string][]func(ctx context.Context, payload []byte)
+	statuses []func(ctx context.Context, status BusStatus)
+	running  bool
+	pubsub   *redis.PubSub
+	ctx      context.Context
+	dropped  atomic.Uint64
+}
+
+// NewEventBus creates an EventBus receiving messages from the redis of store
+func NewEventBus(store *RedisStore) *EventBus {
+	return &EventBus{Store: store, handlers: make(map[string][]func(ctx context.Context, payload []byte))}
+}
+
+func (b *EventBus) bufferSize() int {
+	if b.BufferSize <= 0 {
+		return defaultBusBufferSize
+	}
+	return b.BufferSize
+}
+
+// Handle registers fn to be called with the payload of every message of channel. Handlers may be added while the bus runs.
+// Handlers should be quick, as the messages of all channels wait for them; hand long work over to another goroutine
+func (b *EventBus) Handle(channel string, fn func(ctx context.Context, payload []byte)) {
+	b.mu.Lock()
+	_, known := b.handlers[channel]
+	b.handlers[channel] = append(b.handlers[channel], fn)
+	pubsub, ctx := b.pubsub, b.ctx
+	b.mu.Unlock()
+	if known || pubsub == nil {
+		return
+	}
+	// the channel is subscribed again after a reconnection if this fails
+	if err := pubsub.Subscribe(ctx, channel); err != nil && ctx.Err() == nil {
+		b.logRedisError(ctx, "webredis: pub/sub channel could not be subscribed", err)
+	}
+}
+
+// OnStatus registers fn to be called when the bus subscribes, loses its connection or drops a message.
+// It is called on the goroutine receiving the messages, so it must be quick
+func (b *EventBus) OnStatus(fn func(ctx context.Context, status BusStatus)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.statuses = append(b.statuses, fn)
+}
+
+// Dropped counts the messages dropped because the handlers fell behind
+func (b *EventBus) Dropped() uint64 {
+	return b.dropped.Load()
+}
+
+func (b *EventBus) status(ctx context.Context, status BusStatus) {
+	b.mu.Lock()
+	fns := b.statuses
+	b.mu.Unlock()
+	for _, fn := range fns {
+		fn(ctx, status)
+	}
+}
+
+func (b *EventBus) dispatch(ctx context.Context, msg *redis.Message) {
+	b.mu.Lock()
+	fns := b.handlers[msg.Channel]
+	b.mu.Unlock()
+	for _, fn := range fns {
+		fn(ctx, []byte(msg.Payload))
+	}
+}
+
+// subscribe opens a new subscription to the channels of the handlers, closing the previous one if any
+func (b *EventBus) subscribe(ctx context.Context) *redis.PubSub {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pubsub != nil {
+		b.pubsub.Close()
+	}
+	channels := make([]string, 0, len(b.handlers))
+	for channel := range b.handlers {
+		channels = append(channels, channel)
+	}
+	b.pubsub, b.ctx = b.Store.Conn.Subscribe(ctx, channels...), ctx
+	return b.pubsub
+}
+
+// Run receives messages and hands them to the handlers until ctx is done. It returns once the handlers are done with
+// the messages received before. Run it on its own goroutine; a bus may only run once at a time
+func (b *EventBus) Run(ctx context.Context) error {
+	b.mu.Lock()
+	running := b.running
+	b.running = true
+	b.mu.Unlock()
+	if running {
+		return errors.New("webredis: the event bus is already running")
+	}
+
+	queue := make(chan *redis.Message, b.bufferSize())
+	var dispatching sync.WaitGroup
+	dispatching.Add(1)
+	go func() {
+		defer dispatching.Done()
+		for msg := range queue {
+			b.dispatch(ctx, msg)
+		}
+	}()
+
+	pubsub := b.subscribe(ctx)
+	subscribed, dropping, pinged := false, false, false
+	var delay time.Duration
+	defer func() {
+		b.mu.Lock()
+		b.pubsub.Close()
+		b.pubsub, b.ctx, b.running = nil, nil, false
+		b.mu.Unlock()
+		close(queue)
+		dispatching.Wait()
+		if subscribed {
+			b.status(context.WithoutCancel(ctx), BusDisconnected)
+		}
+	}()
+
+	for {
+		msg, err := pubsub.ReceiveTimeout(ctx, busHealthCheck)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			if !pinged {
+				// quiet channels look the same as a dead connection: ask redis
+				pinged = true
+				pubsub.Ping(ctx)
+				continue
+			}
+			err = errors.New("redis did not answer a ping")
+			pubsub = b.subscribe(ctx)
+		}
+		if err != nil {
+			if subscribed {
+				subscribed = false
+				b.status(ctx, BusDisconnected)
+				b.logRedisError(ctx, "webredis: pub/sub connection lost", err)
+			}
+			pinged = false
+			delay = min(max(2*delay, 100*time.Millisecond), busMaxReconnectDelay)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			continue
+		}
+		pinged = false
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				subscribed, delay = true, 0
+				b.status(ctx, BusSubscribed)
+			}
+		case *redis.Message:
+			if b.Block {
+				select {
+				case queue <- msg:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+				continue
+			}
+			select {
+			case queue <- msg:
+				dropping = false
+			default:
+				b.dropped.Add(1)
+				if !dropping {
+					dropping = true
+					b.Store.LoggerOrNop().LogAttrs(ctx, b.Store.LogLevelsOrDefault().Warning, "webredis: pub/sub messages dropped as the handlers fell behind",
+						slog.String("channel", msg.Channel))
+				}
+				b.status(ctx, BusDropped)
+			}
+		}
+	}
+}
+
+func (b *EventBus) logRedisError(ctx context.Context, msg string, err error) {
+	b.Store.LoggerOrNop().LogAttrs(ctx, b.Store.LogLevelsOrDefault().RedisError, msg, slog.String("cause", err.Error()))
+}
@@ -0,0 +1,272 @@
+// Package queue is a reliable job queue kept in a redis stream. Jobs are handed out to workers through a consumer group,
+// so every job is handled by one worker at a time, and stays in redis until its worker acknowledges it.
+// Jobs which fail are retried after a backoff, then moved to a dead-letter stream; jobs of workers which crashed
+// are handed to another worker
+package queue
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultPrefix is prepended to the keys of a Queue which does not set its own Prefix
+const DefaultPrefix = "webredis:queue:"
+
+// DefaultGroup is the consumer group the workers of a Queue belong to, unless told otherwise
+const DefaultGroup = "workers"
+
+// Queue is a queue of jobs whose payloads are of type T. Create it with New
+type Queue[T any] struct {
+	Store *webredis.RedisStore
+	// Name identifies the queue
+	Name string
+	// Prefix is prepended to the keys of the queue in redis. Defaults to DefaultPrefix
+	Prefix string
+	// Group is the consumer group of the workers. Defaults to DefaultGroup
+	Group string
+	// Codec encodes the payloads. Defaults to webredis.JSONCodec
+	Codec webredis.Codec[T]
+	// MaxDead caps the number of jobs kept in the dead-letter stream, dropping the oldest as new ones are added.
+	// 0 keeps them all. The stream is trimmed approximately, so it may hold a few more.
+	// The jobs waiting in the queue are never dropped
+	MaxDead int64
+	// MaxAttempts is how many times a job is tried before it is moved to the dead-letter stream. Defaults to 5
+	MaxAttempts int
+	// Backoff is how long to wait before trying a job again after the given failed attempt, 1 being the first.
+	// Defaults to ExponentialBackoff(time.Second, 10*time.Minute)
+	Backoff func(attempt int) time.Duration
+	// VisibilityTimeout is how long a job may run before its worker is deemed to have crashed,
+	// and the job is handed to another worker. Defaults to 5 minutes
+	VisibilityTimeout time.Duration
+}
+
+// New creates a queue called name
+func New[T any](store *webredis.RedisStore, name string) *Queue[T] {
+	return &Queue[T]{Store: store, Name: name, Prefix: DefaultPrefix, Group: DefaultGroup}
+}
+
+// Job is a job handed to a worker
+type Job[T any] struct {
+	// ID is the ID of the job in the stream. A job which is retried gets a new ID
+	ID      string
+	Payload T
+	// Attempt counts the times the job was tried, this one included
+	Attempt int
+	// EnqueuedAt is when the job was added to the stream, for this attempt
+	EnqueuedAt time.Time
+}
+
+// DeadJob is a job which failed too many times, as kept in the dead-letter stream
+type DeadJob[T any] struct {
+	Job[T]
+	// Error is the error of the last attempt
+	Error    string
+	FailedAt time.Time
+}
+
+// ExponentialBackoff waits base after the first failed attempt, and twice as long after each of the next ones, up to max.
+// The waits are randomized by up to half, so the jobs which failed together are not all tried again together
+func ExponentialBackoff(base time.Duration, max time.Duration) func(attempt int) time.Duration {
+	return func(attempt int) time.Duration {
+		d := base
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+}
+
+func (q *Queue[T]) prefix() string {
+	if q.Prefix == "" {
+		return DefaultPrefix
+	}
+	return q.Prefix
+}
+
+func (q *Queue[T]) group() string {
+	if q.Group == "" {
+		return DefaultGroup
+	}
+	return q.Group
+}
+
+func (q *Queue[T]) codec() webredis.Codec[T] {
+	if q.Codec == nil {
+		return webredis.JSONCodec[T]{}
+	}
+	return q.Codec
+}
+
+func (q *Queue[T]) maxAttempts() int {
+	if q.MaxAttempts <= 0 {
+		return 5
+	}
+	return q.MaxAttempts
+}
+
+func (q *Queue[T]) backoff(attempt int) time.Duration {
+	if q.Backoff == nil {
+		return ExponentialBackoff(time.Second, 10*time.Minute)(attempt)
+	}
+	return q.Backoff(attempt)
+}
+
+func (q *Queue[T]) visibilityTimeout() time.Duration {
+	if q.VisibilityTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return q.VisibilityTimeout
+}
+
+// streamKey holds the jobs waiting to be handled, and those being handled
+func (q *Queue[T]) streamKey() string {
+	return q.prefix() + q.Name
+}
+
+// delayedKey holds the jobs waiting to be tried again, scored by when
+func (q *Queue[T]) delayedKey() string {
+	return q.prefix() + q.Name + ":delayed"
+}
+
+// deadKey is the dead-letter stream
+func (q *Queue[T]) deadKey() string {
+	return q.prefix() + q.Name + ":dead"
+}
+
+// Enqueue adds a job to the queue, and returns its ID
+func (q *Queue[T]) Enqueue(ctx context.Context, payload T) (string, error) {
+	p, err := q.codec().Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	return q.Store.Conn.XAdd(ctx, &redis.XAddArgs{
+		Stream: q.streamKey(),
+		Values: []interface{}{"payload", p, "attempt", 1},
+	}).Result()
+}
+
+// job decodes a job read from the stream. deliveries is how many times the stream handed it out
+func (q *Queue[T]) job(msg redis.XMessage, deliveries int64) (*Job[T], error) {
+	job := &Job[T]{ID: msg.ID, EnqueuedAt: streamTime(msg.ID)}
+	attempt, _ := strconv.Atoi(field(msg, "attempt"))
+	if attempt < 1 {
+		attempt = 1
+	}
+	// a job handed out again was being handled by a worker which crashed
+	job.Attempt = attempt + int(deliveries) - 1
+	payload, err := q.codec().Unmarshal([]byte(field(msg, "payload")))
+	job.Payload = payload
+	return job, err
+}
+
+func field(msg redis.XMessage, name string) string {
+	s, _ := msg.Values[name].(string)
+	return s
+}
+
+// streamTime is the time at which the entry with the given ID was added to its stream
+func streamTime(id string) time.Time {
+	ms, _, _ := strings.Cut(id, "-")
+	n, _ := strconv.ParseInt(ms, 10, 64)
+	return time.UnixMilli(n)
+}
+
+// Stats describes the jobs of a queue
+type Stats struct {
+	// Waiting is the number of jobs in the stream, being handled or not
+	Waiting int64
+	// Pending is the number of jobs handed to a worker and not acknowledged yet
+	Pending int64
+	// Delayed is the number of jobs waiting to be tried again
+	Delayed int64
+	// Dead is the number of jobs in the dead-letter stream
+	Dead int64
+}
+
+// Stats counts the jobs of the queue
+func (q *Queue[T]) Stats(ctx context.Context) (Stats, error) {
+	var waiting, delayed, dead *redis.IntCmd
+	var pending *redis.XPendingCmd
+	_, err := q.Store.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		waiting = pipe.XLen(ctx, q.streamKey())
+		pending = pipe.XPending(ctx, q.streamKey(), q.group())
+		delayed = pipe.ZCard(ctx, q.delayedKey())
+		dead = pipe.XLen(ctx, q.deadKey())
+		return nil
+	})
+	// a queue which no worker has read from yet has no group
+	if err != nil && !isNoGroup(pending.Err()) {
+		return Stats{}, err
+	}
+	stats := Stats{Waiting: waiting.Val(), Delayed: delayed.Val(), Dead: dead.Val()}
+	if pending.Err() == nil {
+		stats.Pending = pending.Val().Count
+	}
+	return stats, nil
+}
+
+// createGroup creates the consumer group, and the stream, unless they exist
+func (q *Queue[T]) createGroup(ctx context.Context) error {
+	err := q.Store.Conn.XGroupCreateMkStream(ctx, q.streamKey(), q.group(), "0").Err()
+	if err != nil && strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil
+	}
+	return err
+}
+
+func isNoGroup(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "NOGROUP")
+}
+
+// DeadJobs returns up to limit jobs of the dead-letter stream, oldest first. A limit of 0 or less returns them all
+func (q *Queue[T]) DeadJobs(ctx context.Context, limit int64) ([]DeadJob[T], error) {
+	var msgs []redis.XMessage
+	var err error
+	if limit > 0 {
+		msgs, err = q.Store.Conn.XRangeN(ctx, q.deadKey(), "-", "+", limit).Result()
+	} else {
+		msgs, err = q.Store.Conn.XRange(ctx, q.deadKey(), "-", "+").Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]DeadJob[T], 0, len(msgs))
+	for _, msg := range msgs {
+		dead := DeadJob[T]{Error: field(msg, "error"), FailedAt: streamTime(msg.ID)}
+		job, _ := q.job(msg, 1)
+		dead.Job = *job
+		jobs = append(jobs, dead)
+	}
+	return jobs, nil
+}
+
+// RetryDead moves a job of the dead-letter stream back to the queue, to be tried MaxAttempts times again.
+// It returns the new ID of the job, or redis.Nil if there is no such dead job
+func (q *Queue[T]) RetryDead(ctx context.Context, id string) (string, error) {
+	msgs, err := q.Store.Conn.XRange(ctx, q.deadKey(), id, id).Result()
+	if err != nil {
+		return "", err
+	}
+	if len(msgs) == 0 {
+		return "", redis.Nil
+	}
+	var add *redis.StringCmd
+	_, err = q.Store.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		add = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: q.streamKey(),
+			Values: []interface{}{"payload", field(msgs[0], "payload"), "attempt", 1},
+		})
+		pipe.XDel(ctx, q.deadKey(), id)
+		return nil
+	})
+	return add.Val(), err
+}
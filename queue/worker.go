@@ -0,0 +1,282 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gbenroscience/webredis/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// Handler handles a job. Returning an error, or panicking, makes the job fail: it is tried again later,
+// or moved to the dead-letter stream once it used up its attempts
+type Handler[T any] func(ctx context.Context, job *Job[T]) error
+
+// Worker runs a pool of goroutines handling the jobs of a queue
+type Worker[T any] struct {
+	Queue   *Queue[T]
+	Handler Handler[T]
+	// Concurrency is how many jobs are handled at the same time. Defaults to 1
+	Concurrency int
+	// Consumer names the worker in the consumer group. It must be unique among the running workers.
+	// Defaults to the host name, the process ID and a random suffix
+	Consumer string
+	// PollInterval is how often the worker looks for jobs to try again and jobs of crashed workers. Defaults to 1 second
+	PollInterval time.Duration
+}
+
+// NewWorker creates a worker handling up to concurrency jobs of the queue at the same time
+func (q *Queue[T]) NewWorker(handler Handler[T], concurrency int) *Worker[T] {
+	return &Worker[T]{Queue: q, Handler: handler, Concurrency: concurrency}
+}
+
+func (w *Worker[T]) concurrency() int {
+	if w.Concurrency <= 0 {
+		return 1
+	}
+	return w.Concurrency
+}
+
+func (w *Worker[T]) pollInterval() time.Duration {
+	if w.PollInterval <= 0 {
+		return time.Second
+	}
+	return w.PollInterval
+}
+
+// promoteScript moves the delayed jobs which are due back to the stream.
+// Members are "attempt:id:payload", the id making them unique
+var promoteScript = redis.NewScript(`
+redis.replicate_commands()
+local due = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1], 'LIMIT', 0, ARGV[2])
+for _, member in ipairs(due) do
+	local attempt, id, payload = string.match(member, '^(%d+):([^:]+):(.*)$')
+	if attempt then
+		redis.call('XADD', KEYS[1], '*', 'payload', payload, 'attempt', attempt)
+	end
+	redis.call('ZREM', KEYS[2], member)
+end
+return #due`)
+
+// Run handles jobs until ctx is done, then waits for the jobs being handled to finish.
+// Their handlers see ctx done too, so they can stop early; the jobs they do not finish are handed to another worker
+// after the VisibilityTimeout
+func (w *Worker[T]) Run(ctx context.Context) error {
+	q := w.Queue
+	if w.Consumer == "" {
+		host, _ := os.Hostname()
+		rnd := utils.NewRnd()
+		w.Consumer = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), rnd.GenULID())
+	}
+	if err := q.createGroup(ctx); err != nil {
+		return err
+	}
+
+	slots := make(chan struct{}, w.concurrency())
+	var running sync.WaitGroup
+	defer running.Wait()
+	handle := func(msg redis.XMessage, deliveries int64) {
+		running.Add(1)
+		go func() {
+			defer func() {
+				<-slots
+				running.Done()
+			}()
+			w.process(ctx, msg, deliveries)
+		}()
+	}
+
+	var maintained time.Time
+	for {
+		// wait for a free slot, then take all the free ones
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		free := 1
+		for taken := false; !taken && free < cap(slots); {
+			select {
+			case slots <- struct{}{}:
+				free++
+			default:
+				taken = true
+			}
+		}
+
+		var claimed []redis.XPendingExt
+		var msgs []redis.XMessage
+		if time.Since(maintained) >= w.pollInterval() {
+			maintained = time.Now()
+			w.promote(ctx)
+			claimed, msgs = w.reclaim(ctx, free)
+		}
+		if len(msgs) == 0 {
+			streams, err := q.Store.Conn.XReadGroup(ctx, &redis.XReadGroupArgs{
+				Group:    q.group(),
+				Consumer: w.Consumer,
+				Streams:  []string{q.streamKey(), ">"},
+				Count:    int64(free),
+				Block:    w.pollInterval(),
+			}).Result()
+			if isNoGroup(err) {
+				// the stream was deleted
+				err = q.createGroup(ctx)
+			}
+			if err != nil && err != redis.Nil && ctx.Err() == nil {
+				w.logRedisError(ctx, "webredis: jobs could not be read", err)
+				w.sleep(ctx)
+			}
+			if len(streams) > 0 {
+				msgs = streams[0].Messages
+			}
+		}
+
+		deliveries := make(map[string]int64, len(claimed))
+		for _, p := range claimed {
+			deliveries[p.ID] = p.RetryCount
+		}
+		for _, msg := range msgs {
+			n, ok := deliveries[msg.ID]
+			if !ok {
+				n = 1
+			}
+			handle(msg, n)
+			free--
+		}
+		for ; free > 0; free-- {
+			<-slots
+		}
+	}
+}
+
+// sleep waits PollInterval, or until ctx is done
+func (w *Worker[T]) sleep(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(w.pollInterval()):
+	}
+}
+
+// promote moves the jobs which are due to be tried again back to the stream
+func (w *Worker[T]) promote(ctx context.Context) {
+	q := w.Queue
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	err := promoteScript.Run(ctx, q.Store.Conn, []string{q.streamKey(), q.delayedKey()}, now, 100).Err()
+	if err != nil && ctx.Err() == nil {
+		w.logRedisError(ctx, "webredis: delayed jobs could not be moved to the queue", err)
+	}
+}
+
+// reclaim takes over up to count jobs which were handed to a worker longer than VisibilityTimeout ago,
+// as that worker most likely crashed
+func (w *Worker[T]) reclaim(ctx context.Context, count int) ([]redis.XPendingExt, []redis.XMessage) {
+	q := w.Queue
+	pending, err := q.Store.Conn.XPendingExt(ctx, &redis.XPendingExtArgs{
+		Stream: q.streamKey(),
+		Group:  q.group(),
+		Idle:   q.visibilityTimeout(),
+		Start:  "-",
+		End:    "+",
+		Count:  int64(count),
+	}).Result()
+	if err != nil || len(pending) == 0 {
+		if err != nil && ctx.Err() == nil {
+			w.logRedisError(ctx, "webredis: pending jobs could not be listed", err)
+		}
+		return nil, nil
+	}
+	ids := make([]string, len(pending))
+	for i, p := range pending {
+		ids[i] = p.ID
+	}
+	msgs, err := q.Store.Conn.XClaim(ctx, &redis.XClaimArgs{
+		Stream:   q.streamKey(),
+		Group:    q.group(),
+		Consumer: w.Consumer,
+		MinIdle:  q.visibilityTimeout(),
+		Messages: ids,
+	}).Result()
+	if err != nil {
+		if ctx.Err() == nil {
+			w.logRedisError(ctx, "webredis: pending jobs could not be claimed", err)
+		}
+		return nil, nil
+	}
+	for i := range pending {
+		// XCLAIM counts as one more delivery
+		pending[i].RetryCount++
+	}
+	return pending, msgs
+}
+
+// process handles a job, then acknowledges it, schedules it to be tried again, or moves it to the dead-letter stream
+func (w *Worker[T]) process(ctx context.Context, msg redis.XMessage, deliveries int64) {
+	q := w.Queue
+	job, err := q.job(msg, deliveries)
+	switch {
+	case err != nil:
+		// a payload which cannot be decoded never will be
+		job.Attempt = q.maxAttempts()
+	case job.Attempt > q.maxAttempts():
+		// the job was handed out again and again, most likely because it crashes its workers
+		job.Attempt, err = q.maxAttempts(), errors.New("the workers handling the job stopped responding")
+	default:
+		err = w.call(ctx, job)
+	}
+	if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		// the worker is stopping: leave the job to be reclaimed
+		return
+	}
+
+	// the job is settled even if ctx is done, so it is not handled again
+	sctx := context.WithoutCancel(ctx)
+	_, rerr := q.Store.Conn.TxPipelined(sctx, func(pipe redis.Pipeliner) error {
+		switch {
+		case err == nil:
+		case job.Attempt >= q.maxAttempts():
+			pipe.XAdd(sctx, &redis.XAddArgs{
+				Stream: q.deadKey(),
+				MaxLen: q.MaxDead,
+				Approx: true,
+				Values: []interface{}{"payload", field(msg, "payload"), "attempt", job.Attempt, "error", err.Error(), "job", msg.ID},
+			})
+		default:
+			due := time.Now().Add(q.backoff(job.Attempt))
+			member := strconv.Itoa(job.Attempt+1) + ":" + msg.ID + ":" + field(msg, "payload")
+			pipe.ZAdd(sctx, q.delayedKey(), &redis.Z{Score: float64(due.UnixMilli()), Member: member})
+		}
+		pipe.XAck(sctx, q.streamKey(), q.group(), msg.ID)
+		pipe.XDel(sctx, q.streamKey(), msg.ID)
+		return nil
+	})
+	if err != nil {
+		q.Store.LoggerOrNop().LogAttrs(ctx, q.Store.LogLevelsOrDefault().Warning, "webredis: job failed",
+			slog.String("queue", q.Name), slog.String("job", msg.ID), slog.Int("attempt", job.Attempt), slog.String("cause", err.Error()))
+	}
+	if rerr != nil {
+		w.logRedisError(ctx, "webredis: job could not be acknowledged", rerr)
+	}
+}
+
+// call runs the handler, turning a panic into an error
+func (w *Worker[T]) call(ctx context.Context, job *Job[T]) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("the handler panicked: %v", p)
+		}
+	}()
+	return w.Handler(ctx, job)
+}
+
+func (w *Worker[T]) logRedisError(ctx context.Context, msg string, err error) {
+	q := w.Queue
+	q.Store.LoggerOrNop().LogAttrs(ctx, q.Store.LogLevelsOrDefault().RedisError, msg,
+		slog.String("queue", q.Name), slog.String("cause", err.Error()))
+}
@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/go-redis/redis/v8"
+)
+
+// The scripts read the clock of the redis server, so that all instances of an application agree on the time
+var (
+	fixedWindowScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {n, redis.call("PTTL", KEYS[1])}`)
+
+	slidingWindowScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local window = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local count = redis.call("ZCARD", KEYS[1])
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+local reset = 0
+if oldest[2] then
+	reset = tonumber(oldest[2]) + window - now
+end
+if count < limit then
+	redis.call("ZADD", KEYS[1], now, now .. ":" .. ARGV[3])
+	redis.call("PEXPIRE", KEYS[1], window)
+	if count == 0 then
+		reset = window
+	end
+	return {1, count + 1, reset}
+end
+return {0, count, reset}`)
+
+	tokenBucketScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local capacity = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(bucket[1])
+local ts = tonumber(bucket[2])
+if tokens == nil or ts == nil then
+	tokens = capacity
+	ts = now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate)
+end
+local full = math.ceil((capacity - tokens) / rate)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", tostring(now))
+redis.call("PEXPIRE", KEYS[1], math.max(full, 1))
+return {allowed, math.floor(tokens), retry, full}`)
+)
+
+// FixedWindow allows Limit requests per key in every Window. It is the cheapest limiter,
+// but lets through up to twice the limit around the boundary of two windows
+type FixedWindow struct {
+	Store  *webredis.RedisStore
+	Limit  int
+	Window time.Duration
+	// Prefix is prepended to the keys of the limiter in redis. Defaults to DefaultPrefix
+	Prefix string
+}
+
+// NewFixedWindow creates a limiter which allows `limit` requests per key in every window
+func NewFixedWindow(store *webredis.RedisStore, limit int, window time.Duration) *FixedWindow {
+	return &FixedWindow{Store: store, Limit: limit, Window: window}
+}
+
+func (fw *FixedWindow) Allow(ctx context.Context, key string) (Result, error) {
+	vals, err := fixedWindowScript.Run(ctx, fw.Store.Conn, []string{prefixed(fw.Prefix, "fw:"+key)}, fw.Window.Milliseconds()).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	count, ttl := int(vals[0]), time.Duration(vals[1])*time.Millisecond
+	res := Result{Allowed: count <= fw.Limit, Limit: fw.Limit, Remaining: fw.Limit - count, ResetAfter: ttl}
+	if res.Remaining < 0 {
+		res.Remaining = 0
+	}
+	if !res.Allowed {
+		res.RetryAfter = ttl
+	}
+	return res, nil
+}
+
+// SlidingWindowLog allows Limit requests per key in any period of length Window.
+// It keeps a log of the requests in a sorted set, so it is exact, but uses memory proportional to Limit
+type SlidingWindowLog struct {
+	Store  *webredis.RedisStore
+	Limit  int
+	Window time.Duration
+	// Prefix is prepended to the keys of the limiter in redis. Defaults to DefaultPrefix
+	Prefix string
+}
+
+// NewSlidingWindowLog creates a limiter which allows `limit` requests per key in any period of length window
+func NewSlidingWindowLog(store *webredis.RedisStore, limit int, window time.Duration) *SlidingWindowLog {
+	return &SlidingWindowLog{Store: store, Limit: limit, Window: window}
+}
+
+func (sw *SlidingWindowLog) Allow(ctx context.Context, key string) (Result, error) {
+	member, err := uniqueMember()
+	if err != nil {
+		return Result{}, err
+	}
+	vals, err := slidingWindowScript.Run(ctx, sw.Store.Conn, []string{prefixed(sw.Prefix, "sw:"+key)}, sw.Window.Milliseconds(), sw.Limit, member).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	reset := time.Duration(vals[2]) * time.Millisecond
+	res := Result{Allowed: vals[0] == 1, Limit: sw.Limit, Remaining: sw.Limit - int(vals[1]), ResetAfter: reset}
+	if !res.Allowed {
+		// the oldest request leaving the window makes room for the next one
+		res.RetryAfter = reset
+	}
+	return res, nil
+}
+
+// ErrInvalidRate is returned by TokenBucket when its Rate is not a positive number
+var ErrInvalidRate = errors.New("ratelimit: the rate of a token bucket must be positive")
+
+// TokenBucket allows bursts of up to Capacity requests per key, refilled at Rate requests per second
+type TokenBucket struct {
+	Store    *webredis.RedisStore
+	Capacity int
+	Rate     float64
+	// Prefix is prepended to the keys of the limiter in redis. Defaults to DefaultPrefix
+	Prefix string
+}
+
+// NewTokenBucket creates a limiter which allows bursts of up to `capacity` requests per key, refilled at `rate` requests per second
+func NewTokenBucket(store *webredis.RedisStore, capacity int, rate float64) *TokenBucket {
+	return &TokenBucket{Store: store, Capacity: capacity, Rate: rate}
+}
+
+func (tb *TokenBucket) Allow(ctx context.Context, key string) (Result, error) {
+	if !(tb.Rate > 0) || math.IsInf(tb.Rate, 1) {
+		return Result{}, ErrInvalidRate
+	}
+	perMilli := tb.Rate / 1000
+	vals, err := tokenBucketScript.Run(ctx, tb.Store.Conn, []string{prefixed(tb.Prefix, "tb:"+key)}, tb.Capacity, perMilli).Int64Slice()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Allowed:    vals[0] == 1,
+		Limit:      tb.Capacity,
+		Remaining:  int(vals[1]),
+		RetryAfter: time.Duration(vals[2]) * time.Millisecond,
+		ResetAfter: time.Duration(vals[3]) * time.Millisecond,
+	}, nil
+}
@@ -0,0 +1,148 @@
+// Package ratelimit limits how often a client may do something, counting its requests in redis
+// so the limits hold across all instances of an application.
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultPrefix is prepended to the keys of all limiters which do not set their own Prefix
+const DefaultPrefix = "ratelimit:"
+
+// Result is the outcome of asking a Limiter whether a request may go through
+type Result struct {
+	// Allowed is true if the request may go through
+	Allowed bool
+	// Limit is the maximum number of requests allowed by the limiter
+	Limit int
+	// Remaining is the number of requests which may still go through right now
+	Remaining int
+	// ResetAfter is how long until the limiter is back to allowing Limit requests
+	ResetAfter time.Duration
+	// RetryAfter is how long the client has to wait before a request is allowed, when Allowed is false
+	RetryAfter time.Duration
+}
+
+// Limiter decides whether a request made by the client identified by key may go through
+type Limiter interface {
+	Allow(ctx context.Context, key string) (Result, error)
+}
+
+// KeyFunc identifies the client making a request, e.g. by its IP address, session or user.
+// Returning an empty string exempts the request from rate limiting
+type KeyFunc func(r *http.Request) string
+
+// ByIP identifies clients by the host part of r.RemoteAddr
+func ByIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// BySession identifies clients by the ID of their `name` session cookie
+func BySession(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if c, err := r.Cookie(name); err == nil && len(c.Value) > 0 {
+			return "session:" + c.Value
+		}
+		return ""
+	}
+}
+
+// ByHeader identifies clients by the value of a request header, e.g. one carrying an API key or user ID
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if val := r.Header.Get(name); val != "" {
+			return "header:" + name + ":" + val
+		}
+		return ""
+	}
+}
+
+// SessionUsers finds the user of a session, as RedisSessionStore and RedisTokenStore do
+type SessionUsers interface {
+	SessionUser(ctx context.Context, sessionID string) (string, error)
+}
+
+// ByUser identifies clients by the UserID of their `name` session cookie, as found in store,
+// so a user is limited across all of their sessions. Requests without a signed in user are identified by ByIP
+func ByUser(store SessionUsers, name string) KeyFunc {
+	return func(r *http.Request) string {
+		if c, err := r.Cookie(name); err == nil && len(c.Value) > 0 {
+			if userID, err := store.SessionUser(r.Context(), c.Value); err == nil && userID != "" {
+				return "user:" + userID
+			}
+		}
+		return ByIP(r)
+	}
+}
+
+// Middleware rate limits the requests handled by an http.Handler
+type Middleware struct {
+	Limiter Limiter
+	Key     KeyFunc
+	// FailOpen lets requests through when the limiter fails, e.g. because redis is down.
+	// By default such requests get 503 Service Unavailable
+	FailOpen bool
+}
+
+// Handler rate limits the requests handled by next. Every response carries the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, and requests over the limit are refused with
+// 429 Too Many Requests and a Retry-After header
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := m.Key(r)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := m.Limiter.Allow(r.Context(), key)
+		if err != nil {
+			if m.FailOpen {
+				next.ServeHTTP(w, r)
+			} else {
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			}
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.FormatInt(seconds(res.ResetAfter), 10))
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.FormatInt(seconds(res.RetryAfter), 10))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// seconds rounds d up to whole seconds, as the rate limit headers require
+func seconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+func prefixed(prefix, key string) string {
+	if prefix == "" {
+		prefix = DefaultPrefix
+	}
+	return prefix + key
+}
+
+func uniqueMember() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"log/slog"
 	"reflect"
 	"time"
 
 	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type RedisDB struct {
@@ -16,15 +18,38 @@ type RedisDB struct {
 
 type RedisStore struct {
 	Conn *redis.Client
+	// Metrics receives measurements of the store's work. Set it using Instrument
+	Metrics Metrics
+	// Tracer creates OpenTelemetry spans for the store's work. Set it using EnableTracing
+	Tracer trace.Tracer
+	// Logger and LogLevels are used to log failures. Set them using EnableLogging
+	Logger    *slog.Logger
+	LogLevels *LogLevels
+	// Breaker stops sending commands while redis is unavailable. Set it using EnableCircuitBreaker
+	Breaker *CircuitBreaker
+	// Retry retries the idempotent commands which failed for a passing reason. nil means no retries
+	Retry *RetryPolicy
+
+	metricsHooked bool
+	tracingHooked bool
+	loggingHooked bool
+	breakerHooked bool
 }
 
 func (rds *RedisStore) SetWithExpiry(key string, value interface{}, expiryDuration int64) (int, error) {
+	return rds.SetWithExpiryContext(context.Background(), key, value, expiryDuration)
+}
+
+// SetWithExpiryContext is SetWithExpiry, carried out within the given context
+func (rds *RedisStore) SetWithExpiryContext(ctx context.Context, key string, value interface{}, expiryDuration int64) (int, error) {
 	p, err := json.Marshal(value)
 	if err != nil {
 		return RedisMarshalUpdateError, err
 	}
 
-	err = rds.Conn.Set(context.Background(), key, p, time.Duration(expiryDuration)*time.Second).Err()
+	err = rds.Retry.Do(ctx, func() error {
+		return rds.Conn.Set(ctx, key, p, time.Duration(expiryDuration)*time.Second).Err()
+	})
 
 	if err == nil {
 		return RedisRecordUpdated, nil
@@ -39,7 +64,10 @@ func (rds *RedisStore) Set(key string, value interface{}) (int, error) {
 		return RedisMarshalUpdateError, err
 	}
 
-	err = rds.Conn.Set(context.Background(), key, p, 0*time.Second).Err()
+	ctx := context.Background()
+	err = rds.Retry.Do(ctx, func() error {
+		return rds.Conn.Set(ctx, key, p, 0*time.Second).Err()
+	})
 
 	if err == nil {
 		return RedisRecordUpdated, nil
@@ -55,9 +83,14 @@ func isPointer(i interface{}) bool {
 // AddToSet fetches a set (or creates it if it does not already exist) identified
 // by the `nameOfSet`. Then it adds the value to it
 func (rds *RedisStore) AddToSet(nameOfSet string, value string) (int, error) {
-	res := rds.Conn.SAdd(context.Background(), nameOfSet, value)
+	return rds.AddToSetContext(context.Background(), nameOfSet, value)
+}
 
-	err := res.Err()
+// AddToSetContext is AddToSet with a context
+func (rds *RedisStore) AddToSetContext(ctx context.Context, nameOfSet string, value string) (int, error) {
+	err := rds.Retry.Do(ctx, func() error {
+		return rds.Conn.SAdd(ctx, nameOfSet, value).Err()
+	})
 	if err != nil {
 		return RedisRecordUpdateError, err
 	} else {
@@ -69,13 +102,20 @@ func (rds *RedisStore) AddToSet(nameOfSet string, value string) (int, error) {
 // RedisRecordFound,nil if found and RedisRecordNotFound,nil If not found.
 // Returns RedisRecordFetchError, err if an error occurred
 func (rds *RedisStore) IsInSet(nameOfSet string, value string) (int, error) {
-	res := rds.Conn.SIsMember(context.Background(), nameOfSet, value)
+	return rds.IsInSetContext(context.Background(), nameOfSet, value)
+}
 
-	err := res.Err()
+// IsInSetContext is IsInSet with a context
+func (rds *RedisStore) IsInSetContext(ctx context.Context, nameOfSet string, value string) (int, error) {
+	var found bool
+	err := rds.Retry.Do(ctx, func() (err error) {
+		found, err = rds.Conn.SIsMember(ctx, nameOfSet, value).Result()
+		return err
+	})
 	if err != nil {
 		return RedisRecordFetchError, err
 	}
-	if res.Val() {
+	if found {
 		return RedisRecordFound, nil
 	} else {
 		return RedisRecordNotFound, nil
@@ -83,12 +123,11 @@ func (rds *RedisStore) IsInSet(nameOfSet string, value string) (int, error) {
 }
 
 // DeleteFromSet Removes an item from the set. If the item does not exist in the set, it returns false and nil
-// If it does, it deletes it and returns true and nil. If an error occurred while doing all this, it returns false and the error
+// If it does, it deletes it and returns true and nil. If an error occurred while doing all this, it returns false and the error.
+// It is not retried, as a retry would report the item removed by the failed attempt as missing
 func (rds *RedisStore) DeleteFromSet(nameOfSet, value string) (bool, error) {
-	res := rds.Conn.SRem(context.Background(), nameOfSet, value)
-
-	err := res.Err()
-	val := res.Val()
+	ctx := context.Background()
+	val, err := rds.Conn.SRem(ctx, nameOfSet, value).Result()
 	if err != nil {
 		return false, err
 	} else {
@@ -104,12 +143,21 @@ func (rds *RedisStore) DeleteFromSet(nameOfSet, value string) (bool, error) {
 // key is the name of the key whose value we wish to retrieve,
 // dest .. is a pointer to the interface that we wish to decode the value into.
 func (rds *RedisStore) Get(key string, dest interface{}) (int, error) {
+	return rds.GetContext(context.Background(), key, dest)
+}
+
+// GetContext is Get, carried out within the given context
+func (rds *RedisStore) GetContext(ctx context.Context, key string, dest interface{}) (int, error) {
 
 	if !isPointer(dest) {
 		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
 	}
 
-	p, err := rds.Conn.Get(context.Background(), key).Result()
+	var p string
+	err := rds.Retry.Do(ctx, func() (err error) {
+		p, err = rds.Conn.Get(ctx, key).Result()
+		return err
+	})
 	if err == redis.Nil {
 		return RedisRecordNotFound, err
 	} else if err != nil {
@@ -126,8 +174,126 @@ func (rds *RedisStore) Get(key string, dest interface{}) (int, error) {
 	}
 }
 
+// ErrConflict is returned when a record could not be updated because it was changed in redis after it was read.
+// Saving it would have overwritten someone else's changes
+var ErrConflict = errors.New("the record was modified concurrently")
+
+// versionedRecord is the layout of values written by SetIfVersion. The version is kept under a reserved field name,
+// so values written by Set are never taken for versioned records, whatever fields they have
+type versionedRecord struct {
+	Version *int64          `json:"webredis:version"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// marshalVersioned wraps the encoded value data in a versioned record
+func marshalVersioned(version int64, data json.RawMessage) ([]byte, error) {
+	return json.Marshal(versionedRecord{Version: &version, Data: data})
+}
+
+// parseVersioned returns the version of the value p, and whether it is a versioned record
+func parseVersioned(p []byte) (int64, json.RawMessage, bool) {
+	var rec versionedRecord
+	if err := json.Unmarshal(p, &rec); err != nil || rec.Version == nil || rec.Data == nil {
+		return 0, nil, false
+	}
+	return *rec.Version, rec.Data, true
+}
+
+// decodeVersioned decodes a value written by SetIfVersion into dest and returns its version.
+// Values written by Set or SetWithExpiry are decoded as they are and have version 0
+func decodeVersioned(p []byte, dest interface{}) (int64, error) {
+	if version, data, ok := parseVersioned(p); ok {
+		return version, json.Unmarshal(data, dest)
+	}
+	return 0, json.Unmarshal(p, dest)
+}
+
+// GetVersioned works like Get, but also returns the version of the record, as written by SetIfVersion.
+// Records that were never written by SetIfVersion have version 0
+func (rds *RedisStore) GetVersioned(key string, dest interface{}) (int, int64, error) {
+	return rds.GetVersionedContext(context.Background(), key, dest)
+}
+
+// GetVersionedContext is GetVersioned, carried out within the given context
+func (rds *RedisStore) GetVersionedContext(ctx context.Context, key string, dest interface{}) (int, int64, error) {
+
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, 0, errors.New("the `dest` parameter can only be a pointer")
+	}
+
+	var p []byte
+	err := rds.Retry.Do(ctx, func() (err error) {
+		p, err = rds.Conn.Get(ctx, key).Bytes()
+		return err
+	})
+	if err == redis.Nil {
+		return RedisRecordNotFound, 0, err
+	} else if err != nil {
+		return RedisRecordFetchError, 0, err
+	}
+	version, err := decodeVersioned(p, dest)
+	if err != nil {
+		return RedisRecordUnmarshalError, 0, err
+	}
+	return RedisRecordFound, version, nil
+}
+
+// SetIfVersion saves the value only if the record in redis still has the given version, i.e. nobody else
+// has updated it since it was read. A record which does not exist has version 0.
+// On success, it returns RedisRecordUpdated and the new version of the record.
+// If the record was changed in the meantime, it returns RedisRecordConflict and ErrConflict.
+// An expiryDuration of 0 means the record never expires
+func (rds *RedisStore) SetIfVersion(key string, value interface{}, version int64, expiryDuration int64) (int, int64, error) {
+	return rds.SetIfVersionContext(context.Background(), key, value, version, expiryDuration)
+}
+
+// SetIfVersionContext is SetIfVersion, carried out within the given context
+func (rds *RedisStore) SetIfVersionContext(ctx context.Context, key string, value interface{}, version int64, expiryDuration int64) (int, int64, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return RedisMarshalUpdateError, 0, err
+	}
+	p, err := marshalVersioned(version+1, data)
+	if err != nil {
+		return RedisMarshalUpdateError, 0, err
+	}
+
+	conflict := false
+	err = rds.Conn.Watch(ctx, func(tx *redis.Tx) error {
+		current := int64(0)
+		cur, err := tx.Get(ctx, key).Bytes()
+		if err == nil {
+			current, _, _ = parseVersioned(cur)
+		} else if err != redis.Nil {
+			return err
+		}
+		if current != version {
+			conflict = true
+			return nil
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, p, time.Duration(expiryDuration)*time.Second)
+			return nil
+		})
+		return err
+	}, key)
+
+	if err == redis.TxFailedErr || (err == nil && conflict) {
+		return RedisRecordConflict, 0, ErrConflict
+	} else if err != nil {
+		return RedisRecordUpdateError, 0, err
+	}
+	return RedisRecordUpdated, version + 1, nil
+}
+
 func (rds *RedisStore) Delete(key string) (int64, error) {
-	return rds.Conn.Pipeline().Del(context.Background(), key).Result()
+	return rds.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete, carried out within the given context.
+// It is not retried, as a retry would report the key removed by the failed attempt as missing
+func (rds *RedisStore) DeleteContext(ctx context.Context, key string) (int64, error) {
+	return rds.Conn.Del(ctx, key).Result()
 }
 
 func (rds *RedisStore) Close() error {
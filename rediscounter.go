@@ -0,0 +1,99 @@
+package webredis
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// incrementScript adds to a counter, and sets its expiry if it has none, i.e. when the increment created it
+var incrementScript = redis.NewScript(`
+local n = redis.call('INCRBY', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 and redis.call('TTL', KEYS[1]) == -1 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return n`)
+
+// Increment adds `by` to the counter stored at key, and returns the result. `by` may be negative.
+// A counter which does not exist starts at 0 and, if expiryDuration is not 0, expires expiryDuration seconds later;
+// later increments do not push its expiry back, so it counts over a fixed window
+func (rds *RedisStore) Increment(key string, by int64, expiryDuration int64) (int64, error) {
+	return rds.IncrementContext(context.Background(), key, by, expiryDuration)
+}
+
+// IncrementContext is Increment, carried out within the given context
+func (rds *RedisStore) IncrementContext(ctx context.Context, key string, by int64, expiryDuration int64) (int64, error) {
+	return incrementScript.Run(ctx, rds.Conn, []string{key}, by, expiryDuration).Int64()
+}
+
+// Counter returns the value of the counter stored at key. Returns RedisRecordNotFound if it does not exist
+func (rds *RedisStore) Counter(key string) (int, int64, error) {
+	return rds.CounterContext(context.Background(), key)
+}
+
+// CounterContext is Counter, carried out within the given context
+func (rds *RedisStore) CounterContext(ctx context.Context, key string) (int, int64, error) {
+	var val string
+	err := rds.Retry.Do(ctx, func() (err error) {
+		val, err = rds.Conn.Get(ctx, key).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return RedisRecordNotFound, 0, err
+	} else if err != nil {
+		return RedisRecordFetchError, 0, err
+	}
+	n, err := strconv.ParseInt(val, 10, 64)
+	if err != nil {
+		return RedisRecordUnmarshalError, 0, err
+	}
+	return RedisRecordFound, n, nil
+}
+
+// SetBit sets the bit at offset of the bitmap stored at key, e.g. the day of the year a user was active,
+// and returns the value it had before. The bitmap is created, and grown, as needed
+func (rds *RedisStore) SetBit(key string, offset int64, value bool) (bool, error) {
+	return rds.SetBitContext(context.Background(), key, offset, value)
+}
+
+// SetBitContext is SetBit, carried out within the given context
+func (rds *RedisStore) SetBitContext(ctx context.Context, key string, offset int64, value bool) (bool, error) {
+	bit := 0
+	if value {
+		bit = 1
+	}
+	// not retried: a retry would answer the bit set by the first attempt
+	previous, err := rds.Conn.SetBit(ctx, key, offset, bit).Result()
+	return previous == 1, err
+}
+
+// GetBit returns the bit at offset of the bitmap stored at key. Bits which were never set are false
+func (rds *RedisStore) GetBit(key string, offset int64) (bool, error) {
+	return rds.GetBitContext(context.Background(), key, offset)
+}
+
+// GetBitContext is GetBit, carried out within the given context
+func (rds *RedisStore) GetBitContext(ctx context.Context, key string, offset int64) (bool, error) {
+	var bit int64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		bit, err = rds.Conn.GetBit(ctx, key, offset).Result()
+		return err
+	})
+	return bit == 1, err
+}
+
+// BitCount returns how many bits of the bitmap stored at key are set
+func (rds *RedisStore) BitCount(key string) (int64, error) {
+	return rds.BitCountContext(context.Background(), key)
+}
+
+// BitCountContext is BitCount, carried out within the given context
+func (rds *RedisStore) BitCountContext(ctx context.Context, key string) (int64, error) {
+	var n int64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		n, err = rds.Conn.BitCount(ctx, key, nil).Result()
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,224 @@
+package webredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// HashVersionField is the field of a hash in which HashSetIfVersion keeps the version of the hash
+const HashVersionField = "_version"
+
+// HashGetVersioned fetches the given fields of the hash stored at key, together with the version of the hash
+// as written by HashSetIfVersion. Fields that do not exist in the hash are left out of the returned map.
+// Returns RedisRecordNotFound if the hash does not exist
+func (rds *RedisStore) HashGetVersioned(key string, fields ...string) (int, int64, map[string]string, error) {
+	return rds.HashGetVersionedContext(context.Background(), key, fields...)
+}
+
+// HashGetVersionedContext is HashGetVersioned, carried out within the given context
+func (rds *RedisStore) HashGetVersionedContext(ctx context.Context, key string, fields ...string) (int, int64, map[string]string, error) {
+	var vals []interface{}
+	err := rds.Retry.Do(ctx, func() (err error) {
+		vals, err = rds.Conn.HMGet(ctx, key, append([]string{HashVersionField}, fields...)...).Result()
+		return err
+	})
+	if err != nil {
+		return RedisRecordFetchError, 0, nil, err
+	}
+	if vals[0] == nil {
+		return RedisRecordNotFound, 0, nil, redis.Nil
+	}
+	version, err := strconv.ParseInt(vals[0].(string), 10, 64)
+	if err != nil {
+		return RedisRecordUnmarshalError, 0, nil, err
+	}
+
+	res := make(map[string]string, len(fields))
+	for i, field := range fields {
+		if val, ok := vals[i+1].(string); ok {
+			res[field] = val
+		}
+	}
+	return RedisRecordFound, version, res, nil
+}
+
+// HashGetField fetches a single field of the hash stored at key.
+// Returns RedisRecordNotFound if the hash or the field does not exist
+func (rds *RedisStore) HashGetField(key string, field string) (int, string, error) {
+	return rds.HashGetFieldContext(context.Background(), key, field)
+}
+
+// HashGetFieldContext is HashGetField, carried out within the given context
+func (rds *RedisStore) HashGetFieldContext(ctx context.Context, key string, field string) (int, string, error) {
+	var val string
+	err := rds.Retry.Do(ctx, func() (err error) {
+		val, err = rds.Conn.HGet(ctx, key, field).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return RedisRecordNotFound, "", err
+	} else if err != nil {
+		return RedisRecordFetchError, "", err
+	}
+	return RedisRecordFound, val, nil
+}
+
+// HashSetIfVersion writes the fields in `set` and removes the fields in `del` from the hash stored at key,
+// only if the hash still has the given version, i.e. nobody else has updated it since it was read.
+// A hash which does not exist has version 0.
+// On success, it returns RedisRecordUpdated and the new version of the hash.
+// If the hash was changed in the meantime, it returns RedisRecordConflict and ErrConflict.
+// An expiryDuration of 0 means the hash never expires
+func (rds *RedisStore) HashSetIfVersion(key string, version int64, set map[string]string, del []string, expiryDuration int64) (int, int64, error) {
+	return rds.HashSetIfVersionContext(context.Background(), key, version, set, del, expiryDuration)
+}
+
+// HashSetIfVersionContext is HashSetIfVersion, carried out within the given context
+func (rds *RedisStore) HashSetIfVersionContext(ctx context.Context, key string, version int64, set map[string]string, del []string, expiryDuration int64) (int, int64, error) {
+	conflict := false
+	err := rds.Conn.Watch(ctx, func(tx *redis.Tx) error {
+		current := int64(0)
+		cur, err := tx.HGet(ctx, key, HashVersionField).Result()
+		if err == nil {
+			current, _ = strconv.ParseInt(cur, 10, 64)
+		} else if err != redis.Nil {
+			return err
+		}
+		if current != version {
+			conflict = true
+			return nil
+		}
+
+		values := make([]interface{}, 0, 2*len(set)+2)
+		for field, val := range set {
+			values = append(values, field, val)
+		}
+		values = append(values, HashVersionField, version+1)
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if len(del) > 0 {
+				pipe.HDel(ctx, key, del...)
+			}
+			pipe.HSet(ctx, key, values...)
+			if expiryDuration > 0 {
+				pipe.Expire(ctx, key, time.Duration(expiryDuration)*time.Second)
+			} else {
+				pipe.Persist(ctx, key)
+			}
+			return nil
+		})
+		return err
+	}, key)
+
+	if err == redis.TxFailedErr || (err == nil && conflict) {
+		return RedisRecordConflict, 0, ErrConflict
+	} else if err != nil {
+		return RedisRecordUpdateError, 0, err
+	}
+	return RedisRecordUpdated, version + 1, nil
+}
+
+// HashSet saves the value, encoded as JSON, in a field of the hash stored at key. The hash is created if it does not exist
+func (rds *RedisStore) HashSet(key string, field string, value interface{}) (int, error) {
+	return rds.HashSetContext(context.Background(), key, field, value)
+}
+
+// HashSetContext is HashSet, carried out within the given context
+func (rds *RedisStore) HashSetContext(ctx context.Context, key string, field string, value interface{}) (int, error) {
+	p, err := json.Marshal(value)
+	if err != nil {
+		return RedisMarshalUpdateError, err
+	}
+	err = rds.Retry.Do(ctx, func() error {
+		return rds.Conn.HSet(ctx, key, field, p).Err()
+	})
+	if err != nil {
+		return RedisRecordUpdateError, err
+	}
+	return RedisRecordUpdated, nil
+}
+
+// HashGet decodes a field of the hash stored at key, as saved by HashSet, into dest, which must be a pointer.
+// Returns RedisRecordNotFound if the hash or the field does not exist
+func (rds *RedisStore) HashGet(key string, field string, dest interface{}) (int, error) {
+	return rds.HashGetContext(context.Background(), key, field, dest)
+}
+
+// HashGetContext is HashGet, carried out within the given context
+func (rds *RedisStore) HashGetContext(ctx context.Context, key string, field string, dest interface{}) (int, error) {
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+	}
+	redisStat, val, err := rds.HashGetFieldContext(ctx, key, field)
+	if err != nil {
+		return redisStat, err
+	}
+	if err := json.Unmarshal([]byte(val), dest); err != nil {
+		return RedisRecordUnmarshalError, err
+	}
+	return RedisRecordFound, nil
+}
+
+// HashGetAll decodes all fields of the hash stored at key, as saved by HashSet, into dest, which must be a pointer
+// to a map or to a struct whose JSON fields are named like the fields of the hash.
+// Returns RedisRecordNotFound if the hash does not exist
+func (rds *RedisStore) HashGetAll(key string, dest interface{}) (int, error) {
+	return rds.HashGetAllContext(context.Background(), key, dest)
+}
+
+// HashGetAllContext is HashGetAll, carried out within the given context
+func (rds *RedisStore) HashGetAllContext(ctx context.Context, key string, dest interface{}) (int, error) {
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+	}
+	var fields map[string]string
+	err := rds.Retry.Do(ctx, func() (err error) {
+		fields, err = rds.Conn.HGetAll(ctx, key).Result()
+		return err
+	})
+	if err != nil {
+		return RedisRecordFetchError, err
+	}
+	if len(fields) == 0 {
+		return RedisRecordNotFound, redis.Nil
+	}
+	obj := make(map[string]json.RawMessage, len(fields))
+	for field, val := range fields {
+		obj[field] = json.RawMessage(val)
+	}
+	p, err := json.Marshal(obj)
+	if err == nil {
+		err = json.Unmarshal(p, dest)
+	}
+	if err != nil {
+		return RedisRecordUnmarshalError, err
+	}
+	return RedisRecordFound, nil
+}
+
+// HashDelete removes fields from the hash stored at key, and returns how many of them existed
+func (rds *RedisStore) HashDelete(key string, fields ...string) (int64, error) {
+	return rds.HashDeleteContext(context.Background(), key, fields...)
+}
+
+// HashDeleteContext is HashDelete, carried out within the given context.
+// It is not retried, as a retry would not count the fields removed by the failed attempt
+func (rds *RedisStore) HashDeleteContext(ctx context.Context, key string, fields ...string) (int64, error) {
+	return rds.Conn.HDel(ctx, key, fields...).Result()
+}
+
+// HashIncrement adds `by` to the integer in a field of the hash stored at key, and returns the result.
+// A field which does not exist counts as 0. The result can be read with HashGet
+func (rds *RedisStore) HashIncrement(key string, field string, by int64) (int64, error) {
+	return rds.HashIncrementContext(context.Background(), key, field, by)
+}
+
+// HashIncrementContext is HashIncrement, carried out within the given context
+func (rds *RedisStore) HashIncrementContext(ctx context.Context, key string, field string, by int64) (int64, error) {
+	return rds.Conn.HIncrBy(ctx, key, field, by).Result()
+}
@@ -0,0 +1,135 @@
+package webredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ListPush appends the values, each encoded as JSON, to the end of the list called `nameOfList`, e.g. to enqueue them.
+// The list is created if it does not exist
+func (rds *RedisStore) ListPush(nameOfList string, values ...interface{}) (int, error) {
+	return rds.ListPushContext(context.Background(), nameOfList, values...)
+}
+
+// ListPushContext is ListPush, carried out within the given context
+func (rds *RedisStore) ListPushContext(ctx context.Context, nameOfList string, values ...interface{}) (int, error) {
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		p, err := json.Marshal(value)
+		if err != nil {
+			return RedisMarshalUpdateError, err
+		}
+		args[i] = p
+	}
+	if err := rds.Conn.RPush(ctx, nameOfList, args...).Err(); err != nil {
+		return RedisRecordUpdateError, err
+	}
+	return RedisRecordUpdated, nil
+}
+
+// ListPop removes the first value of the list and decodes it into dest, which must be a pointer, e.g. to dequeue it.
+// Returns RedisRecordNotFound if the list is empty
+func (rds *RedisStore) ListPop(nameOfList string, dest interface{}) (int, error) {
+	return rds.ListPopContext(context.Background(), nameOfList, dest)
+}
+
+// ListPopContext is ListPop, carried out within the given context
+func (rds *RedisStore) ListPopContext(ctx context.Context, nameOfList string, dest interface{}) (int, error) {
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+	}
+	p, err := rds.Conn.LPop(ctx, nameOfList).Bytes()
+	return decodeListValue(p, err, dest)
+}
+
+// ListPopWait is ListPop, which waits up to timeout for a value when the list is empty.
+// A timeout of 0 waits until a value comes or ctx is done
+func (rds *RedisStore) ListPopWait(ctx context.Context, nameOfList string, timeout time.Duration, dest interface{}) (int, error) {
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+	}
+	vals, err := rds.Conn.BLPop(ctx, timeout, nameOfList).Result()
+	var p []byte
+	if err == nil {
+		// BLPOP answers the name of the list, then the value
+		p = []byte(vals[1])
+	}
+	return decodeListValue(p, err, dest)
+}
+
+func decodeListValue(p []byte, err error, dest interface{}) (int, error) {
+	if err == redis.Nil {
+		return RedisRecordNotFound, err
+	} else if err != nil {
+		return RedisRecordFetchError, err
+	}
+	if err := json.Unmarshal(p, dest); err != nil {
+		return RedisRecordUnmarshalError, err
+	}
+	return RedisRecordFound, nil
+}
+
+// ListRange decodes the values of the list from position `start` to position `stop`, both included, into dest,
+// which must be a pointer to a slice. Negative positions count from the end: 0 and -1 return the whole list
+func (rds *RedisStore) ListRange(nameOfList string, start int64, stop int64, dest interface{}) (int, error) {
+	return rds.ListRangeContext(context.Background(), nameOfList, start, stop, dest)
+}
+
+// ListRangeContext is ListRange, carried out within the given context
+func (rds *RedisStore) ListRangeContext(ctx context.Context, nameOfList string, start int64, stop int64, dest interface{}) (int, error) {
+	if !isPointer(dest) {
+		return RedisInvalidArgsError, errors.New("the `dest` parameter can only be a pointer")
+	}
+	var vals []string
+	err := rds.Retry.Do(ctx, func() (err error) {
+		vals, err = rds.Conn.LRange(ctx, nameOfList, start, stop).Result()
+		return err
+	})
+	if err != nil {
+		return RedisRecordFetchError, err
+	}
+	arr := make([]json.RawMessage, len(vals))
+	for i, val := range vals {
+		arr[i] = json.RawMessage(val)
+	}
+	p, err := json.Marshal(arr)
+	if err == nil {
+		err = json.Unmarshal(p, dest)
+	}
+	if err != nil {
+		return RedisRecordUnmarshalError, err
+	}
+	return RedisRecordFound, nil
+}
+
+// ListLength returns the number of values in the list
+func (rds *RedisStore) ListLength(nameOfList string) (int64, error) {
+	return rds.ListLengthContext(context.Background(), nameOfList)
+}
+
+// ListLengthContext is ListLength, carried out within the given context
+func (rds *RedisStore) ListLengthContext(ctx context.Context, nameOfList string) (int64, error) {
+	var n int64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		n, err = rds.Conn.LLen(ctx, nameOfList).Result()
+		return err
+	})
+	return n, err
+}
+
+// ListTrim keeps only the values of the list from position `start` to position `stop`, both included,
+// e.g. the 100 most recent entries of a log pushed with ListPush, with -100 and -1
+func (rds *RedisStore) ListTrim(nameOfList string, start int64, stop int64) error {
+	return rds.ListTrimContext(context.Background(), nameOfList, start, stop)
+}
+
+// ListTrimContext is ListTrim, carried out within the given context
+func (rds *RedisStore) ListTrimContext(ctx context.Context, nameOfList string, start int64, stop int64) error {
+	return rds.Retry.Do(ctx, func() error {
+		return rds.Conn.LTrim(ctx, nameOfList, start, stop).Err()
+	})
+}
@@ -0,0 +1,198 @@
+package webredis
+
+import (
+	"context"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ScoredMember is a member of a sorted set with its score
+type ScoredMember struct {
+	Member string  `json:"member"`
+	Score  float64 `json:"score"`
+}
+
+func scoredMembers(zs []redis.Z) []ScoredMember {
+	members := make([]ScoredMember, len(zs))
+	for i, z := range zs {
+		member, _ := z.Member.(string)
+		members[i] = ScoredMember{Member: member, Score: z.Score}
+	}
+	return members
+}
+
+// SortedSetAdd adds the member to the sorted set called `nameOfSet` with the given score, or updates its score
+// if it is already there. The set is created if it does not exist
+func (rds *RedisStore) SortedSetAdd(nameOfSet string, member string, score float64) (int, error) {
+	return rds.SortedSetAddContext(context.Background(), nameOfSet, member, score)
+}
+
+// SortedSetAddContext is SortedSetAdd, carried out within the given context
+func (rds *RedisStore) SortedSetAddContext(ctx context.Context, nameOfSet string, member string, score float64) (int, error) {
+	err := rds.Retry.Do(ctx, func() error {
+		return rds.Conn.ZAdd(ctx, nameOfSet, &redis.Z{Score: score, Member: member}).Err()
+	})
+	if err != nil {
+		return RedisRecordUpdateError, err
+	}
+	return RedisRecordUpdated, nil
+}
+
+// SortedSetIncrement adds `by` to the score of the member, e.g. the points of a player on a leaderboard, and returns the new score.
+// A member which is not in the set is added with a score of `by`
+func (rds *RedisStore) SortedSetIncrement(nameOfSet string, member string, by float64) (float64, error) {
+	return rds.SortedSetIncrementContext(context.Background(), nameOfSet, member, by)
+}
+
+// SortedSetIncrementContext is SortedSetIncrement, carried out within the given context
+func (rds *RedisStore) SortedSetIncrementContext(ctx context.Context, nameOfSet string, member string, by float64) (float64, error) {
+	return rds.Conn.ZIncrBy(ctx, nameOfSet, by, member).Result()
+}
+
+// SortedSetScore returns the score of the member. Returns RedisRecordNotFound if it is not in the set
+func (rds *RedisStore) SortedSetScore(nameOfSet string, member string) (int, float64, error) {
+	return rds.SortedSetScoreContext(context.Background(), nameOfSet, member)
+}
+
+// SortedSetScoreContext is SortedSetScore, carried out within the given context
+func (rds *RedisStore) SortedSetScoreContext(ctx context.Context, nameOfSet string, member string) (int, float64, error) {
+	var score float64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		score, err = rds.Conn.ZScore(ctx, nameOfSet, member).Result()
+		return err
+	})
+	if err == redis.Nil {
+		return RedisRecordNotFound, 0, err
+	} else if err != nil {
+		return RedisRecordFetchError, 0, err
+	}
+	return RedisRecordFound, score, nil
+}
+
+// SortedSetRank returns the position of the member in the set, 0 being the lowest score, or the highest if `highestFirst` is set.
+// Returns RedisRecordNotFound if it is not in the set
+func (rds *RedisStore) SortedSetRank(nameOfSet string, member string, highestFirst bool) (int, int64, error) {
+	return rds.SortedSetRankContext(context.Background(), nameOfSet, member, highestFirst)
+}
+
+// SortedSetRankContext is SortedSetRank, carried out within the given context
+func (rds *RedisStore) SortedSetRankContext(ctx context.Context, nameOfSet string, member string, highestFirst bool) (int, int64, error) {
+	var rank int64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		if highestFirst {
+			rank, err = rds.Conn.ZRevRank(ctx, nameOfSet, member).Result()
+		} else {
+			rank, err = rds.Conn.ZRank(ctx, nameOfSet, member).Result()
+		}
+		return err
+	})
+	if err == redis.Nil {
+		return RedisRecordNotFound, 0, err
+	} else if err != nil {
+		return RedisRecordFetchError, 0, err
+	}
+	return RedisRecordFound, rank, nil
+}
+
+// SortedSetRange returns the members from position `start` to position `stop`, both included, lowest score first,
+// or highest first if `highestFirst` is set, e.g. the top 10 of a leaderboard with 0, 9 and true.
+// Negative positions count from the end, -1 being the last member
+func (rds *RedisStore) SortedSetRange(nameOfSet string, start int64, stop int64, highestFirst bool) ([]ScoredMember, error) {
+	return rds.SortedSetRangeContext(context.Background(), nameOfSet, start, stop, highestFirst)
+}
+
+// SortedSetRangeContext is SortedSetRange, carried out within the given context
+func (rds *RedisStore) SortedSetRangeContext(ctx context.Context, nameOfSet string, start int64, stop int64, highestFirst bool) ([]ScoredMember, error) {
+	var zs []redis.Z
+	err := rds.Retry.Do(ctx, func() (err error) {
+		if highestFirst {
+			zs, err = rds.Conn.ZRevRangeWithScores(ctx, nameOfSet, start, stop).Result()
+		} else {
+			zs, err = rds.Conn.ZRangeWithScores(ctx, nameOfSet, start, stop).Result()
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scoredMembers(zs), nil
+}
+
+// SortedSetRangeByScore returns the members whose score is between min and max, both included, lowest score first,
+// e.g. the entries of a time-ordered index scored by their time. It skips `offset` members and returns at most `limit`;
+// a limit of 0 or less returns them all
+func (rds *RedisStore) SortedSetRangeByScore(nameOfSet string, min float64, max float64, offset int64, limit int64) ([]ScoredMember, error) {
+	return rds.SortedSetRangeByScoreContext(context.Background(), nameOfSet, min, max, offset, limit)
+}
+
+// SortedSetRangeByScoreContext is SortedSetRangeByScore, carried out within the given context
+func (rds *RedisStore) SortedSetRangeByScoreContext(ctx context.Context, nameOfSet string, min float64, max float64, offset int64, limit int64) ([]ScoredMember, error) {
+	opt := &redis.ZRangeBy{Min: formatScore(min), Max: formatScore(max), Offset: offset, Count: limit}
+	if limit <= 0 {
+		opt.Count = -1
+	}
+	var zs []redis.Z
+	err := rds.Retry.Do(ctx, func() (err error) {
+		zs, err = rds.Conn.ZRangeByScoreWithScores(ctx, nameOfSet, opt).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return scoredMembers(zs), nil
+}
+
+// SortedSetRemove removes members from the set, and returns how many of them were in it
+func (rds *RedisStore) SortedSetRemove(nameOfSet string, members ...string) (int64, error) {
+	return rds.SortedSetRemoveContext(context.Background(), nameOfSet, members...)
+}
+
+// SortedSetRemoveContext is SortedSetRemove, carried out within the given context.
+// It is not retried, as a retry would not count the members removed by the failed attempt
+func (rds *RedisStore) SortedSetRemoveContext(ctx context.Context, nameOfSet string, members ...string) (int64, error) {
+	args := make([]interface{}, len(members))
+	for i, member := range members {
+		args[i] = member
+	}
+	return rds.Conn.ZRem(ctx, nameOfSet, args...).Result()
+}
+
+// SortedSetRemoveByScore removes the members whose score is between min and max, both included,
+// e.g. the entries of a time-ordered index which are too old, and returns how many were removed
+func (rds *RedisStore) SortedSetRemoveByScore(nameOfSet string, min float64, max float64) (int64, error) {
+	return rds.SortedSetRemoveByScoreContext(context.Background(), nameOfSet, min, max)
+}
+
+// SortedSetRemoveByScoreContext is SortedSetRemoveByScore, carried out within the given context.
+// It is not retried, as a retry would not count the members removed by the failed attempt
+func (rds *RedisStore) SortedSetRemoveByScoreContext(ctx context.Context, nameOfSet string, min float64, max float64) (int64, error) {
+	return rds.Conn.ZRemRangeByScore(ctx, nameOfSet, formatScore(min), formatScore(max)).Result()
+}
+
+// SortedSetLength returns the number of members of the set
+func (rds *RedisStore) SortedSetLength(nameOfSet string) (int64, error) {
+	return rds.SortedSetLengthContext(context.Background(), nameOfSet)
+}
+
+// SortedSetLengthContext is SortedSetLength, carried out within the given context
+func (rds *RedisStore) SortedSetLengthContext(ctx context.Context, nameOfSet string) (int64, error) {
+	var n int64
+	err := rds.Retry.Do(ctx, func() (err error) {
+		n, err = rds.Conn.ZCard(ctx, nameOfSet).Result()
+		return err
+	})
+	return n, err
+}
+
+// formatScore writes a score as redis reads it, infinities included
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "+inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
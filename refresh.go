@@ -0,0 +1,352 @@
+package webredis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gbenroscience/webredis/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultRefreshPrefix is prepended to the keys of the refresh tokens of a RedisTokenStore, unless told otherwise
+const DefaultRefreshPrefix = "webredis:refresh:"
+
+const defaultRefreshTTL = 30 * 24 * time.Hour
+
+// ErrInvalidRefreshToken is returned by Refresh for refresh tokens which do not exist, expired or were revoked
+var ErrInvalidRefreshToken = errors.New("webredis: the refresh token is invalid or expired")
+
+// ErrRefreshTokenReused is returned by Refresh for refresh tokens which were already exchanged.
+// The token must have been copied, so its whole family was revoked
+var ErrRefreshTokenReused = errors.New("webredis: the refresh token was already used; its family was revoked")
+
+// TokenPair is an access token and the refresh token to exchange for the next pair, shaped like an OAuth 2.0 token response
+type TokenPair struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	// ExpiresIn is how long the access token lasts, in seconds
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+func (rts *RedisTokenStore) refreshPrefix() string {
+	if rts.RefreshPrefix == "" {
+		return DefaultRefreshPrefix
+	}
+	return rts.RefreshPrefix
+}
+
+// refreshKey holds the family of a refresh token, when it was used, and the pair it was exchanged for, encrypted.
+// Only a hash of the token is kept
+func (rts *RedisTokenStore) refreshKey(hash string) string {
+	return rts.refreshPrefix() + hash
+}
+
+// familyKey holds the grant of a family
+func (rts *RedisTokenStore) familyKey(family string) string {
+	return rts.refreshPrefix() + "family:" + family
+}
+
+// familyTokensKey holds the tokens of a family which may still be used: "r:" and the hash of the latest refresh token,
+// "a:" and the session ID, i.e. the hash, of each access token
+func (rts *RedisTokenStore) familyTokensKey(family string) string {
+	return rts.refreshPrefix() + "family:" + family + ":tokens"
+}
+
+// linkScript adds a refresh token and an access token to a family, unless the family was revoked
+var linkScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[3], 'family', ARGV[1], 'used', '0')
+redis.call('PEXPIRE', KEYS[3], ARGV[4])
+redis.call('SADD', KEYS[2], 'r:' .. ARGV[2], 'a:' .. ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('PEXPIRE', KEYS[2], ARGV[4])
+return 1`)
+
+// exchangeScript marks a refresh token used.
+// It returns 1 and the family if it was not used yet, 2, the family and the pair it was exchanged for
+// if it was used less than the reuse interval ago, 0 if there is no such token, and -1 and the family if it was used before.
+// The pair is empty if the first exchange has not stored it yet
+var exchangeScript = redis.NewScript(`
+local rec = redis.call('HMGET', KEYS[1], 'family', 'used', 'pair')
+if not rec[1] then
+	return {0, ''}
+end
+if rec[2] and rec[2] ~= '0' then
+	if tonumber(ARGV[2]) > 0 and tonumber(ARGV[1]) - tonumber(rec[2]) <= tonumber(ARGV[2]) then
+		return {2, rec[1], rec[3] or ''}
+	end
+	return {-1, rec[1]}
+end
+redis.call('HSET', KEYS[1], 'used', ARGV[1])
+return {1, rec[1]}`)
+
+// releaseScript marks a refresh token unused again, if it is still marked used at the given time, by the exchange which failed
+var releaseScript = redis.NewScript(`
+if redis.call('HGET', KEYS[1], 'used') == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'used', '0')
+	return 1
+end
+return 0`)
+
+// IssueTokenPair starts a family of tokens for the grant: an access token, as issued by IssueToken, and a refresh token.
+// Exchange the refresh token with Refresh for the next pair of the family, before the access token expires
+func (rts *RedisTokenStore) IssueTokenPair(ctx context.Context, grant TokenGrant) (*TokenPair, error) {
+	if grant.RefreshTTL <= 0 {
+		grant.RefreshTTL = defaultRefreshTTL
+	}
+	family, err := newAPIToken()
+	if err != nil {
+		return nil, err
+	}
+	_, err = rts.RedisClient.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, rts.familyKey(family),
+			"subject", grant.Subject,
+			"scopes", strings.Join(grant.Scopes, " "),
+			"client", grant.ClientID,
+			"ttl", grant.TTL.Milliseconds(),
+			"refresh_ttl", grant.RefreshTTL.Milliseconds())
+		pipe.PExpire(ctx, rts.familyKey(family), grant.RefreshTTL)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rts.issuePair(ctx, family, grant)
+}
+
+// issuePair issues the next pair of tokens of a family
+func (rts *RedisTokenStore) issuePair(ctx context.Context, family string, grant TokenGrant) (*TokenPair, error) {
+	accessToken, access, err := rts.IssueToken(ctx, grant)
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := newAPIToken()
+	if err != nil {
+		return nil, err
+	}
+	hash := hashToken(refresh)
+	linked, err := linkScript.Run(ctx, rts.RedisClient.Conn,
+		[]string{rts.familyKey(family), rts.familyTokensKey(family), rts.refreshKey(hash)},
+		family, hash, access.ID, grant.RefreshTTL.Milliseconds()).Int()
+	if err != nil || linked == 0 {
+		// an access token outside of its family could not be revoked with it
+		rts.RevokeToken(ctx, accessToken)
+		if err == nil {
+			err = ErrRefreshTokenReused
+		}
+		return nil, err
+	}
+	return &TokenPair{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(access.MaxAge),
+		RefreshToken: refresh,
+		Scope:        strings.Join(access.Scopes, " "),
+	}, nil
+}
+
+// Refresh exchanges a refresh token for the next pair of tokens of its family. Each refresh token can be exchanged once:
+// a token presented again must have been copied, so the whole family is revoked, access tokens included,
+// and ErrRefreshTokenReused is returned. Within RefreshReuseInterval of the first exchange, the token gets the pair
+// issued then instead. Tokens which do not exist, expired or were revoked get ErrInvalidRefreshToken
+func (rts *RedisTokenStore) Refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "Refresh", AttrSessionName.String(APITokenName))
+	pair, err := rts.refresh(ctx, refreshToken)
+	if err == ErrInvalidRefreshToken || err == ErrRefreshTokenReused {
+		done(nil)
+	} else {
+		done(err)
+	}
+	return pair, err
+}
+
+func (rts *RedisTokenStore) refresh(ctx context.Context, refreshToken string) (*TokenPair, error) {
+	// not retried: after a lost reply, the token would look used by someone else
+	hash := hashToken(refreshToken)
+	usedAt := time.Now().UnixMilli()
+	res, err := exchangeScript.Run(ctx, rts.RedisClient.Conn, []string{rts.refreshKey(hash)},
+		usedAt, rts.RefreshReuseInterval.Milliseconds()).Slice()
+	if err != nil {
+		return nil, err
+	}
+	status, _ := res[0].(int64)
+	family, _ := res[1].(string)
+	if status == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	fields, err := rts.RedisClient.Conn.HGetAll(ctx, rts.familyKey(family)).Result()
+	if err != nil {
+		if status == 1 {
+			rts.release(ctx, hash, usedAt)
+		}
+		return nil, err
+	}
+	if len(fields) == 0 {
+		return nil, ErrInvalidRefreshToken
+	}
+	grant := TokenGrant{Subject: fields["subject"], Scopes: strings.Fields(fields["scopes"]), ClientID: fields["client"]}
+	if ms, err := strconv.ParseInt(fields["ttl"], 10, 64); err == nil {
+		grant.TTL = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.ParseInt(fields["refresh_ttl"], 10, 64); err == nil {
+		grant.RefreshTTL = time.Duration(ms) * time.Millisecond
+	}
+
+	if status < 0 {
+		rts.logger().LogAttrs(ctx, rts.logLevels().Warning, "webredis: refresh token was used twice; its family was revoked",
+			slog.String("user", grant.Subject), slog.String("client", grant.ClientID))
+		rts.audit(ctx, nil, AuditRefreshReuse, &Session{Name: APITokenName, UserID: grant.Subject}, "", grant.ClientID)
+		if err := rts.revokeFamily(ctx, family); err != nil {
+			return nil, err
+		}
+		return nil, ErrRefreshTokenReused
+	}
+	if status == 2 {
+		// the pair issued by the first exchange, which the client did not get; none is issued for a reuse
+		stored, _ := res[2].(string)
+		if stored == "" {
+			return nil, ErrInvalidRefreshToken
+		}
+		return rts.openPair(stored)
+	}
+
+	pair, err := rts.issuePair(ctx, family, grant)
+	if err != nil {
+		// the client did not get a pair, so the token may be presented again without being taken for stolen
+		rts.release(ctx, hash, usedAt)
+		return nil, err
+	}
+	if err := rts.supersede(ctx, family, hash, pair); err != nil {
+		// the pair was issued all the same; a reuse within RefreshReuseInterval is refused
+		rts.logger().LogAttrs(ctx, rts.logLevels().RedisError, "webredis: exchanged refresh token could not be updated",
+			slog.String("user", grant.Subject), slog.String("client", grant.ClientID), slog.String("cause", err.Error()))
+	}
+	return pair, nil
+}
+
+// release marks the refresh token unused again after its exchange, made at usedAt, failed
+func (rts *RedisTokenStore) release(ctx context.Context, hash string, usedAt int64) {
+	err := releaseScript.Run(context.WithoutCancel(ctx), rts.RedisClient.Conn, []string{rts.refreshKey(hash)}, usedAt).Err()
+	if err != nil {
+		rts.logger().LogAttrs(ctx, rts.logLevels().RedisError, "webredis: refresh token could not be released after a failed exchange",
+			slog.String("cause", err.Error()))
+	}
+}
+
+// supersede records the pair a refresh token was exchanged for, and prunes the family of the tokens which can no longer be used:
+// the exchanged refresh token, and the access tokens which expired
+func (rts *RedisTokenStore) supersede(ctx context.Context, family string, hash string, pair *TokenPair) error {
+	if rts.RefreshReuseInterval > 0 {
+		sealed, err := rts.sealPair(pair)
+		if err != nil {
+			return err
+		}
+		if err := rts.RedisClient.Conn.HSet(ctx, rts.refreshKey(hash), "pair", sealed).Err(); err != nil {
+			return err
+		}
+	}
+
+	members, err := rts.RedisClient.Conn.SMembers(ctx, rts.familyTokensKey(family)).Result()
+	if err != nil {
+		return err
+	}
+	var accessIDs []string
+	for _, member := range members {
+		if id, ok := strings.CutPrefix(member, "a:"); ok {
+			accessIDs = append(accessIDs, id)
+		}
+	}
+	exists := make([]*redis.IntCmd, len(accessIDs))
+	_, err = rts.RedisClient.Conn.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range accessIDs {
+			exists[i] = pipe.Exists(ctx, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	stale := []interface{}{"r:" + hash}
+	for i, id := range accessIDs {
+		if exists[i].Val() == 0 {
+			stale = append(stale, "a:"+id)
+		}
+	}
+	return rts.RedisClient.Conn.SRem(ctx, rts.familyTokensKey(family), stale...).Err()
+}
+
+// sealPair encrypts a pair of tokens, to be kept in redis
+func (rts *RedisTokenStore) sealPair(pair *TokenPair) (string, error) {
+	k, err := utils.NewKryptik(rts.Keys, utils.ModeCBC)
+	if err != nil {
+		return "", err
+	}
+	jsn, err := json.Marshal(pair)
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(string(jsn))
+}
+
+// openPair decrypts a pair of tokens sealed by sealPair
+func (rts *RedisTokenStore) openPair(sealed string) (*TokenPair, error) {
+	k, err := utils.NewKryptik(rts.Keys, utils.ModeCBC)
+	if err != nil {
+		return nil, err
+	}
+	jsn, err := k.Decrypt(sealed)
+	if err != nil {
+		return nil, err
+	}
+	var pair TokenPair
+	err = json.Unmarshal([]byte(jsn), &pair)
+	return &pair, err
+}
+
+// RevokeRefreshToken revokes the family of a refresh token, access tokens included, e.g. when a user signs out of an app
+func (rts *RedisTokenStore) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	family, err := rts.RedisClient.Conn.HGet(ctx, rts.refreshKey(hashToken(refreshToken)), "family").Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return rts.revokeFamily(ctx, family)
+}
+
+// revokeFamily deletes a family and all its tokens
+func (rts *RedisTokenStore) revokeFamily(ctx context.Context, family string) error {
+	// first, so no token is added to the family meanwhile
+	if err := rts.RedisClient.Conn.Del(ctx, rts.familyKey(family)).Err(); err != nil {
+		return err
+	}
+	members, err := rts.RedisClient.Conn.SMembers(ctx, rts.familyTokensKey(family)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{rts.familyTokensKey(family)}
+	var accessIDs []string
+	for _, member := range members {
+		if hash, ok := strings.CutPrefix(member, "r:"); ok {
+			keys = append(keys, rts.refreshKey(hash))
+		} else if id, ok := strings.CutPrefix(member, "a:"); ok {
+			accessIDs = append(accessIDs, id)
+		}
+	}
+	if len(accessIDs) > 0 {
+		if _, err := rts.DeleteMany(ctx, accessIDs); err != nil {
+			return err
+		}
+	}
+	return rts.RedisClient.Conn.Del(ctx, keys...).Err()
+}
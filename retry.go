@@ -0,0 +1,110 @@
+package webredis
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RetryPolicy retries the idempotent commands of a RedisStore which failed for a reason that may go away,
+// such as a dropped connection or a replica still loading its data, so a single blip does not fail the request.
+// Retries wait an exponentially growing delay, with full jitter, and never go past the deadline of the context:
+// when the next wait would end after it, the last error is returned at once.
+// It works on top of the retries of go-redis itself (redis.Options.MaxRetries), which only cover network errors
+type RetryPolicy struct {
+	// MaxAttempts is how many times a command is tried in all, the first one included. Defaults to 3
+	MaxAttempts int
+	// BaseDelay is the longest wait before the first retry. Each retry doubles it. Defaults to 20ms
+	BaseDelay time.Duration
+	// MaxDelay caps the wait between two attempts. Defaults to 1 second
+	MaxDelay time.Duration
+	// Retryable tells if a command which failed with err should be tried again. Defaults to IsRetryable
+	Retryable func(err error) bool
+}
+
+// NewRetryPolicy creates a RetryPolicy trying commands up to maxAttempts times, waiting up to baseDelay before the first retry
+func NewRetryPolicy(maxAttempts int, baseDelay time.Duration) *RetryPolicy {
+	return &RetryPolicy{MaxAttempts: maxAttempts, BaseDelay: baseDelay}
+}
+
+// IsRetryable tells if err may go away by itself, so the command which failed with it is worth sending again:
+// redis could not be reached, or replied that it cannot serve the command for now
+// (LOADING, BUSY, TRYAGAIN, CLUSTERDOWN, MASTERDOWN, READONLY).
+// ErrCircuitOpen is not: the breaker already decided redis is down
+func IsRetryable(err error) bool {
+	if err == nil || err == ErrCircuitOpen || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var replied redis.Error
+	if errors.As(err, &replied) {
+		for _, prefix := range []string{"LOADING ", "BUSY ", "TRYAGAIN ", "CLUSTERDOWN ", "MASTERDOWN ", "READONLY "} {
+			if strings.HasPrefix(replied.Error(), prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	return IsUnavailable(err)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return 3
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return IsRetryable(err)
+	}
+	return p.Retryable(err)
+}
+
+// backoff is the wait before the given retry, the first being 1: a random duration up to BaseDelay*2^(retry-1), capped by MaxDelay
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	base, max := p.BaseDelay, p.MaxDelay
+	if base <= 0 {
+		base = 20 * time.Millisecond
+	}
+	if max <= 0 {
+		max = time.Second
+	}
+	d := base
+	for i := 1; i < retry && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// Do calls fn until it succeeds, fails with an error which is not retryable, or the attempts run out,
+// and returns its last error. It gives up early when ctx is done or its deadline would pass during the next wait.
+// A nil RetryPolicy calls fn once
+func (p *RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	err := fn()
+	if p == nil {
+		return err
+	}
+	for retry := 1; retry < p.maxAttempts() && err != nil && p.retryable(err); retry++ {
+		wait := p.backoff(retry)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		err = fn()
+	}
+	return err
+}
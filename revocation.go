@@ -0,0 +1,256 @@
+package webredis
+
+import (
+	"context"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultRevocationPrefix is prepended to the keys of a RevocationList, unless told otherwise
+const DefaultRevocationPrefix = "webredis:revoked:"
+
+// DefaultRevocationChannel is the pub/sub channel on which a RevocationList tells every instance about new revocations
+const DefaultRevocationChannel = "webredis:revoked"
+
+const (
+	defaultFilterSize = 100000
+	// revocationBucket is the span of the sets revocations are kept in. A revocation is added to the set of every day
+	// its token may still be presented on, and each set expires with its day
+	revocationBucket = 24 * time.Hour
+)
+
+// RevocationList is a set of revoked token IDs, e.g. the jti of JWTs, kept in redis sets by AddToSet and IsInSet.
+// While it is subscribed to an EventBus, it keeps a bloom filter of the revoked IDs in memory, so checking a token
+// which was not revoked, the usual case, does not reach redis. Without a bus, every check reaches redis.
+// The zero value is not usable: create it with NewRevocationList
+type RevocationList struct {
+	Store *RedisStore
+	// Prefix is prepended to the keys of the list in redis. Defaults to DefaultRevocationPrefix
+	Prefix string
+	// Channel is the pub/sub channel of the revocations. Defaults to DefaultRevocationChannel
+	Channel string
+	// TTL is how long an ID stays revoked: the lifetime of the tokens
+	TTL time.Duration
+	// FilterSize is how many revocations the bloom filter holds with 1% of false positives, which are checked in redis.
+	// Defaults to 100000
+	FilterSize int
+
+	mu         sync.Mutex
+	subscribed bool
+	filter     *bloomFilter
+	loadedAt   time.Time
+	// next is the filter being loaded, which gets the revocations received meanwhile too
+	next *bloomFilter
+}
+
+// NewRevocationList creates a RevocationList keeping IDs revoked for ttl, the lifetime of the tokens
+func NewRevocationList(store *RedisStore, ttl time.Duration) *RevocationList {
+	return &RevocationList{Store: store, TTL: ttl}
+}
+
+func (rl *RevocationList) prefix() string {
+	if rl.Prefix == "" {
+		return DefaultRevocationPrefix
+	}
+	return rl.Prefix
+}
+
+func (rl *RevocationList) topic() *Topic[string] {
+	channel := rl.Channel
+	if channel == "" {
+		channel = DefaultRevocationChannel
+	}
+	t := NewTopic[string](rl.Store, channel)
+	t.Codec = StringCodec{}
+	return t
+}
+
+func (rl *RevocationList) filterSize() int {
+	if rl.FilterSize <= 0 {
+		return defaultFilterSize
+	}
+	return rl.FilterSize
+}
+
+// bucket returns the set holding the IDs revoked at t, and when it expires
+func (rl *RevocationList) bucket(t time.Time) (string, time.Time) {
+	day := t.Unix() / int64(revocationBucket/time.Second)
+	return rl.prefix() + strconv.FormatInt(day, 10), time.Unix((day+1)*int64(revocationBucket/time.Second), 0)
+}
+
+// buckets returns the sets of the days from now until TTL from now
+func (rl *RevocationList) buckets() ([]string, []time.Time) {
+	var keys []string
+	var expiries []time.Time
+	now := time.Now()
+	for t := now; ; t = t.Add(revocationBucket) {
+		key, expires := rl.bucket(t)
+		keys, expiries = append(keys, key), append(expiries, expires)
+		if !expires.Before(now.Add(rl.TTL)) {
+			return keys, expiries
+		}
+	}
+}
+
+// Revoke revokes the IDs for TTL, and tells every instance
+func (rl *RevocationList) Revoke(ctx context.Context, ids ...string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	keys, expiries := rl.buckets()
+	for i, key := range keys {
+		for _, id := range ids {
+			if _, err := rl.Store.AddToSetContext(ctx, key, id); err != nil {
+				return err
+			}
+		}
+		if err := rl.Store.Conn.ExpireAt(ctx, key, expiries[i]).Err(); err != nil {
+			return err
+		}
+	}
+	rl.add(ids...)
+	return rl.topic().Publish(ctx, ids...)
+}
+
+// IsRevoked tells if the ID of a token which expires at expiresAt was revoked
+func (rl *RevocationList) IsRevoked(ctx context.Context, id string, expiresAt time.Time) (bool, error) {
+	rl.mu.Lock()
+	unknown := rl.filter != nil && !rl.filter.mayContain(id)
+	// the filter fills up with the IDs of expired tokens, so it is loaded again every day
+	var next *bloomFilter
+	if rl.filter != nil && rl.next == nil && time.Since(rl.loadedAt) > revocationBucket {
+		next = rl.startLoad()
+	}
+	rl.mu.Unlock()
+	if next != nil {
+		go rl.load(context.WithoutCancel(ctx), next)
+	}
+	if unknown {
+		return false, nil
+	}
+	// the token may be presented until it expires, so its revocation is in the set of that day
+	if expiresAt.Before(time.Now()) {
+		expiresAt = time.Now()
+	}
+	key, _ := rl.bucket(expiresAt)
+	redisStat, err := rl.Store.IsInSetContext(ctx, key, id)
+	return redisStat == RedisRecordFound, err
+}
+
+func (rl *RevocationList) add(ids ...string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for _, id := range ids {
+		if rl.filter != nil {
+			rl.filter.add(id)
+		}
+		if rl.next != nil {
+			rl.next.add(id)
+		}
+	}
+}
+
+// Subscribe has bus hand the revocations of every instance to the list, which keeps its bloom filter up to date with them.
+// The filter is loaded from redis whenever the bus subscribes, and is not used while the bus may miss revocations
+func (rl *RevocationList) Subscribe(bus *EventBus) {
+	bus.OnStatus(func(ctx context.Context, status BusStatus) {
+		rl.mu.Lock()
+		rl.filter, rl.subscribed = nil, status != BusDisconnected
+		var next *bloomFilter
+		if rl.subscribed {
+			next = rl.startLoad()
+		}
+		rl.mu.Unlock()
+		if next != nil {
+			go rl.load(context.WithoutCancel(ctx), next)
+		}
+	})
+	rl.topic().Subscribe(bus, func(ctx context.Context, id string) {
+		rl.add(id)
+	})
+}
+
+// startLoad makes the filter to be filled by load, so no other load starts meanwhile. rl.mu must be held
+func (rl *RevocationList) startLoad() *bloomFilter {
+	rl.next = newBloomFilter(rl.filterSize())
+	return rl.next
+}
+
+// load fills next, made by startLoad, with the IDs revoked in redis, and uses it once it is full
+func (rl *RevocationList) load(ctx context.Context, next *bloomFilter) {
+	defer func() {
+		rl.mu.Lock()
+		defer rl.mu.Unlock()
+		if rl.next == next {
+			rl.next = nil
+		}
+	}()
+
+	keys, _ := rl.buckets()
+	for _, key := range keys {
+		ids, err := rl.Store.Conn.SMembers(ctx, key).Result()
+		if err != nil {
+			rl.Store.LoggerOrNop().LogAttrs(ctx, rl.Store.LogLevelsOrDefault().RedisError, "webredis: revocations could not be loaded; checking them in redis",
+				slog.String("cause", err.Error()))
+			return
+		}
+		// the revocations received meanwhile are added to next too, under the lock
+		rl.mu.Lock()
+		for _, id := range ids {
+			next.add(id)
+		}
+		rl.mu.Unlock()
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	// unless a newer load started, or revocations may have been missed, meanwhile
+	if rl.next == next && rl.subscribed {
+		rl.filter, rl.loadedAt = next, time.Now()
+	}
+}
+
+// bloomFilter tells if an ID may have been added to it, or was not for sure
+type bloomFilter struct {
+	bits []uint64
+	k    uint64
+}
+
+// newBloomFilter makes a filter holding n IDs with 1% of false positives
+func newBloomFilter(n int) *bloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(0.01) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Round(float64(m) / float64(n) * math.Ln2))
+	return &bloomFilter{bits: make([]uint64, (m+63)/64), k: max(k, 1)}
+}
+
+// positions derives the k bits of id from two hashes, as in Kirsch and Mitzenmacher
+func (f *bloomFilter) positions(id string, fn func(bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	m := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < f.k; i++ {
+		fn((h1 + i*h2) % m)
+	}
+}
+
+func (f *bloomFilter) add(id string) {
+	f.positions(id, func(bit uint64) {
+		f.bits[bit/64] |= 1 << (bit % 64)
+	})
+}
+
+func (f *bloomFilter) mayContain(id string) bool {
+	found := true
+	f.positions(id, func(bit uint64) {
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			found = false
+		}
+	})
+	return found
+}
@@ -0,0 +1,126 @@
+package webredis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// serveMembers answers every SMEMBERS on a local listener with members, and every other command with an error
+func serveMembers(t *testing.T, members []string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	var reply strings.Builder
+	fmt.Fprintf(&reply, "*%d\r\n", len(members))
+	for _, m := range members {
+		fmt.Fprintf(&reply, "$%d\r\n%s\r\n", len(m), m)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(r)
+					if err != nil {
+						return
+					}
+					if strings.EqualFold(args[0], "smembers") {
+						conn.Write([]byte(reply.String()))
+					} else {
+						conn.Write([]byte("-ERR unknown command\r\n"))
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// readCommand reads a command sent as an array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return args, nil
+}
+
+// TestRevocationLoadKeepsConcurrentRevocations is meant to run with -race
+func TestRevocationLoadKeepsConcurrentRevocations(t *testing.T) {
+	loaded := make([]string, 5000)
+	for i := range loaded {
+		loaded[i] = JWTID("loaded" + strconv.Itoa(i))
+	}
+	conn := redis.NewClient(&redis.Options{Addr: serveMembers(t, loaded)})
+	defer conn.Close()
+	rl := NewRevocationList(&RedisStore{Conn: conn}, 72*time.Hour)
+	rl.subscribed = true
+
+	rl.mu.Lock()
+	next := rl.startLoad()
+	rl.mu.Unlock()
+
+	// revocations keep arriving until the load is over
+	var received []string
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			id := JWTID("received" + strconv.Itoa(i))
+			rl.add(id)
+			received = append(received, id)
+		}
+	}()
+	rl.load(context.Background(), next)
+	close(done)
+	wg.Wait()
+
+	if rl.filter != next {
+		t.Fatal("the loaded filter is not used")
+	}
+	for _, id := range append(loaded, received...) {
+		if !rl.filter.mayContain(id) {
+			t.Fatalf("the filter lost %s", id)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package sessions
+
+import (
+	"context"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+// GetMany loads the sessions saved under ids in a single round trip, e.g. for an admin screen.
+// The session at each index is nil unless the result at the same index is webredis.RedisRecordFound.
+// Loading sessions this way is not an access: it fires no hooks, does not touch the Index and bypasses the Cache
+func (rss *RedisSessionStore) GetMany(ctx context.Context, ids []string) ([]*Session, []webredis.BatchResult, error) {
+	ctx, done := rss.RedisClient.StartOperation(ctx, storeName, "GetMany", webredis.AttrBackend.String(rss.Layout.String()))
+	sessions := make([]*Session, len(ids))
+	var res []webredis.BatchResult
+	var err error
+	if rss.Layout == LayoutHash {
+		var fields []map[string]string
+		fields, res, err = rss.RedisClient.HashGetManyVersioned(ctx, ids, metaField)
+		for i := range res {
+			if res[i].Status == webredis.RedisRecordFound {
+				sessions[i], res[i].Err = rss.fromHash(ctx, ids[i], fields[i][metaField], res[i].Version)
+			}
+		}
+	} else {
+		texts := make([]string, len(ids))
+		dests := make([]interface{}, len(ids))
+		for i := range texts {
+			dests[i] = &texts[i]
+		}
+		res, err = rss.RedisClient.GetMany(ctx, ids, dests)
+		for i := range res {
+			if res[i].Status == webredis.RedisRecordFound {
+				sessions[i], res[i].Err = rss.fromStored(ctx, texts[i], res[i].Version)
+			}
+		}
+	}
+	for i := range res {
+		if res[i].Status == webredis.RedisRecordFound && res[i].Err != nil {
+			sessions[i], res[i].Status = nil, webredis.RedisRecordUnmarshalError
+		}
+	}
+	done(err)
+	return sessions, res, err
+}
+
+// DeleteMany deletes the sessions saved under ids in a single round trip, e.g. to revoke all sessions of a user.
+// The result of a session which was deleted is webredis.RedisRecordFound. Each deleted session is recorded as revoked
+// in the Audit log and fires SessionDestroyed; their name and user are only known if the store has an Index
+func (rss *RedisSessionStore) DeleteMany(ctx context.Context, ids []string) ([]webredis.BatchResult, error) {
+	ctx, done := rss.RedisClient.StartOperation(ctx, storeName, "DeleteMany")
+	res, err := rss.RedisClient.DeleteMany(ctx, ids)
+	if err == nil {
+		rss.invalidateMany(ctx, ids)
+		removed := make(map[string]webredis.SessionInfo)
+		if rss.Index != nil {
+			infos, err := rss.Index.RemoveMany(ctx, ids)
+			for _, info := range infos {
+				removed[info.ID] = info
+			}
+			if err != nil {
+				webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, "", ids[0], err)
+			}
+		}
+		var deleted []*Session
+		for _, r := range res {
+			if r.Status == webredis.RedisRecordFound {
+				info := removed[r.Key]
+				s := &Session{ID: r.Key, Name: info.Name, UserID: info.UserID}
+				rss.audit(ctx, nil, webredis.AuditRevoked, s, "", "")
+				rss.fire(ctx, webredis.SessionDestroyed, s, "")
+				deleted = append(deleted, s)
+			}
+		}
+		rss.notify(ctx, webredis.SessionDestroyed, "", deleted...)
+	}
+	done(err)
+	return res, err
+}
+
+// TouchMany renews the sessions in redis for another Options.MaxAge, in as many round trips as there are distinct MaxAges,
+// and records the access in the Index. The result of a session which no longer exists is webredis.RedisRecordNotFound
+func (rss *RedisSessionStore) TouchMany(ctx context.Context, sessions []*Session) ([]webredis.BatchResult, error) {
+	ctx, done := rss.RedisClient.StartOperation(ctx, storeName, "TouchMany")
+	byAge := make(map[int][]int)
+	for i, s := range sessions {
+		byAge[s.Options.MaxAge] = append(byAge[s.Options.MaxAge], i)
+	}
+	res := make([]webredis.BatchResult, len(sessions))
+	var err error
+	for age, indexes := range byAge {
+		ids := make([]string, len(indexes))
+		for j, i := range indexes {
+			ids[j] = sessions[i].ID
+		}
+		var touched []webredis.BatchResult
+		touched, err = rss.RedisClient.TouchMany(ctx, ids, int64(age))
+		for j, i := range indexes {
+			res[i] = touched[j]
+		}
+		if err != nil {
+			break
+		}
+	}
+	for i, s := range sessions {
+		if res[i].Status == 0 {
+			// left out after a group failed as a whole
+			res[i] = webredis.BatchResult{Key: s.ID, Status: webredis.RedisRecordUpdateError, Err: err}
+		}
+	}
+
+	var infos []webredis.SessionInfo
+	for i, s := range sessions {
+		if res[i].Status == webredis.RedisRecordUpdated {
+			infos = append(infos, s.info())
+		}
+	}
+	rss.touchMany(ctx, infos)
+	done(err)
+	return res, err
+}
+
+// SaveMany saves the sessions in a single round trip, e.g. from a bulk job. No cookie is set.
+// Sessions which were saved by someone else since they were loaded are not merged with OnConflict:
+// their result is webredis.RedisRecordConflict, and they can be loaded, changed and saved again one by one.
+// The result of each saved session is webredis.RedisRecordUpdated, and its Version is updated
+func (rss *RedisSessionStore) SaveMany(ctx context.Context, sessions []*Session) ([]webredis.BatchResult, error) {
+	ctx, done := rss.RedisClient.StartOperation(ctx, storeName, "SaveMany", webredis.AttrBackend.String(rss.Layout.String()))
+	res := make([]webredis.BatchResult, len(sessions))
+	created := make([]bool, len(sessions))
+	var indexes []int
+	var stringWrites []webredis.VersionedWrite
+	var hashWrites []webredis.HashWrite
+	for i, s := range sessions {
+		res[i].Key = s.ID
+		created[i] = s.IsNew
+		if s.Degraded {
+			if err := rss.restoreVersion(ctx, s); err != nil {
+				res[i].Status, res[i].Err = webredis.RedisRecordUpdateError, err
+				continue
+			}
+		}
+		var err error
+		if rss.Layout == LayoutHash {
+			var wr webredis.HashWrite
+			if wr, err = rss.hashWrite(s); err == nil {
+				hashWrites = append(hashWrites, wr)
+			}
+		} else {
+			var tkn string
+			if tkn, err = rss.token(s); err == nil {
+				stringWrites = append(stringWrites, webredis.VersionedWrite{Key: s.ID, Value: tkn, Version: s.Version, ExpiryDuration: int64(s.Options.MaxAge)})
+			}
+		}
+		if err != nil {
+			res[i].Status, res[i].Err = webredis.RedisMarshalUpdateError, err
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+
+	var written []webredis.BatchResult
+	var err error
+	if rss.Layout == LayoutHash {
+		written, err = rss.RedisClient.HashSetManyIfVersion(ctx, hashWrites)
+	} else {
+		written, err = rss.RedisClient.SetManyIfVersion(ctx, stringWrites)
+	}
+
+	var changed []string
+	var infos []webredis.SessionInfo
+	for j, i := range indexes {
+		res[i] = written[j]
+		s := sessions[i]
+		if res[i].Status != webredis.RedisRecordUpdated {
+			webredis.LogSave(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, res[i].Err)
+			continue
+		}
+		if rss.Layout == LayoutHash {
+			rss.RedisClient.ObservePayload(ctx, storeName, "save", hashWriteSize(hashWrites[j]))
+		} else {
+			rss.RedisClient.ObservePayload(ctx, storeName, "save", len(stringWrites[j].Value.(string)))
+		}
+		if !created[i] {
+			changed = append(changed, s.ID)
+		}
+		s.Version, s.Degraded, s.IsNew = res[i].Version, false, false
+		s.dirty, s.deleted = nil, nil
+		infos = append(infos, s.info())
+	}
+	rss.invalidateMany(ctx, changed)
+	rss.touchMany(ctx, infos)
+	for _, i := range indexes {
+		if res[i].Status == webredis.RedisRecordUpdated {
+			if created[i] {
+				rss.audit(ctx, nil, webredis.AuditCreated, sessions[i], "", "")
+			}
+			rss.fire(ctx, webredis.SessionSaved, sessions[i], "")
+		}
+	}
+	done(err)
+	return res, err
+}
+
+// info describes the session as it is recorded in the Index
+func (s *Session) info() webredis.SessionInfo {
+	return webredis.SessionInfo{
+		ID:        s.ID,
+		Name:      s.Name,
+		UserID:    s.UserID,
+		CreatedAt: time.Unix(s.CreatedAt, 0),
+		TTL:       time.Duration(s.Options.MaxAge) * time.Second,
+	}
+}
+
+// touchMany records the access to the sessions in the Index, if there is one
+func (rss *RedisSessionStore) touchMany(ctx context.Context, infos []webredis.SessionInfo) {
+	if rss.Index == nil || len(infos) == 0 {
+		return
+	}
+	err := rss.Index.TouchMany(ctx, infos)
+	webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, infos[0].Name, infos[0].ID, err)
+}
+
+// invalidateMany drops the sessions from the Cache of every instance, if there is one
+func (rss *RedisSessionStore) invalidateMany(ctx context.Context, ids []string) {
+	if rss.Cache == nil || len(ids) == 0 {
+		return
+	}
+	err := rss.Cache.Invalidate(ctx, rss.RedisClient, ids...)
+	webredis.LogInvalidation(ctx, rss.logger(), rss.logLevels(), storeName, "", ids[0], err)
+}
@@ -0,0 +1,181 @@
+package sessions
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+// DefaultInvalidationChannel is the redis pub/sub channel on which the stores of all instances
+// tell each other which sessions changed
+const DefaultInvalidationChannel = "webredis:invalidate:session"
+
+// LocalCache keeps the sessions most recently loaded by a RedisSessionStore in memory, decrypted,
+// so requests which come often for the same session (e.g. polling) are served without a round trip to redis.
+//
+// Whenever a store saves, regenerates or deletes a session, it tells the stores of all instances
+// through redis pub/sub, and they drop their copy. Sessions are only served from the cache while Listen
+// is subscribed: when the subscription is lost, the cache is emptied and bypassed until it is back.
+// A session may still be served for up to TTL after it expired in redis
+type LocalCache struct {
+	// Size is the most sessions kept. The least recently used are dropped first
+	Size int
+	// TTL is how long a session is served from the cache before it is loaded from redis again
+	TTL time.Duration
+	// Channel is the pub/sub channel of the invalidations. Defaults to DefaultInvalidationChannel
+	Channel string
+
+	instance string
+
+	mu        sync.Mutex
+	lru       *list.List
+	entries   map[string]*list.Element
+	listening bool
+	// seq counts the invalidations, so sessions loaded while one of them was invalidated are not cached
+	seq uint64
+}
+
+type cacheEntry struct {
+	session *Session
+	expires time.Time
+}
+
+// NewLocalCache creates a LocalCache keeping up to size sessions for ttl
+func NewLocalCache(size int, ttl time.Duration) *LocalCache {
+	return &LocalCache{
+		Size:     size,
+		TTL:      ttl,
+		instance: webredis.NewSessionID(),
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *LocalCache) channel() string {
+	if c.Channel == "" {
+		return DefaultInvalidationChannel
+	}
+	return c.Channel
+}
+
+// get returns a copy of the cached session, and the invalidation count to pass to add if there is none
+func (c *LocalCache) get(id string) (*Session, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.listening {
+		return nil, c.seq
+	}
+	el, ok := c.entries[id]
+	if !ok {
+		return nil, c.seq
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+		return nil, c.seq
+	}
+	c.lru.MoveToFront(el)
+	return entry.session.clone(), c.seq
+}
+
+// add caches a copy of the session, unless something was invalidated since seq was returned by get
+func (c *LocalCache) add(s *Session, seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.listening || c.seq != seq || c.Size <= 0 {
+		return
+	}
+	entry := &cacheEntry{session: s.clone(), expires: time.Now().Add(c.TTL)}
+	if el, ok := c.entries[s.ID]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[s.ID] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).session.ID)
+	}
+}
+
+// remove drops the session from the cache
+func (c *LocalCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	if el, ok := c.entries[id]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+// reset empties the cache, and sets whether it may serve sessions
+func (c *LocalCache) reset(listening bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq++
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.listening = listening
+}
+
+// topic carries the invalidations, as "instance id" messages
+func (c *LocalCache) topic(rds *webredis.RedisStore) *webredis.Topic[string] {
+	t := webredis.NewTopic[string](rds, c.channel())
+	t.Codec = webredis.StringCodec{}
+	return t
+}
+
+// Invalidate drops the sessions from the cache of this instance, and tells the other instances to drop them too.
+// The stores do so for the sessions they change: call it for sessions deleted from redis without going through a store
+func (c *LocalCache) Invalidate(ctx context.Context, rds *webredis.RedisStore, ids ...string) error {
+	msgs := make([]string, len(ids))
+	for i, id := range ids {
+		c.remove(id)
+		msgs[i] = c.instance + " " + id
+	}
+	return c.topic(rds).Publish(ctx, msgs...)
+}
+
+// Subscribe has bus hand the invalidations sent by the stores of all instances to the cache, e.g. to share a bus with
+// other subscribers. The cache serves nothing until the bus runs, and is emptied whenever the bus may have missed invalidations
+func (c *LocalCache) Subscribe(bus *webredis.EventBus) {
+	bus.OnStatus(func(ctx context.Context, status webredis.BusStatus) {
+		c.reset(status != webredis.BusDisconnected)
+	})
+	c.topic(bus.Store).Subscribe(bus, func(ctx context.Context, msg string) {
+		instance, id, ok := strings.Cut(msg, " ")
+		if ok && instance != c.instance {
+			c.remove(id)
+		}
+	})
+}
+
+// Listen subscribes to the invalidations sent by the stores of all instances, until ctx is done.
+// Run it on its own goroutine: the cache serves nothing until it is subscribed
+func (c *LocalCache) Listen(ctx context.Context, rds *webredis.RedisStore) error {
+	bus := webredis.NewEventBus(rds)
+	c.Subscribe(bus)
+	return bus.Run(ctx)
+}
+
+// clone copies the session, so the copy in the cache is not changed by the caller
+func (s *Session) clone() *Session {
+	cp := *s
+	cp.Values = make(map[string]interface{}, len(s.Values))
+	for key, val := range s.Values {
+		cp.Values[key] = val
+	}
+	if s.Options != nil {
+		opts := *s.Options
+		cp.Options = &opts
+	}
+	cp.dirty, cp.deleted, cp.fetched, cp.ctx = nil, nil, nil, nil
+	return &cp
+}
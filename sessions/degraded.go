@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+// loadStateless decodes a session kept in the cookie while redis is unavailable
+func (rss *RedisSessionStore) loadStateless(value string) (*Session, int, error) {
+	redisStat, tkn, err := rss.RedisClient.OpenStateless(rss.Keys, value)
+	if err != nil {
+		return nil, redisStat, err
+	}
+	s, err := rss.fromToken(tkn)
+	if err != nil {
+		return nil, webredis.RedisRecordUnmarshalError, err
+	}
+	if s.Values == nil {
+		s.Values = make(map[string]interface{})
+	}
+	s.IsNew = false
+	s.Degraded = true
+	return s, webredis.RedisRecordFound, nil
+}
+
+// saveStateless sends the whole session in the cookie, as redis is unavailable
+func (rss *RedisSessionStore) saveStateless(s *Session, w http.ResponseWriter) error {
+	tkn, err := rss.token(s)
+	if err != nil {
+		return err
+	}
+	value, err := webredis.SealStateless(rss.Keys, tkn, time.Duration(s.Options.MaxAge)*time.Second)
+	if err != nil {
+		return err
+	}
+	s.Degraded = true
+	http.SetCookie(w, NewCookie(s.Name, value, s.Options))
+	return nil
+}
+
+// restoreVersion prepares a session kept without redis to be saved in redis again, over its copy in redis.
+// A session which is no longer in redis, e.g. because it was deleted meanwhile, is not brought back: webredis.ErrConflict is returned.
+// Sessions created while redis was unavailable have no copy, and are saved as new
+func (rss *RedisSessionStore) restoreVersion(ctx context.Context, s *Session) error {
+	var redisStat int
+	var err error
+	if rss.Layout == LayoutHash {
+		redisStat, s.Version, _, err = rss.RedisClient.HashGetVersionedContext(ctx, s.ID)
+	} else {
+		var stored json.RawMessage
+		redisStat, s.Version, err = rss.RedisClient.GetVersionedContext(ctx, s.ID, &stored)
+	}
+	if redisStat == webredis.RedisRecordFetchError {
+		return err
+	}
+	if redisStat == webredis.RedisRecordNotFound && !s.IsNew {
+		return webredis.ErrConflict
+	}
+	if rss.Layout != LayoutHash {
+		return nil
+	}
+
+	if redisStat == webredis.RedisRecordFound {
+		// the values deleted while the session was kept in the cookie are deleted from redis too
+		fields, err := rss.RedisClient.Conn.HKeys(ctx, s.ID).Result()
+		if err != nil {
+			return err
+		}
+		for _, field := range fields {
+			key := strings.TrimPrefix(field, valuePrefix)
+			if _, ok := s.Values[key]; !ok && strings.HasPrefix(field, valuePrefix) {
+				s.DeleteAny(key)
+			}
+		}
+	}
+	// all its values are written, as none of them may be in redis
+	for key, val := range s.Values {
+		s.set(key, val)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package sessions
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+// ExportSessions writes all sessions of the store to w, still encrypted and with the time they expire,
+// e.g. to move them to another redis server with ImportSessions
+func (rss *RedisSessionStore) ExportSessions(ctx context.Context, w io.Writer) error {
+	_, err := rss.ExportSessionsFrom(ctx, w, 0)
+	return err
+}
+
+// ExportSessionsFrom resumes an export which was interrupted, from the cursor returned by the failed export
+// or by webredis.ResumeCursor. It returns the cursor reached, which is 0 once the export is complete
+func (rss *RedisSessionStore) ExportSessionsFrom(ctx context.Context, w io.Writer, cursor uint64) (uint64, error) {
+	return rss.RedisClient.ExportSessionRecords(ctx, w, webredis.ExportOptions{
+		Store:  storeName,
+		Cursor: cursor,
+		Accept: rss.owns,
+	})
+}
+
+// ImportSessions restores the sessions written by ExportSessions. Sessions which already exist are kept.
+// It returns how many sessions were imported
+func (rss *RedisSessionStore) ImportSessions(ctx context.Context, r io.Reader) (int, error) {
+	imported, _, err := rss.RedisClient.ImportSessionRecords(ctx, r, webredis.ImportOptions{
+		Accept: rss.owns,
+		Imported: func(ctx context.Context, rec *webredis.SessionRecord) {
+			if rss.Index == nil {
+				return
+			}
+			s, err := rss.fromToken(rec.EncryptedMeta())
+			if err != nil {
+				return
+			}
+			err = rss.Index.Touch(ctx, s.ID, s.Name, s.UserID, time.Unix(s.CreatedAt, 0), rec.TTL)
+			webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, err)
+		},
+	})
+	return imported, err
+}
+
+// owns tells if the record is a session which this store can decrypt
+func (rss *RedisSessionStore) owns(rec *webredis.SessionRecord) bool {
+	_, err := rss.fromToken(rec.EncryptedMeta())
+	return err == nil
+}
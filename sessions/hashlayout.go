@@ -0,0 +1,225 @@
+package sessions
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/gbenroscience/webredis/utils"
+	"github.com/go-redis/redis/v8"
+)
+
+// Layout is how a RedisSessionStore lays out its sessions in redis
+type Layout int
+
+const (
+	// LayoutString saves each session as a single encrypted string, rewritten in full on every Save
+	LayoutString Layout = iota
+	// LayoutHash saves each session as a redis hash. Every value of the session is encrypted on its own and
+	// kept in its own field, so Save only writes the values which were stored or deleted since the session was loaded,
+	// and values are only fetched from redis the first time they are read.
+	LayoutHash
+)
+
+func (l Layout) String() string {
+	if l == LayoutHash {
+		return "hash"
+	}
+	return "string"
+}
+
+// metaField is the hash field holding the encrypted session without its values
+const metaField = "_meta"
+
+// valuePrefix starts the names of the hash fields holding the values of a session
+const valuePrefix = "v:"
+
+// valueField is the hash field holding the encrypted value stored under key
+func valueField(key string) string {
+	return valuePrefix + key
+}
+
+// loadHash fetches the metadata of a session saved with LayoutHash. Its values are fetched lazily
+func (rss *RedisSessionStore) loadHash(ctx context.Context, sessionID string) (*Session, int, error) {
+	redisStat, version, fields, err := rss.RedisClient.HashGetVersionedContext(ctx, sessionID, metaField)
+	if err != nil {
+		return nil, redisStat, err
+	}
+
+	session, err := rss.fromHash(ctx, sessionID, fields[metaField], version)
+	if err != nil {
+		return nil, webredis.RedisRecordUnmarshalError, err
+	}
+	return session, webredis.RedisRecordFound, nil
+}
+
+// fromHash decrypts the metadata of a session saved with LayoutHash, which has the given version in redis,
+// and sets it up to fetch its values lazily, within ctx
+func (rss *RedisSessionStore) fromHash(ctx context.Context, sessionID string, metaText string, version int64) (*Session, error) {
+	rss.RedisClient.ObservePayload(ctx, storeName, "get", len(metaText))
+	session, err := rss.fromToken(metaText)
+	if err != nil {
+		return nil, err
+	}
+	session.Values = make(map[string]interface{})
+	session.IsNew = false
+	session.Version = version
+	session.ctx = ctx
+	session.loader = func(ctx context.Context, key string) (interface{}, bool, error) {
+		redisStat, text, err := rss.RedisClient.HashGetFieldContext(ctx, sessionID, valueField(key))
+		if redisStat == webredis.RedisRecordNotFound {
+			return nil, false, nil
+		} else if err != nil {
+			webredis.LogValue(ctx, rss.logger(), rss.logLevels(), storeName, session.Name, sessionID, webredis.OutcomeError, err)
+			return nil, false, err
+		}
+		val, err := rss.decryptValue(text)
+		if err != nil {
+			// fetching it again would not help
+			webredis.LogValue(ctx, rss.logger(), rss.logLevels(), storeName, session.Name, sessionID, webredis.OutcomeDecryptFailure, err)
+			return nil, false, nil
+		}
+		return val, true, nil
+	}
+	return session, nil
+}
+
+// loadHashAll fetches a session saved with LayoutHash together with all its values, e.g. for OnConflict to merge them
+func (rss *RedisSessionStore) loadHashAll(ctx context.Context, sessionID string) (*Session, error) {
+	var fields map[string]string
+	err := rss.RedisClient.Retry.Do(ctx, func() (err error) {
+		fields, err = rss.RedisClient.Conn.HGetAll(ctx, sessionID).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fields[webredis.HashVersionField]; !ok {
+		return nil, redis.Nil
+	}
+	version, err := strconv.ParseInt(fields[webredis.HashVersionField], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	session, err := rss.fromHash(ctx, sessionID, fields[metaField], version)
+	if err != nil {
+		return nil, err
+	}
+	if session.Values, err = rss.decryptValues(fields); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// writeHash saves the metadata of a session and the values changed since it was loaded.
+// A session which was never saved has all its values written
+func (rss *RedisSessionStore) writeHash(ctx context.Context, s *Session) (int, int64, error) {
+	wr, err := rss.hashWrite(s)
+	if err != nil {
+		return webredis.RedisMarshalUpdateError, 0, err
+	}
+	redisStat, version, err := rss.RedisClient.HashSetIfVersionContext(ctx, wr.Key, wr.Version, wr.Set, wr.Del, wr.ExpiryDuration)
+	if redisStat == webredis.RedisRecordUpdated {
+		rss.RedisClient.ObservePayload(ctx, storeName, "save", hashWriteSize(wr))
+	}
+	return redisStat, version, err
+}
+
+// hashWriteSize is the size of the encrypted fields written by wr
+func hashWriteSize(wr webredis.HashWrite) int {
+	size := 0
+	for _, text := range wr.Set {
+		size += len(text)
+	}
+	return size
+}
+
+// hashWrite encrypts the metadata of a session and the values changed since it was loaded, as they are saved with LayoutHash
+func (rss *RedisSessionStore) hashWrite(s *Session) (webredis.HashWrite, error) {
+	meta := *s
+	meta.Values = nil
+	metaText, err := rss.token(&meta)
+	if err != nil {
+		return webredis.HashWrite{}, err
+	}
+
+	set := map[string]string{metaField: metaText}
+	for key, val := range s.Values {
+		if s.Version > 0 && !s.dirty[key] {
+			continue
+		}
+		text, err := rss.encryptValue(val)
+		if err != nil {
+			return webredis.HashWrite{}, err
+		}
+		set[valueField(key)] = text
+	}
+	del := make([]string, 0, len(s.deleted))
+	for key := range s.deleted {
+		del = append(del, valueField(key))
+	}
+
+	return webredis.HashWrite{Key: s.ID, Version: s.Version, Set: set, Del: del, ExpiryDuration: int64(s.Options.MaxAge)}, nil
+}
+
+func (rss *RedisSessionStore) encryptValue(val interface{}) (string, error) {
+	k, err := utils.NewKryptik(rss.Keys, utils.ModeCBC)
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(utils.Stringify(val))
+}
+
+func (rss *RedisSessionStore) decryptValue(text string) (interface{}, error) {
+	k, err := utils.NewKryptik(rss.Keys, utils.ModeCBC)
+	if err != nil {
+		return nil, err
+	}
+	jsn, err := k.Decrypt(text)
+	if err != nil {
+		return nil, err
+	}
+	var val interface{}
+	err = json.Unmarshal([]byte(jsn), &val)
+	return val, err
+}
+
+// DecryptedValues returns all values of the session saved under id, whatever its Layout.
+// It is meant for admin tools, e.g. as the Values of an admin.Handler
+func (rss *RedisSessionStore) DecryptedValues(ctx context.Context, id string) (map[string]interface{}, error) {
+	session, _, err := rss.load(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if rss.Layout != LayoutHash {
+		return session.Values, nil
+	}
+	return rss.hashValues(ctx, id)
+}
+
+// hashValues fetches and decrypts all values of a session saved with LayoutHash
+func (rss *RedisSessionStore) hashValues(ctx context.Context, id string) (map[string]interface{}, error) {
+	fields, err := rss.RedisClient.Conn.HGetAll(ctx, id).Result()
+	if err != nil {
+		return nil, err
+	}
+	return rss.decryptValues(fields)
+}
+
+// decryptValues decrypts the values among the fields of a session saved with LayoutHash
+func (rss *RedisSessionStore) decryptValues(fields map[string]string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	for field, text := range fields {
+		if !strings.HasPrefix(field, valuePrefix) {
+			continue
+		}
+		val, err := rss.decryptValue(text)
+		if err != nil {
+			return nil, err
+		}
+		values[strings.TrimPrefix(field, valuePrefix)] = val
+	}
+	return values, nil
+}
@@ -0,0 +1,20 @@
+package sessions
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+)
+
+// WithSessionLock serializes the requests handled by next which carry the same `name` session cookie,
+// so handlers that Get, change and Save the same session never run at the same time.
+// Requests without a session cookie are not serialized. See webredis.WithLock
+func (rss *RedisSessionStore) WithSessionLock(name string, ttl time.Duration, next http.Handler) http.Handler {
+	return webredis.WithLock(rss.RedisClient, func(r *http.Request) string {
+		if c, err := r.Cookie(name); err == nil && len(c.Value) > 0 {
+			return "session:" + c.Value
+		}
+		return ""
+	}, ttl, next)
+}
@@ -0,0 +1,302 @@
+package sessions
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gbenroscience/webredis"
+	"github.com/go-redis/redis/v8"
+)
+
+// DefaultRememberCookie is the name of the remember-me cookie, unless told otherwise
+const DefaultRememberCookie = "remember_me"
+
+// DefaultRememberPrefix is prepended to the keys of the remember-me tokens in redis, unless told otherwise
+const DefaultRememberPrefix = "webredis:remember:"
+
+// RememberedKey is set to true in the values of the sessions signed in by RememberMe.Restore,
+// e.g. to ask for the password again before sensitive actions
+const RememberedKey = "_remembered"
+
+// ErrNotRemembered is returned by RememberMe for requests without a valid remember-me token
+var ErrNotRemembered = errors.New("sessions: the request carries no valid remember-me token")
+
+// ErrRememberTheft is returned by RememberMe for requests presenting a remember-me token which was already replaced.
+// The token must have been copied, so its series was revoked
+var ErrRememberTheft = errors.New("sessions: the remember-me token was already used; its series was revoked")
+
+const (
+	defaultRememberMaxAge = 30 * 24 * time.Hour
+	defaultRotationGrace  = 10 * time.Second
+	rememberSelectorSize  = 12
+	rememberValidatorSize = 32
+)
+
+// RememberMe keeps users signed in beyond the life of their sessions, for "keep me signed in".
+// Its cookie holds a token "selector:validator". The selector finds the series of the token in redis, where only a hash
+// of the validator is kept, so reading redis does not give away valid tokens.
+// The validator is replaced each time the token is used. A token presented with a validator which was replaced must have been
+// copied: the series is revoked, signing out both the thief and the user
+type RememberMe struct {
+	Store *RedisSessionStore
+	// CookieName is the name of the cookie. Defaults to DefaultRememberCookie
+	CookieName string
+	// Prefix is prepended to the keys of the tokens in redis. Defaults to DefaultRememberPrefix
+	Prefix string
+	// MaxAge is how long a series lasts after it was last used. Defaults to 30 days
+	MaxAge time.Duration
+	// RotationGrace is how long the validator replaced last is still accepted, for the requests the browser sent
+	// at the same time as the one which replaced it. Defaults to 10 seconds
+	RotationGrace time.Duration
+	// Secure sets the Secure attribute of the cookie
+	Secure bool
+	// OnTheft is called with the user whose token was copied, once its series is revoked, e.g. to revoke the sessions of the user.
+	// Leave nil to only revoke the series
+	OnTheft func(ctx context.Context, userID string)
+}
+
+// NewRememberMe creates a RememberMe signing users in to the sessions of store
+func NewRememberMe(store *RedisSessionStore) *RememberMe {
+	return &RememberMe{Store: store, CookieName: DefaultRememberCookie, Prefix: DefaultRememberPrefix}
+}
+
+func (rm *RememberMe) cookieName() string {
+	if rm.CookieName == "" {
+		return DefaultRememberCookie
+	}
+	return rm.CookieName
+}
+
+func (rm *RememberMe) prefix() string {
+	if rm.Prefix == "" {
+		return DefaultRememberPrefix
+	}
+	return rm.Prefix
+}
+
+func (rm *RememberMe) maxAge() time.Duration {
+	if rm.MaxAge <= 0 {
+		return defaultRememberMaxAge
+	}
+	return rm.MaxAge
+}
+
+func (rm *RememberMe) rotationGrace() time.Duration {
+	if rm.RotationGrace <= 0 {
+		return defaultRotationGrace
+	}
+	return rm.RotationGrace
+}
+
+// seriesKey holds the user, the hashed validator, the previous one and when it was replaced
+func (rm *RememberMe) seriesKey(selector string) string {
+	return rm.prefix() + selector
+}
+
+// userKey holds the selectors of the series of a user
+func (rm *RememberMe) userKey(userID string) string {
+	return rm.prefix() + "user:" + userID
+}
+
+// useScript checks the validator of a series and replaces it.
+// It returns 1 and the user if the validator matches, 2 and the user if it was replaced less than the grace period ago,
+// 0 if there is no such series, and -1 and the user if the validator was replaced before, after deleting the series
+var useScript = redis.NewScript(`
+local rec = redis.call('HMGET', KEYS[1], 'user', 'validator', 'previous', 'rotated')
+if not rec[1] then
+	return {0, ''}
+end
+if rec[2] == ARGV[1] then
+	redis.call('HSET', KEYS[1], 'validator', ARGV[2], 'previous', ARGV[1], 'rotated', ARGV[3])
+	redis.call('PEXPIRE', KEYS[1], ARGV[5])
+	return {1, rec[1]}
+end
+if rec[3] == ARGV[1] and tonumber(ARGV[3]) - tonumber(rec[4]) <= tonumber(ARGV[4]) then
+	return {2, rec[1]}
+end
+redis.call('DEL', KEYS[1])
+return {-1, rec[1]}`)
+
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashValidator(validator string) string {
+	sum := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(sum[:])
+}
+
+// parse splits the token of the cookie of r into its selector and validator
+func (rm *RememberMe) parse(r *http.Request) (string, string, bool) {
+	c, err := r.Cookie(rm.cookieName())
+	if err != nil {
+		return "", "", false
+	}
+	selector, validator, ok := strings.Cut(c.Value, ":")
+	if !ok || base64.RawURLEncoding.DecodedLen(len(selector)) != rememberSelectorSize ||
+		base64.RawURLEncoding.DecodedLen(len(validator)) != rememberValidatorSize {
+		return "", "", false
+	}
+	return selector, validator, true
+}
+
+func (rm *RememberMe) setCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, NewCookie(rm.cookieName(), value, &Options{
+		Path:     "/",
+		MaxAge:   maxAge,
+		Secure:   rm.Secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}))
+}
+
+// Issue starts a new series for the user and sets its cookie. Call it when the user signs in and asks to be remembered
+func (rm *RememberMe) Issue(w http.ResponseWriter, r *http.Request, userID string) error {
+	ctx := requestContext(r)
+	selector, err := randomToken(rememberSelectorSize)
+	if err != nil {
+		return err
+	}
+	validator, err := randomToken(rememberValidatorSize)
+	if err != nil {
+		return err
+	}
+	_, err = rm.Store.RedisClient.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, rm.seriesKey(selector), "user", userID, "validator", hashValidator(validator), "created", time.Now().Unix())
+		pipe.PExpire(ctx, rm.seriesKey(selector), rm.maxAge())
+		pipe.SAdd(ctx, rm.userKey(userID), selector)
+		pipe.PExpire(ctx, rm.userKey(userID), rm.maxAge())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	rm.setCookie(w, selector+":"+validator, int(rm.maxAge()/time.Second))
+	return nil
+}
+
+// Authenticate returns the user of the remember-me token of r, and replaces its validator in the cookie.
+// It returns ErrNotRemembered if r has no valid token, and ErrRememberTheft if the token was copied; the cookie is cleared in both cases
+func (rm *RememberMe) Authenticate(w http.ResponseWriter, r *http.Request) (string, error) {
+	ctx := requestContext(r)
+	selector, validator, ok := rm.parse(r)
+	if !ok {
+		return "", ErrNotRemembered
+	}
+	next, err := randomToken(rememberValidatorSize)
+	if err != nil {
+		return "", err
+	}
+	// not retried: after a lost reply, the validator may have been replaced by one the browser never gets
+	res, err := useScript.Run(ctx, rm.Store.RedisClient.Conn, []string{rm.seriesKey(selector)},
+		hashValidator(validator), hashValidator(next), time.Now().UnixMilli(),
+		rm.rotationGrace().Milliseconds(), rm.maxAge().Milliseconds()).Slice()
+	if err != nil {
+		return "", err
+	}
+	status, _ := res[0].(int64)
+	userID, _ := res[1].(string)
+
+	switch status {
+	case 1:
+		err := rm.Store.RedisClient.Conn.PExpire(ctx, rm.userKey(userID), rm.maxAge()).Err()
+		if err != nil {
+			rm.Store.logger().LogAttrs(ctx, rm.Store.logLevels().RedisError, "webredis: remember-me series of the user could not be renewed",
+				slog.String("cause", err.Error()))
+		}
+		rm.setCookie(w, selector+":"+next, int(rm.maxAge()/time.Second))
+		return userID, nil
+	case 2:
+		// the cookie with the validator which replaced this one is on its way to the browser
+		return userID, nil
+	case -1:
+		rm.setCookie(w, "", -1)
+		rm.Store.RedisClient.Conn.SRem(ctx, rm.userKey(userID), selector)
+		rm.Store.logger().LogAttrs(ctx, rm.Store.logLevels().Warning, "webredis: remember-me token was used after it was replaced; its series was revoked",
+			slog.String("user", userID))
+		rm.Store.audit(ctx, r, webredis.AuditRememberTheft, &Session{Name: rm.cookieName(), UserID: userID}, "", "series revoked")
+		if rm.OnTheft != nil {
+			rm.OnTheft(ctx, userID)
+		}
+		return userID, ErrRememberTheft
+	}
+	rm.setCookie(w, "", -1)
+	return "", ErrNotRemembered
+}
+
+// Restore returns the session called name of r if it is signed in, or else signs it in from the remember-me token of r.
+// The session is then given to the user, marked with RememberedKey and saved, under a new ID if it existed before.
+// It returns the errors of Authenticate, e.g. ErrNotRemembered if the session is not signed in and there is no token
+func (rm *RememberMe) Restore(w http.ResponseWriter, r *http.Request, name string) (*Session, error) {
+	s, err := rm.Store.Get(r, name)
+	if err != nil {
+		return nil, err
+	}
+	if s.UserID != "" {
+		return s, nil
+	}
+	userID, err := rm.Authenticate(w, r)
+	if err != nil {
+		return nil, err
+	}
+	s.UserID = userID
+	s.StoreBool(RememberedKey, true)
+	if s.IsNew {
+		err = rm.Store.Save(s, r, w)
+	} else {
+		// the session gains privileges, so an ID which leaked before must not carry them
+		err = rm.Store.Regenerate(s, r, w)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rm.Store.audit(requestContext(r), r, webredis.AuditRemembered, s, "", "")
+	return s, nil
+}
+
+// Forget revokes the series of the remember-me token of r, if any, and clears the cookie. Call it when the user signs out
+func (rm *RememberMe) Forget(w http.ResponseWriter, r *http.Request) error {
+	rm.setCookie(w, "", -1)
+	selector, _, ok := rm.parse(r)
+	if !ok {
+		return nil
+	}
+	ctx := requestContext(r)
+	userID, err := rm.Store.RedisClient.Conn.HGet(ctx, rm.seriesKey(selector), "user").Result()
+	if err == redis.Nil {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	_, err = rm.Store.RedisClient.Conn.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, rm.seriesKey(selector))
+		pipe.SRem(ctx, rm.userKey(userID), selector)
+		return nil
+	})
+	return err
+}
+
+// ForgetUser revokes every series of the user, e.g. when the password changes
+func (rm *RememberMe) ForgetUser(ctx context.Context, userID string) error {
+	selectors, err := rm.Store.RedisClient.Conn.SMembers(ctx, rm.userKey(userID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{rm.userKey(userID)}
+	for _, selector := range selectors {
+		keys = append(keys, rm.seriesKey(selector))
+	}
+	return rm.Store.RedisClient.Conn.Del(ctx, keys...).Err()
+}
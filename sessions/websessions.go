@@ -2,8 +2,9 @@ package sessions
 
 import (
 	"bytes"
-	"encoding/base64"
+	"context"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"time"
 
@@ -20,8 +21,38 @@ type RedisSessionStore struct {
 	//applies to all sessions created in seconds, you may customize on the individual sessions
 	// using session.Options.MaxAge = ...
 	MaxAgeDefault int
+	// Binding optionally binds sessions to the client that created them. Leave nil to disable
+	Binding *webredis.SessionBinding
+	// OnConflict is called by Save when the session was saved by a concurrent request after it was loaded.
+	// It must merge the stored session and the local one, and return the session to save in their place.
+	// Leave nil to make Save fail with webredis.ErrConflict instead
+	OnConflict func(stored *Session, local *Session) (*Session, error)
+	// MaxConflictRetries is how many times Save merges and retries a conflicting session. Defaults to 3
+	MaxConflictRetries int
+	// Logger records lookups and saves which failed. Defaults to the Logger of RedisClient; if neither is set, nothing is logged
+	Logger *slog.Logger
+	// LogLevels sets the level of each event logged by Logger. Defaults to the LogLevels of RedisClient
+	LogLevels *webredis.LogLevels
+	// Index optionally keeps track of the saved sessions, so they can be listed by name or by user. Leave nil to disable
+	Index *webredis.SessionIndex
+	// Layout is how sessions are laid out in redis. Defaults to LayoutString.
+	// Sessions saved with one layout cannot be loaded with the other
+	Layout Layout
+	// Hooks are called when sessions are created, loaded, saved, destroyed or regenerated. Leave nil to disable
+	Hooks *webredis.Hooks
+	// Audit records security events of the sessions, such as their creation and revocation. Leave nil to disable
+	Audit *webredis.AuditLog
+	// Cache optionally keeps recently loaded sessions in memory. Leave nil to disable. See LocalCache
+	Cache *LocalCache
+	// Notices broadcasts the sessions which are revoked or regenerated to every instance, e.g. so websocket servers
+	// can close the connections opened with them. Leave nil to disable. See NewSessionTopic
+	Notices *webredis.Topic[webredis.SessionNotice]
+	// DegradedMode is what the store does when redis is unavailable. Defaults to webredis.DegradeNewSession
+	DegradedMode webredis.DegradedMode
 }
 
+const defaultConflictRetries = 3
+
 type Options struct {
 	Path   string `json:"path"`
 	Domain string `json:"domain"`
@@ -44,6 +75,25 @@ type Session struct {
 	Values  map[string]interface{} `json:"value"`
 	IsNew   bool                   `json:"is_new"`
 	Options *Options               `json:"options"`
+	// Fingerprint holds the hashed client attributes recorded when the session was created
+	Fingerprint map[string]string `json:"fingerprint,omitempty"`
+	// Version is the version of the session in redis when it was loaded. It is used by Save to detect lost updates
+	Version int64 `json:"-"`
+	// UserID optionally ties the session to a user, so it can be listed and revoked together with the user's other sessions
+	UserID string `json:"user_id,omitempty"`
+	// CreatedAt is when the session was created, in seconds since the epoch
+	CreatedAt int64 `json:"created_at"`
+	// Degraded is set on sessions kept in the cookie instead of redis, because redis is unavailable. See webredis.DegradeStateless
+	Degraded bool `json:"-"`
+
+	// dirty and deleted track the values changed since the session was loaded, so LayoutHash only writes those
+	dirty   map[string]bool
+	deleted map[string]bool
+	// loader fetches values which have not been loaded yet, for sessions saved with LayoutHash,
+	// within ctx, the context of the request the session was looked up for
+	loader  func(ctx context.Context, key string) (interface{}, bool, error)
+	ctx     context.Context
+	fetched map[string]bool
 }
 
 // NewWebRedisStore Creates a pointer to a new RedisSessionStore
@@ -56,85 +106,215 @@ func NewWebRedisStore(redisClient *redis.Client, secretKey string, defaultSessio
 
 // GetExisting returns a Session if one exists
 func (rss *RedisSessionStore) GetExisting(sessionID string) (*Session, error) {
-	session := new(Session)
-	rs := rss.RedisClient
-
-	var sessText string
-	redisStat, err := rs.Get(sessionID, &sessText)
-
+	session, _, err := rss.load(context.Background(), sessionID)
 	if err != nil {
 		return nil, err
 	}
+	return session, nil
+}
 
-	session, err = rss.fromToken(sessText)
+// SessionUser returns the UserID of the session saved under sessionID, or an empty string if there is no such session
+func (rss *RedisSessionStore) SessionUser(ctx context.Context, sessionID string) (string, error) {
+	session, redisStat, _, err := rss.loadCached(ctx, sessionID)
+	if redisStat == webredis.RedisRecordNotFound || redisStat == webredis.RedisRecordUnmarshalError {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return session.UserID, nil
+}
 
+// loadCached is load, served from the Cache if it holds the session. It also tells if the session came from the Cache.
+// Sessions kept in the cookie while redis was unavailable are decoded from it
+func (rss *RedisSessionStore) loadCached(ctx context.Context, sessionID string) (*Session, int, bool, error) {
+	if webredis.IsStateless(sessionID) {
+		session, redisStat, err := rss.loadStateless(sessionID)
+		return session, redisStat, false, err
+	}
+	if rss.Cache == nil {
+		session, redisStat, err := rss.load(ctx, sessionID)
+		return session, redisStat, false, err
+	}
+	session, seq := rss.Cache.get(sessionID)
+	if session != nil {
+		session.ctx = ctx
+		return session, webredis.RedisRecordFound, true, nil
+	}
+	session, redisStat, err := rss.load(ctx, sessionID)
 	if redisStat == webredis.RedisRecordFound {
-		session.IsNew = false
-		return session, nil
-	} else {
+		rss.Cache.add(session, seq)
+	}
+	return session, redisStat, false, err
+}
+
+// invalidate drops the session from the Cache of every instance, if there is one
+func (rss *RedisSessionStore) invalidate(ctx context.Context, s *Session, id string) {
+	if rss.Cache == nil {
+		return
+	}
+	err := rss.Cache.Invalidate(ctx, rss.RedisClient, id)
+	webredis.LogInvalidation(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, id, err)
+}
+
+// load fetches and decrypts the session saved under sessionID, whatever the Layout it was saved with.
+// The returned status is webredis.RedisRecordUnmarshalError if the session could not be decrypted
+func (rss *RedisSessionStore) load(ctx context.Context, sessionID string) (*Session, int, error) {
+	if rss.Layout == LayoutHash {
+		return rss.loadHash(ctx, sessionID)
+	}
+
+	var sessText string
+	redisStat, version, err := rss.RedisClient.GetVersionedContext(ctx, sessionID, &sessText)
+	if err != nil {
+		return nil, redisStat, err
+	}
+
+	session, err := rss.fromStored(ctx, sessText, version)
+	if err != nil {
+		return nil, webredis.RedisRecordUnmarshalError, err
+	}
+	return session, webredis.RedisRecordFound, nil
+}
+
+// fromStored decrypts a session saved with LayoutString, which has the given version in redis
+func (rss *RedisSessionStore) fromStored(ctx context.Context, sessText string, version int64) (*Session, error) {
+	rss.RedisClient.ObservePayload(ctx, storeName, "get", len(sessText))
+	session, err := rss.fromToken(sessText)
+	if err != nil {
 		return nil, err
 	}
+	session.IsNew = false
+	session.Version = version
+	return session, nil
 }
 
+// storeName identifies RedisSessionStore in the measurements reported to webredis.Metrics
+const storeName = "session"
+
 // Get returns a Session if one exists, or creates a new one if not
 func (rss *RedisSessionStore) Get(r *http.Request, name string) (*Session, error) {
-	session := new(Session)
-	rs := rss.RedisClient
+	ctx, done := rss.RedisClient.StartOperation(r.Context(), storeName, "Get",
+		webredis.AttrSessionName.String(name), webredis.AttrBackend.String(rss.Layout.String()))
+	session, outcome, err := rss.get(ctx, r, name)
+	rss.RedisClient.MetricsOrNop().ObserveLookup(storeName, outcome)
+	done(err, webredis.AttrOutcome.String(outcome))
+	return session, err
+}
 
+// get looks up the session of the request, and reports the outcome of the lookup
+func (rss *RedisSessionStore) get(ctx context.Context, r *http.Request, name string) (*Session, string, error) {
 	if c, err := r.Cookie(name); err == nil {
 		sessionID := c.Value
 		if len(sessionID) > 0 {
-			var sessText string
-			redisStat, err := rs.Get(sessionID, &sessText)
-
-			if err != nil {
-				//redis may be running on a configuration where it does not save to disk when power is lost.
-				// So give the user a new session here.
-				session = create(r, name, rss.MaxAgeDefault)
-				return session, nil
-			}
+			session, redisStat, cached, err := rss.loadCached(ctx, sessionID)
 
 			if redisStat == webredis.RedisRecordFound {
 				// The cached session was retrieved
-				session, err = rss.fromToken(sessText)
-				if err != nil {
-					//Data corruption occurred either with redis or the AES algorithm. Give a new session, please
-					session = create(r, name, rss.MaxAgeDefault)
-					return session, nil
+				switch rss.Binding.Verify(r, session.ID, session.Fingerprint) {
+				case webredis.FingerprintReject:
+					rss.audit(ctx, r, webredis.AuditFingerprintMismatch, session, "", "rejected")
+					webredis.LogLookup(ctx, rss.logger(), rss.logLevels(), storeName, name, sessionID, webredis.OutcomeFingerprintMismatch, nil)
+					return nil, webredis.OutcomeFingerprintMismatch, webredis.ErrFingerprintMismatch
+				case webredis.FingerprintRegenerate:
+					rss.audit(ctx, r, webredis.AuditFingerprintMismatch, session, "", "replaced by a new session")
+					//The session cookie was most likely presented by someone other than its owner
+					return rss.fresh(ctx, r, name, webredis.OutcomeFingerprintMismatch, sessionID, nil), webredis.OutcomeFingerprintMismatch, nil
+				}
+				rss.fire(ctx, webredis.SessionLoaded, session, "")
+				if cached {
+					return session, webredis.OutcomeCacheHit, nil
 				}
-				session.IsNew = false
-				return session, nil
+				if !session.Degraded {
+					rss.touch(ctx, session)
+				}
+				return session, webredis.OutcomeHit, nil
 			} else if redisStat == webredis.RedisRecordNotFound {
 				//Session possibly has expired in redis; most likely
-				session = create(r, name, rss.MaxAgeDefault)
-				return session, nil
+				return rss.fresh(ctx, r, name, webredis.OutcomeExpired, sessionID, nil), webredis.OutcomeExpired, nil
+			} else if redisStat == webredis.RedisRecordUnmarshalError {
+				//Data corruption occurred either with redis or the AES algorithm. Give a new session, please
+				rss.audit(ctx, r, webredis.AuditDecryptFailure, &Session{ID: sessionID, Name: name}, "", "")
+				return rss.fresh(ctx, r, name, webredis.OutcomeDecryptFailure, sessionID, err), webredis.OutcomeDecryptFailure, nil
+			} else if rss.DegradedMode == webredis.DegradeFailClosed {
+				webredis.LogLookup(ctx, rss.logger(), rss.logLevels(), storeName, name, sessionID, webredis.OutcomeError, err)
+				return nil, webredis.OutcomeError, err
 			} else {
-				//Weird, weird, weird
-				session = create(r, name, rss.MaxAgeDefault)
-				return session, nil
+				//redis may be running on a configuration where it does not save to disk when power is lost.
+				// So give the user a new session here.
+				session := rss.fresh(ctx, r, name, webredis.OutcomeError, sessionID, err)
+				session.Degraded = rss.DegradedMode == webredis.DegradeStateless
+				return session, webredis.OutcomeError, nil
 			}
 		} else {
 			//Session cookie set, but with no value... programming error most likely
 			//Most likely from registration or login, since no session header exists
-			session = create(r, name, rss.MaxAgeDefault)
-			return session, nil
+			return rss.fresh(ctx, r, name, webredis.OutcomeMiss, "", nil), webredis.OutcomeMiss, nil
 		}
 
 	} else {
 		//Session cookie not set
 		//Most likely from registration or login, since no session header exists
-		session = create(r, name, rss.MaxAgeDefault)
-		return session, nil
+		return rss.fresh(ctx, r, name, webredis.OutcomeMiss, "", nil), webredis.OutcomeMiss, nil
 	}
 
 }
 
-func create(r *http.Request, name string, maxAge int) *Session {
+// fresh creates a new session in place of the one which could not be loaded for the given reason
+// sessionID and cause are those of the session which could not be loaded, if any
+func (rss *RedisSessionStore) fresh(ctx context.Context, r *http.Request, name string, reason string, sessionID string, cause error) *Session {
+	webredis.LogLookup(ctx, rss.logger(), rss.logLevels(), storeName, name, sessionID, reason, cause)
+	rss.RedisClient.MetricsOrNop().ObserveSessionCreated(storeName, reason)
+	session := create(r, name, rss.MaxAgeDefault, rss.Binding)
+	rss.fire(ctx, webredis.SessionCreated, session, "")
+	return session
+}
+
+// fire calls the Hooks registered for the event, if any
+func (rss *RedisSessionStore) fire(ctx context.Context, kind webredis.SessionEventKind, s *Session, previousID string) {
+	rss.Hooks.Fire(ctx, webredis.SessionEvent{
+		Kind:       kind,
+		Store:      storeName,
+		SessionID:  s.ID,
+		PreviousID: previousID,
+		Name:       s.Name,
+		UserID:     s.UserID,
+		Session:    s,
+	})
+}
+
+// notify broadcasts that the sessions were revoked or regenerated, if the store has Notices
+func (rss *RedisSessionStore) notify(ctx context.Context, kind webredis.SessionEventKind, previousID string, sessions ...*Session) {
+	if rss.Notices == nil || len(sessions) == 0 {
+		return
+	}
+	notices := make([]webredis.SessionNotice, len(sessions))
+	for i, s := range sessions {
+		notices[i] = webredis.SessionNotice{Kind: kind, Store: storeName, SessionID: s.ID, PreviousID: previousID, Name: s.Name, UserID: s.UserID}
+	}
+	err := rss.Notices.Publish(ctx, notices...)
+	webredis.LogNotice(ctx, rss.logger(), rss.logLevels(), storeName, sessions[0].Name, sessions[0].ID, err)
+}
+
+// audit records a security event of the session in the Audit log, if any. r is the request which caused it, if any
+func (rss *RedisSessionStore) audit(ctx context.Context, r *http.Request, typ string, s *Session, previousID string, detail string) {
+	if rss.Audit == nil {
+		return
+	}
+	err := rss.Audit.RecordRequest(ctx, r, webredis.AuditEvent{
+		Type:       typ,
+		Store:      storeName,
+		Name:       s.Name,
+		SessionID:  s.ID,
+		PreviousID: previousID,
+		UserID:     s.UserID,
+		Detail:     detail,
+	})
+	webredis.LogAudit(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, err)
+}
+
+func create(r *http.Request, name string, maxAge int, binding *webredis.SessionBinding) *Session {
 	sess := new(Session)
-	var rnd = utils.NewRnd()
-	id := rnd.GenULID()
-	id = base64.RawURLEncoding.EncodeToString([]byte(id))
-	sess.ID = id
+	sess.ID = webredis.NewSessionID()
 	sess.Name = name
 	sess.Values = make(map[string]interface{})
 	sess.Options = new(Options)
@@ -143,6 +323,8 @@ func create(r *http.Request, name string, maxAge int) *Session {
 	sess.Options.HttpOnly = false
 	sess.Options.MaxAge = maxAge
 	sess.Options.SameSite = 1
+	sess.Fingerprint = binding.Fingerprint(r)
+	sess.CreatedAt = time.Now().Unix()
 	sess.IsNew = true
 
 	return sess
@@ -164,66 +346,124 @@ func newCookieFromOptions(name, value string, options *Options) *http.Cookie {
 }
 
 func (s *Session) StoreInt(key string, val int) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreText(key string, val string) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreBool(key string, val bool) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreFloat32(key string, val float32) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreFloat64(key string, val float64) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreByte(key string, val []byte) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 func (s *Session) StoreAny(key string, val interface{}) {
-	s.Values[key] = val
+	s.set(key, val)
 }
 
 func (s *Session) GetText(key string, defaultVal string) string {
-	if txt, ok := s.Values[key].(string); ok {
+	if txt, ok := s.value(key).(string); ok {
 		return txt
 	}
 	return defaultVal
 }
 func (s *Session) GetBoolean(key string, defaultVal bool) bool {
-	if boole, ok := s.Values[key].(bool); ok {
+	if boole, ok := s.value(key).(bool); ok {
 		return boole
 	}
 	return defaultVal
 }
 func (s *Session) GetInt(key string, defaultVal int) int {
-	if bits, ok := s.Values[key].(int); ok {
+	if bits, ok := s.value(key).(int); ok {
 		return bits
 	}
 	return defaultVal
 }
 func (s *Session) GetByte(key string, defaultVal byte) byte {
-	if bits, ok := s.Values[key].(byte); ok {
+	if bits, ok := s.value(key).(byte); ok {
 		return bits
 	}
 	return defaultVal
 }
 func (s *Session) GetFloat32(key string, defaultVal float32) float32 {
-	if bits, ok := s.Values[key].(float32); ok {
+	if bits, ok := s.value(key).(float32); ok {
 		return bits
 	}
 	return defaultVal
 }
 func (s *Session) GetFloat64(key string, defaultVal float64) float64 {
-	if bits, ok := s.Values[key].(float64); ok {
+	if bits, ok := s.value(key).(float64); ok {
 		return bits
 	}
 	return defaultVal
 }
 
 func (s *Session) GetAny(key string) interface{} {
-	return s.Values[key]
+	return s.value(key)
+}
+
+// DeleteAny You need to call RedisSessionStore.Save to persist this action to redis!
+func (s *Session) DeleteAny(key string) {
+	delete(s.Values, key)
+	delete(s.dirty, key)
+	if s.deleted == nil {
+		s.deleted = make(map[string]bool)
+	}
+	s.deleted[key] = true
+}
+
+// set stores a value and remembers that it has to be written on the next Save
+func (s *Session) set(key string, val interface{}) {
+	s.Values[key] = val
+	delete(s.deleted, key)
+	if s.dirty == nil {
+		s.dirty = make(map[string]bool)
+	}
+	s.dirty[key] = true
+}
+
+// value returns the value stored under key, fetching it from redis first if it has not been loaded yet.
+// A value which redis failed to return reads as missing, and is fetched again the next time it is read
+func (s *Session) value(key string) interface{} {
+	if val, ok := s.Values[key]; ok || s.loader == nil || s.deleted[key] || s.fetched[key] {
+		return val
+	}
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	val, ok, err := s.loader(ctx, key)
+	if err != nil {
+		return nil
+	}
+	if s.fetched == nil {
+		s.fetched = make(map[string]bool)
+	}
+	s.fetched[key] = true
+	if ok {
+		s.Values[key] = val
+	}
+	return val
+}
+
+// adoptChanges marks all loaded values of a session returned by OnConflict as changed, together with the values deleted from local
+func (s *Session) adoptChanges(local *Session) {
+	s.dirty = make(map[string]bool, len(s.Values))
+	for key := range s.Values {
+		s.dirty[key] = true
+	}
+	s.deleted = make(map[string]bool, len(local.deleted))
+	for key := range local.deleted {
+		if _, ok := s.Values[key]; !ok {
+			s.deleted[key] = true
+		}
+	}
 }
 
 // NewCookie returns an http.Cookie with the options set. It also sets
@@ -268,23 +508,182 @@ func (rss *RedisSessionStore) fromToken(sessionToken string) (*Session, error) {
 	return &s, err
 }
 
-// Save saves a session in redis
+// Save saves a session in redis. If the session was saved by a concurrent request after it was loaded,
+// both are merged using OnConflict and saved again; without OnConflict, webredis.ErrConflict is returned.
 func (rss *RedisSessionStore) Save(s *Session, r *http.Request, w http.ResponseWriter) error {
+	ctx, done := rss.RedisClient.StartOperation(requestContext(r), storeName, "Save",
+		webredis.AttrSessionName.String(s.Name), webredis.AttrBackend.String(rss.Layout.String()))
+	created := s.IsNew
+	err := rss.save(ctx, s, w)
+	if err != nil && rss.DegradedMode == webredis.DegradeStateless && webredis.IsUnavailable(err) {
+		err = rss.saveStateless(s, w)
+	}
+	webredis.LogSave(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, err)
+	if err == nil {
+		if created && !s.Degraded {
+			rss.audit(ctx, r, webredis.AuditCreated, s, "", "")
+		}
+		rss.fire(ctx, webredis.SessionSaved, s, "")
+	}
+	done(err)
+	return err
+}
 
-	tkn, err := rss.token(s)
+// Regenerate gives the session a new ID, saves it under that ID and deletes it under the old one.
+// Regenerate sessions when their privileges change, e.g. on login, so an ID which leaked before cannot be used after
+func (rss *RedisSessionStore) Regenerate(s *Session, r *http.Request, w http.ResponseWriter) error {
+	ctx, done := rss.RedisClient.StartOperation(requestContext(r), storeName, "Regenerate",
+		webredis.AttrSessionName.String(s.Name), webredis.AttrBackend.String(rss.Layout.String()))
+	err := rss.regenerate(ctx, s, r, w)
+	webredis.LogSave(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, err)
+	done(err)
+	return err
+}
 
-	if err != nil {
+func (rss *RedisSessionStore) regenerate(ctx context.Context, s *Session, r *http.Request, w http.ResponseWriter) error {
+	// a session saved as a hash is written in full under its new ID, so the values not read yet are needed
+	if s.loader != nil {
+		values, err := rss.hashValues(ctx, s.ID)
+		if err != nil {
+			return err
+		}
+		for key, val := range values {
+			if _, ok := s.Values[key]; !ok && !s.deleted[key] {
+				s.Values[key] = val
+			}
+		}
+	}
+	previous := *s
+	s.ID, s.Version = webredis.NewSessionID(), 0
+	s.loader, s.deleted = nil, nil
+	if err := rss.save(ctx, s, w); err != nil {
+		*s = previous
 		return err
 	}
-	redisStat, err := rss.RedisClient.SetWithExpiry(s.ID, tkn, int64(s.Options.MaxAge)) // save session to redis
-	if redisStat == webredis.RedisRecordUpdated {
-		http.SetCookie(w, NewCookie(s.Name, s.ID, s.Options)) // send session id to browser as cookie
+
+	_, err := rss.RedisClient.DeleteContext(ctx, previous.ID)
+	rss.invalidate(ctx, s, previous.ID)
+	if err == nil && rss.Index != nil {
+		webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, previous.ID, rss.Index.Remove(ctx, previous.ID))
 	}
+	rss.RedisClient.MetricsOrNop().ObserveSessionCreated(storeName, "regenerated")
+	rss.audit(ctx, r, webredis.AuditRegenerated, s, previous.ID, "")
+	rss.fire(ctx, webredis.SessionRegenerated, s, previous.ID)
+	rss.notify(ctx, webredis.SessionRegenerated, previous.ID, s)
 	return err
 }
 
+// touch records the access to a session in the Index, if there is one
+func (rss *RedisSessionStore) touch(ctx context.Context, s *Session) {
+	if rss.Index == nil {
+		return
+	}
+	err := rss.Index.Touch(ctx, s.ID, s.Name, s.UserID, time.Unix(s.CreatedAt, 0), time.Duration(s.Options.MaxAge)*time.Second)
+	webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, err)
+}
+
+func (rss *RedisSessionStore) logger() *slog.Logger {
+	if rss.Logger != nil {
+		return rss.Logger
+	}
+	return rss.RedisClient.LoggerOrNop()
+}
+
+func (rss *RedisSessionStore) logLevels() *webredis.LogLevels {
+	if rss.LogLevels != nil {
+		return rss.LogLevels
+	}
+	return rss.RedisClient.LogLevelsOrDefault()
+}
+
+func (rss *RedisSessionStore) save(ctx context.Context, s *Session, w http.ResponseWriter) error {
+	retries := rss.MaxConflictRetries
+	if retries <= 0 {
+		retries = defaultConflictRetries
+	}
+
+	if s.Degraded {
+		if err := rss.restoreVersion(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		redisStat, version, err := rss.write(ctx, s) // save session to redis
+		if redisStat == webredis.RedisRecordUpdated {
+			if !s.IsNew {
+				// nobody can have cached a session which was never saved before
+				rss.invalidate(ctx, s, s.ID)
+			}
+			s.Version, s.Degraded, s.IsNew = version, false, false
+			rss.touch(ctx, s)
+			s.dirty, s.deleted = nil, nil
+			http.SetCookie(w, NewCookie(s.Name, s.ID, s.Options)) // send session id to browser as cookie
+			return nil
+		}
+		if redisStat != webredis.RedisRecordConflict || rss.OnConflict == nil || attempt >= retries {
+			return err
+		}
+
+		var stored *Session
+		if rss.Layout == LayoutHash {
+			// values are fetched lazily, and OnConflict must see all of them to merge
+			stored, err = rss.loadHashAll(ctx, s.ID)
+		} else {
+			stored, _, err = rss.load(ctx, s.ID)
+		}
+		if err != nil {
+			//The session was deleted or has expired since it was loaded; don't bring it back to life
+			return webredis.ErrConflict
+		}
+		merged, err := rss.OnConflict(stored, s)
+		if err != nil {
+			return err
+		}
+		merged.Version = stored.Version
+		merged.adoptChanges(s)
+		*s = *merged
+	}
+}
+
+// requestContext is the context of r, or the background context for callers who have no request to pass
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// write encrypts the session and saves it in redis using the configured Layout
+func (rss *RedisSessionStore) write(ctx context.Context, s *Session) (int, int64, error) {
+	if rss.Layout == LayoutHash {
+		return rss.writeHash(ctx, s)
+	}
+	tkn, err := rss.token(s)
+	if err != nil {
+		return webredis.RedisMarshalUpdateError, 0, err
+	}
+	redisStat, version, err := rss.RedisClient.SetIfVersionContext(ctx, s.ID, tkn, s.Version, int64(s.Options.MaxAge))
+	if redisStat == webredis.RedisRecordUpdated {
+		rss.RedisClient.ObservePayload(ctx, storeName, "save", len(tkn))
+	}
+	return redisStat, version, err
+}
+
 // Delete Manually delete the session from redis
 func (rss *RedisSessionStore) Delete(s *Session) (int64, error) {
 	rs := rss.RedisClient
-	return rs.Delete(s.ID)
+	ctx, done := rs.StartOperation(context.Background(), storeName, "Delete", webredis.AttrSessionName.String(s.Name))
+	n, err := rs.DeleteContext(ctx, s.ID)
+	rss.invalidate(ctx, s, s.ID)
+	if err == nil && rss.Index != nil {
+		webredis.LogIndex(ctx, rss.logger(), rss.logLevels(), storeName, s.Name, s.ID, rss.Index.Remove(ctx, s.ID))
+	}
+	if err == nil && n > 0 {
+		rss.audit(ctx, nil, webredis.AuditRevoked, s, "", "")
+		rss.fire(ctx, webredis.SessionDestroyed, s, "")
+		rss.notify(ctx, webredis.SessionDestroyed, "", s)
+	}
+	done(err)
+	return n, err
 }
@@ -2,12 +2,17 @@ package webredis
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
+	"time"
 
 	"github.com/gbenroscience/webredis/utils"
 	"github.com/go-redis/redis/v8"
+	"github.com/oklog/ulid"
 )
 
 // RedisTokenStore Manages tokens usable with REST APIS and saves them to redis.
@@ -20,8 +25,40 @@ type RedisTokenStore struct {
 	// using session.Options.MaxAge = ...
 	MaxAgeDefault int
 	HeaderName    string
+	// Binding optionally binds sessions to the client that created them. Leave nil to disable
+	Binding *SessionBinding
+	// OnConflict is called by Save when the session was saved by a concurrent request after it was loaded.
+	// It must merge the stored session and the local one, and return the session to save in their place.
+	// Leave nil to make Save fail with ErrConflict instead
+	OnConflict func(stored *Session, local *Session) (*Session, error)
+	// MaxConflictRetries is how many times Save merges and retries a conflicting session. Defaults to 3
+	MaxConflictRetries int
+	// Logger records lookups and saves which failed. Defaults to the Logger of RedisClient; if neither is set, nothing is logged
+	Logger *slog.Logger
+	// LogLevels sets the level of each event logged by Logger. Defaults to the LogLevels of RedisClient
+	LogLevels *LogLevels
+	// Index optionally keeps track of the saved sessions, so they can be listed by name or by user. Leave nil to disable
+	Index *SessionIndex
+	// Hooks are called when sessions are created, loaded, saved, destroyed or regenerated. Leave nil to disable
+	Hooks *Hooks
+	// Audit records security events of the sessions, such as their creation and revocation. Leave nil to disable
+	Audit *AuditLog
+	// Notices broadcasts the sessions which are revoked or regenerated to every instance, e.g. so websocket servers
+	// can close the connections opened with them. Leave nil to disable. See NewSessionTopic
+	Notices *Topic[SessionNotice]
+	// DegradedMode is what the store does when redis is unavailable. Defaults to DegradeNewSession
+	DegradedMode DegradedMode
+	// RefreshPrefix is prepended to the keys of the refresh tokens in redis. Defaults to DefaultRefreshPrefix
+	RefreshPrefix string
+	// RefreshReuseInterval is how long after it was exchanged a refresh token presented again gets the same pair,
+	// rather than revoking its family, e.g. for clients which retry when the response is lost. Defaults to 0: any reuse revokes the family
+	RefreshReuseInterval time.Duration
+	// JWT issues the sessions as signed JWTs, verified without redis, and revokes their JWTs with them. Leave nil to disable
+	JWT *JWTConfig
 }
 
+const defaultConflictRetries = 3
+
 // NewWebRedisStore Creates a pointer to a new RedisTokenStore
 // redisClient: a client connection to redis
 // secretKey: A 32 bytes long string to use for encrypting(using AES) and decryptng the session data
@@ -37,95 +74,235 @@ type Session struct {
 	Values map[string]interface{} `json:"value"`
 	IsNew  bool                   `json:"is_new"`
 	MaxAge int                    `json:"max_age"`
+	// Fingerprint holds the hashed client attributes recorded when the session was created
+	Fingerprint map[string]string `json:"fingerprint,omitempty"`
+	// Version is the version of the session in redis when it was loaded. It is used by Save to detect lost updates
+	Version int64 `json:"-"`
+	// UserID optionally ties the session to a user, so it can be listed and revoked together with the user's other sessions
+	UserID string `json:"user_id,omitempty"`
+	// CreatedAt is when the session was created, in seconds since the epoch
+	CreatedAt int64 `json:"created_at"`
+	// Degraded is set on sessions kept in the header instead of redis, because redis is unavailable. See DegradeStateless
+	Degraded bool `json:"-"`
+	// Scopes are what an API token may be used for. See IssueToken
+	Scopes []string `json:"scopes,omitempty"`
+	// ClientID is the client an API token was issued to
+	ClientID string `json:"client_id,omitempty"`
+	// ExpiresAt is when an API token expires, in seconds since the epoch
+	ExpiresAt int64 `json:"expires_at,omitempty"`
 }
 
-func create(r *http.Request, name string, maxAge int) *Session {
+func create(r *http.Request, name string, maxAge int, binding *SessionBinding) *Session {
 	sess := new(Session)
-	var rnd = utils.NewRnd()
-	id := rnd.GenULID()
-	id = base64.RawURLEncoding.EncodeToString([]byte(id))
-	sess.ID = id
+	sess.ID = NewSessionID()
 	sess.Name = name
 	sess.Values = make(map[string]interface{})
 	sess.MaxAge = maxAge
+	sess.Fingerprint = binding.Fingerprint(r)
+	sess.CreatedAt = time.Now().Unix()
 	sess.IsNew = true
 
 	return sess
 }
 
+// NewSessionID generates an ID for a new session
+func NewSessionID() string {
+	var rnd = utils.NewRnd()
+	id := rnd.GenULID()
+	return base64.RawURLEncoding.EncodeToString([]byte(id))
+}
+
+// IsSessionID tells if id has the form of the IDs made by NewSessionID
+func IsSessionID(id string) bool {
+	raw, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return false
+	}
+	_, err = ulid.ParseStrict(string(raw))
+	return err == nil
+}
+
+// tokenStoreName identifies RedisTokenStore in the measurements reported to Metrics
+const tokenStoreName = "token"
+
 // GetExisting returns a Session if one exists
 func (rts *RedisTokenStore) GetExisting(sessionID string) (*Session, error) {
-	session := new(Session)
-	rs := rts.RedisClient
+	session, _, err := rts.loadSession(context.Background(), sessionID)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
 
+// SessionUser returns the UserID of the session saved under sessionID, or an empty string if there is no such session
+func (rts *RedisTokenStore) SessionUser(ctx context.Context, sessionID string) (string, error) {
+	session, redisStat, err := rts.lookup(ctx, sessionID)
+	if redisStat == RedisRecordNotFound || redisStat == RedisRecordUnmarshalError {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return session.UserID, nil
+}
+
+// load fetches and decrypts the session saved under sessionID.
+// The returned status is RedisRecordUnmarshalError if the session could not be decrypted
+func (rts *RedisTokenStore) load(ctx context.Context, sessionID string) (*Session, int, error) {
 	var sessText string
-	redisStat, err := rs.Get(sessionID, &sessText)
+	redisStat, version, err := rts.RedisClient.GetVersionedContext(ctx, sessionID, &sessText)
+	if err != nil {
+		return nil, redisStat, err
+	}
 
+	session, err := rts.fromStored(ctx, sessText, version)
 	if err != nil {
-		return nil, err
+		return nil, RedisRecordUnmarshalError, err
 	}
+	return session, RedisRecordFound, nil
+}
 
-	session, err = rts.fromToken(sessText)
+// loadSession is load for the lookups of sessions by ID. API tokens are not found there: they are saved
+// under the hash of the token, which is not a credential, being the key in redis
+func (rts *RedisTokenStore) loadSession(ctx context.Context, sessionID string) (*Session, int, error) {
+	session, redisStat, err := rts.load(ctx, sessionID)
+	if redisStat == RedisRecordFound && session.Name == APITokenName {
+		return nil, RedisRecordNotFound, redis.Nil
+	}
+	return session, redisStat, err
+}
 
-	if redisStat == RedisRecordFound {
-		session.IsNew = false
-		return session, nil
-	} else {
+// fromStored decrypts a session saved in redis, which has the given version there
+func (rts *RedisTokenStore) fromStored(ctx context.Context, sessText string, version int64) (*Session, error) {
+	rts.RedisClient.ObservePayload(ctx, tokenStoreName, "get", len(sessText))
+	session, err := rts.fromToken(sessText)
+	if err != nil {
 		return nil, err
 	}
+	session.IsNew = false
+	session.Version = version
+	return session, nil
 }
 
 // Get returns a Session if one exists, or creates a new one if not
 func (rts *RedisTokenStore) Get(r *http.Request, name string) (*Session, error) {
-	session := new(Session)
-	rs := rts.RedisClient
+	ctx, done := rts.RedisClient.StartOperation(r.Context(), tokenStoreName, "Get",
+		AttrSessionName.String(name), AttrBackend.String("string"))
+	session, outcome, err := rts.get(ctx, r, name)
+	rts.RedisClient.MetricsOrNop().ObserveLookup(tokenStoreName, outcome)
+	done(err, AttrOutcome.String(outcome))
+	return session, err
+}
 
+// get looks up the session of the request, and reports the outcome of the lookup
+func (rts *RedisTokenStore) get(ctx context.Context, r *http.Request, name string) (*Session, string, error) {
 	if c, err := r.Cookie(name); err == nil {
 		sessionID := c.Value
 		if len(sessionID) > 0 {
-			var sessText string
-			redisStat, err := rs.Get(sessionID, &sessText)
-
-			if err != nil {
-				//redis may be running on a configuration where it does not save to disk when power is lost.
-				// So give the user a new session here.
-				session = create(r, name, rts.MaxAgeDefault)
-				return session, nil
+			session, redisStat, err := rts.lookup(ctx, sessionID)
+			if redisStat == RedisRecordFound && session.Name != name {
+				// a session of another name is not the session of this cookie
+				session, redisStat = nil, RedisRecordNotFound
 			}
 
 			if redisStat == RedisRecordFound {
 				// The cached session was retrieved
-				session, err = rts.fromToken(sessText)
-				if err != nil {
-					//Data corruption occurred either with redis or the AES algorithm. Give a new session, please
-					session = create(r, name, rts.MaxAgeDefault)
-					return session, nil
+				switch rts.Binding.Verify(r, session.ID, session.Fingerprint) {
+				case FingerprintReject:
+					rts.audit(ctx, r, AuditFingerprintMismatch, session, "", "rejected")
+					LogLookup(ctx, rts.logger(), rts.logLevels(), tokenStoreName, name, sessionID, OutcomeFingerprintMismatch, nil)
+					return nil, OutcomeFingerprintMismatch, ErrFingerprintMismatch
+				case FingerprintRegenerate:
+					rts.audit(ctx, r, AuditFingerprintMismatch, session, "", "replaced by a new session")
+					//The session cookie was most likely presented by someone other than its owner
+					return rts.fresh(ctx, r, name, OutcomeFingerprintMismatch, sessionID, nil), OutcomeFingerprintMismatch, nil
+				}
+				if !session.Degraded {
+					rts.touch(ctx, session)
 				}
-				session.IsNew = false
-				return session, nil
+				rts.fire(ctx, SessionLoaded, session, "")
+				return session, OutcomeHit, nil
 			} else if redisStat == RedisRecordNotFound {
 				//Session possibly has expired in redis; most likely
-				session = create(r, name, rts.MaxAgeDefault)
-				return session, nil
+				return rts.fresh(ctx, r, name, OutcomeExpired, sessionID, nil), OutcomeExpired, nil
+			} else if redisStat == RedisRecordUnmarshalError {
+				//Data corruption occurred either with redis or the AES algorithm. Give a new session, please
+				rts.audit(ctx, r, AuditDecryptFailure, &Session{ID: sessionID, Name: name}, "", "")
+				return rts.fresh(ctx, r, name, OutcomeDecryptFailure, sessionID, err), OutcomeDecryptFailure, nil
+			} else if rts.DegradedMode == DegradeFailClosed {
+				LogLookup(ctx, rts.logger(), rts.logLevels(), tokenStoreName, name, sessionID, OutcomeError, err)
+				return nil, OutcomeError, err
 			} else {
-				//Weird, weird, weird
-				session = create(r, name, rts.MaxAgeDefault)
-				return session, nil
+				//redis may be running on a configuration where it does not save to disk when power is lost.
+				// So give the user a new session here.
+				session := rts.fresh(ctx, r, name, OutcomeError, sessionID, err)
+				session.Degraded = rts.DegradedMode == DegradeStateless
+				return session, OutcomeError, nil
 			}
 		} else {
 			//Session cookie set, but with no value... programming error most likely
 			//Most likely from registration or login, since no session header exists
-			session = create(r, name, rts.MaxAgeDefault)
-			return session, nil
+			return rts.fresh(ctx, r, name, OutcomeMiss, "", nil), OutcomeMiss, nil
 		}
 
 	} else {
 		//Session cookie not set
 		//Most likely from registration or login, since no session header exists
-		session = create(r, name, rts.MaxAgeDefault)
-		return session, nil
+		return rts.fresh(ctx, r, name, OutcomeMiss, "", nil), OutcomeMiss, nil
+	}
+
+}
+
+// fresh creates a new session in place of the one which could not be loaded for the given reason
+// sessionID and cause are those of the session which could not be loaded, if any
+func (rts *RedisTokenStore) fresh(ctx context.Context, r *http.Request, name string, reason string, sessionID string, cause error) *Session {
+	LogLookup(ctx, rts.logger(), rts.logLevels(), tokenStoreName, name, sessionID, reason, cause)
+	rts.RedisClient.MetricsOrNop().ObserveSessionCreated(tokenStoreName, reason)
+	session := create(r, name, rts.MaxAgeDefault, rts.Binding)
+	rts.fire(ctx, SessionCreated, session, "")
+	return session
+}
+
+// fire calls the Hooks registered for the event, if any
+func (rts *RedisTokenStore) fire(ctx context.Context, kind SessionEventKind, s *Session, previousID string) {
+	rts.Hooks.Fire(ctx, SessionEvent{
+		Kind:       kind,
+		Store:      tokenStoreName,
+		SessionID:  s.ID,
+		PreviousID: previousID,
+		Name:       s.Name,
+		UserID:     s.UserID,
+		Session:    s,
+	})
+}
+
+// notify broadcasts that the sessions were revoked or regenerated, if the store has Notices
+func (rts *RedisTokenStore) notify(ctx context.Context, kind SessionEventKind, previousID string, sessions ...*Session) {
+	if rts.Notices == nil || len(sessions) == 0 {
+		return
 	}
+	notices := make([]SessionNotice, len(sessions))
+	for i, s := range sessions {
+		notices[i] = SessionNotice{Kind: kind, Store: tokenStoreName, SessionID: s.ID, PreviousID: previousID, Name: s.Name, UserID: s.UserID}
+	}
+	err := rts.Notices.Publish(ctx, notices...)
+	LogNotice(ctx, rts.logger(), rts.logLevels(), tokenStoreName, sessions[0].Name, sessions[0].ID, err)
+}
 
+// audit records a security event of the session in the Audit log, if any. r is the request which caused it, if any
+func (rts *RedisTokenStore) audit(ctx context.Context, r *http.Request, typ string, s *Session, previousID string, detail string) {
+	if rts.Audit == nil {
+		return
+	}
+	err := rts.Audit.RecordRequest(ctx, r, AuditEvent{
+		Type:       typ,
+		Store:      tokenStoreName,
+		Name:       s.Name,
+		SessionID:  s.ID,
+		PreviousID: previousID,
+		UserID:     s.UserID,
+		Detail:     detail,
+	})
+	LogAudit(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
 }
 
 func (s *Session) StoreInt(key string, val int) {
@@ -217,24 +394,208 @@ func (rts *RedisTokenStore) fromToken(sessionToken string) (*Session, error) {
 	return &s, err
 }
 
-// Save saves a session in redis
+// Save saves a session in redis. If the session was saved by a concurrent request after it was loaded,
+// both are merged using OnConflict and saved again; without OnConflict, ErrConflict is returned.
 func (rts *RedisTokenStore) Save(s *Session, r *http.Request, w http.ResponseWriter) error {
+	ctx := requestContext(r)
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "Save",
+		AttrSessionName.String(s.Name), AttrBackend.String("string"))
+	created := s.IsNew
+	err := rts.save(ctx, s, w)
+	if err != nil && rts.DegradedMode == DegradeStateless && IsUnavailable(err) {
+		err = rts.saveStateless(s, w)
+	}
+	LogSave(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
+	if err == nil {
+		if created && !s.Degraded {
+			rts.audit(ctx, r, AuditCreated, s, "", "")
+		}
+		rts.fire(ctx, SessionSaved, s, "")
+	}
+	done(err)
+	return err
+}
 
-	tkn, err := rts.token(s)
+// Regenerate gives the session a new ID, saves it under that ID and deletes it under the old one.
+// Regenerate sessions when their privileges change, e.g. on login, so an ID which leaked before cannot be used after
+func (rts *RedisTokenStore) Regenerate(s *Session, r *http.Request, w http.ResponseWriter) error {
+	ctx := requestContext(r)
+	ctx, done := rts.RedisClient.StartOperation(ctx, tokenStoreName, "Regenerate",
+		AttrSessionName.String(s.Name), AttrBackend.String("string"))
 
+	previousID, previousVersion := s.ID, s.Version
+	s.ID, s.Version = NewSessionID(), 0
+	err := rts.save(ctx, s, w)
 	if err != nil {
-		return err
+		s.ID, s.Version = previousID, previousVersion
+	} else {
+		_, err = rts.RedisClient.DeleteContext(ctx, previousID)
+		if err == nil && rts.Index != nil {
+			LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, previousID, rts.Index.Remove(ctx, previousID))
+		}
+		rts.RedisClient.MetricsOrNop().ObserveSessionCreated(tokenStoreName, "regenerated")
+		rts.audit(ctx, r, AuditRegenerated, s, previousID, "")
+		rts.fire(ctx, SessionRegenerated, s, previousID)
+		rts.notify(ctx, SessionRegenerated, previousID, s)
+		rts.revokeJWTs(ctx, s.Name, previousID)
 	}
-	redisStat, err := rts.RedisClient.SetWithExpiry(s.ID, tkn, int64(s.MaxAge)) // save session to redis
-	if redisStat == RedisRecordUpdated {
-		w.Header().Set(s.Name, s.ID)
+	LogSave(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
+	done(err)
+	return err
+}
 
+// requestContext is the context of r, or the background context for callers who have no request to pass
+func requestContext(r *http.Request) context.Context {
+	if r == nil {
+		return context.Background()
+	}
+	return r.Context()
+}
+
+// touch records the access to a session in the Index, if there is one
+func (rts *RedisTokenStore) touch(ctx context.Context, s *Session) {
+	if rts.Index == nil {
+		return
+	}
+	err := rts.Index.Touch(ctx, s.ID, s.Name, s.UserID, time.Unix(s.CreatedAt, 0), time.Duration(s.MaxAge)*time.Second)
+	LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
+}
+
+func (rts *RedisTokenStore) logger() *slog.Logger {
+	if rts.Logger != nil {
+		return rts.Logger
+	}
+	return rts.RedisClient.LoggerOrNop()
+}
+
+func (rts *RedisTokenStore) logLevels() *LogLevels {
+	if rts.LogLevels != nil {
+		return rts.LogLevels
+	}
+	return rts.RedisClient.LogLevelsOrDefault()
+}
+
+func (rts *RedisTokenStore) save(ctx context.Context, s *Session, w http.ResponseWriter) error {
+	retries := rts.MaxConflictRetries
+	if retries <= 0 {
+		retries = defaultConflictRetries
+	}
+
+	if s.Degraded {
+		if err := rts.restoreVersion(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		tkn, err := rts.token(s)
+
+		if err != nil {
+			return err
+		}
+		redisStat, version, err := rts.RedisClient.SetIfVersionContext(ctx, s.ID, tkn, s.Version, int64(s.MaxAge)) // save session to redis
+		if redisStat == RedisRecordUpdated {
+			rts.RedisClient.ObservePayload(ctx, tokenStoreName, "save", len(tkn))
+			s.Version, s.Degraded, s.IsNew = version, false, false
+			rts.touch(ctx, s)
+			w.Header().Set(s.Name, s.ID)
+			return nil
+		}
+		if redisStat != RedisRecordConflict || rts.OnConflict == nil || attempt >= retries {
+			return err
+		}
+
+		stored, _, err := rts.load(ctx, s.ID)
+		if err != nil {
+			//The session was deleted or has expired since it was loaded; don't bring it back to life
+			return ErrConflict
+		}
+		merged, err := rts.OnConflict(stored, s)
+		if err != nil {
+			return err
+		}
+		merged.Version = stored.Version
+		*s = *merged
 	}
-	return err
 }
 
 // Delete Manually delete the session from redis
 func (rts *RedisTokenStore) Delete(s *Session) (int64, error) {
 	rs := rts.RedisClient
-	return rs.Delete(s.ID)
+	ctx, done := rs.StartOperation(context.Background(), tokenStoreName, "Delete", AttrSessionName.String(s.Name))
+	n, err := rs.DeleteContext(ctx, s.ID)
+	if err == nil && rts.Index != nil {
+		LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, rts.Index.Remove(ctx, s.ID))
+	}
+	if err == nil && n > 0 {
+		rts.audit(ctx, nil, AuditRevoked, s, "", "")
+		rts.fire(ctx, SessionDestroyed, s, "")
+		rts.notify(ctx, SessionDestroyed, "", s)
+		rts.revokeJWTs(ctx, s.Name, s.ID)
+	}
+	done(err)
+	return n, err
+}
+
+// DeleteAny You need to call RedisTokenStore.Save to persist this action to redis!
+func (s *Session) DeleteAny(key string) {
+	delete(s.Values, key)
+}
+
+// WithSessionLock serializes the requests handled by next which carry the same `name` session cookie,
+// so handlers that Get, change and Save the same session never run at the same time.
+// Requests without a session cookie are not serialized. See WithLock
+func (rts *RedisTokenStore) WithSessionLock(name string, ttl time.Duration, next http.Handler) http.Handler {
+	return WithLock(rts.RedisClient, func(r *http.Request) string {
+		if c, err := r.Cookie(name); err == nil && len(c.Value) > 0 {
+			return "session:" + c.Value
+		}
+		return ""
+	}, ttl, next)
+}
+
+// ExportSessions writes all sessions of the store to w, still encrypted and with the time they expire,
+// e.g. to move them to another redis server with ImportSessions
+func (rts *RedisTokenStore) ExportSessions(ctx context.Context, w io.Writer) error {
+	_, err := rts.ExportSessionsFrom(ctx, w, 0)
+	return err
+}
+
+// ExportSessionsFrom resumes an export which was interrupted, from the cursor returned by the failed export
+// or by ResumeCursor. It returns the cursor reached, which is 0 once the export is complete
+func (rts *RedisTokenStore) ExportSessionsFrom(ctx context.Context, w io.Writer, cursor uint64) (uint64, error) {
+	return rts.RedisClient.ExportSessionRecords(ctx, w, ExportOptions{
+		Store:  tokenStoreName,
+		Cursor: cursor,
+		Accept: rts.owns,
+	})
+}
+
+// ImportSessions restores the sessions written by ExportSessions. Sessions which already exist are kept.
+// It returns how many sessions were imported
+func (rts *RedisTokenStore) ImportSessions(ctx context.Context, r io.Reader) (int, error) {
+	imported, _, err := rts.RedisClient.ImportSessionRecords(ctx, r, ImportOptions{
+		Accept: rts.owns,
+		Imported: func(ctx context.Context, rec *SessionRecord) {
+			if rts.Index == nil {
+				return
+			}
+			s, err := rts.fromToken(rec.Text)
+			if err != nil {
+				return
+			}
+			err = rts.Index.Touch(ctx, s.ID, s.Name, s.UserID, time.Unix(s.CreatedAt, 0), rec.TTL)
+			LogIndex(ctx, rts.logger(), rts.logLevels(), tokenStoreName, s.Name, s.ID, err)
+		},
+	})
+	return imported, err
+}
+
+// owns tells if the record is a session which this store can decrypt
+func (rts *RedisTokenStore) owns(rec *SessionRecord) bool {
+	if rec.Layout != "string" {
+		return false
+	}
+	_, err := rts.fromToken(rec.Text)
+	return err == nil
 }
@@ -0,0 +1,117 @@
+package webredis
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is the name of the OpenTelemetry tracer which creates the spans of this library
+const TracerName = "github.com/gbenroscience/webredis"
+
+// Attributes set on the spans of the session stores
+const (
+	AttrStore       = attribute.Key("webredis.store")
+	AttrSessionName = attribute.Key("webredis.session.name")
+	AttrOutcome     = attribute.Key("webredis.outcome")
+	AttrPayloadSize = attribute.Key("webredis.payload_size")
+	AttrBackend     = attribute.Key("webredis.backend")
+)
+
+// EnableTracing makes the store, and the session stores using it, emit OpenTelemetry spans created by tp.
+// Every redis command gets a span, as does every Get, Save and Delete of the session stores.
+// Pass otel.GetTracerProvider() to use the global provider. Calling it again replaces tp
+func (rds *RedisStore) EnableTracing(tp trace.TracerProvider) {
+	rds.Tracer = tp.Tracer(TracerName)
+	if !rds.tracingHooked {
+		rds.tracingHooked = true
+		rds.Conn.AddHook(tracingHook{rds: rds, addr: rds.Conn.Options().Addr})
+	}
+}
+
+// TracerOrNop returns the tracer set with EnableTracing, or one which creates no spans if tracing is disabled
+func (rds *RedisStore) TracerOrNop() trace.Tracer {
+	if rds.Tracer == nil {
+		return trace.NewNoopTracerProvider().Tracer(TracerName)
+	}
+	return rds.Tracer
+}
+
+// EndSpan records err, if any, on the span and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// tracingHook creates a span for every command sent by a redis.Client
+type tracingHook struct {
+	rds  *RedisStore
+	addr string
+}
+
+func (h tracingHook) attributes(operation string) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("db.system", "redis"),
+		attribute.String("db.operation", operation),
+		attribute.String("net.peer.name", h.addr),
+	)
+}
+
+func (h tracingHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	name := strings.ToLower(cmd.Name())
+	ctx, _ = h.rds.TracerOrNop().Start(ctx, "redis."+name, trace.WithSpanKind(trace.SpanKindClient), h.attributes(name))
+	return ctx, nil
+}
+
+func (h tracingHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	EndSpan(trace.SpanFromContext(ctx), commandErr(cmd))
+	return nil
+}
+
+func (h tracingHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = strings.ToLower(cmd.Name())
+	}
+	ctx, _ = h.rds.TracerOrNop().Start(ctx, "redis.pipeline", trace.WithSpanKind(trace.SpanKindClient), h.attributes(strings.Join(names, " ")))
+	return ctx, nil
+}
+
+func (h tracingHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = commandErr(cmd); err != nil {
+			break
+		}
+	}
+	EndSpan(trace.SpanFromContext(ctx), err)
+	return nil
+}
+
+// StartOperation starts timing and tracing an operation of a session store, e.g. store "session" and op "Get".
+// The returned func ends both, and must be called once the operation is done
+func (rds *RedisStore) StartOperation(ctx context.Context, store string, op string, attrs ...attribute.KeyValue) (context.Context, func(err error, attrs ...attribute.KeyValue)) {
+	start := time.Now()
+	attrs = append(attrs, AttrStore.String(store))
+	ctx, span := rds.TracerOrNop().Start(ctx, "webredis."+store+"."+op, trace.WithAttributes(attrs...))
+	return ctx, func(err error, attrs ...attribute.KeyValue) {
+		rds.MetricsOrNop().ObserveOperation(store, strings.ToLower(op), time.Since(start), err)
+		span.SetAttributes(attrs...)
+		EndSpan(span, err)
+	}
+}
+
+// ObservePayload reports the size of an encrypted session read or written by a session store,
+// both to the metrics and to the span in ctx
+func (rds *RedisStore) ObservePayload(ctx context.Context, store string, op string, size int) {
+	rds.MetricsOrNop().ObservePayloadSize(store, op, size)
+	trace.SpanFromContext(ctx).SetAttributes(AttrPayloadSize.Int(size))
+}
@@ -135,8 +135,9 @@ func (k Kryptik) decryptCBC(encrypted string) (decrypted string, err error) {
 		return
 	}
 
-	if len(cipherText) < aes.BlockSize {
-		err = errors.New("the block size of the ciphertext is too short")
+	// the IV and at least one block, which holds the padding
+	if len(cipherText) < 2*aes.BlockSize || len(cipherText)%aes.BlockSize != 0 {
+		err = errors.New("the ciphertext is not a whole number of blocks")
 		return
 	}
 
@@ -149,7 +150,11 @@ func (k Kryptik) decryptCBC(encrypted string) (decrypted string, err error) {
 	// XORKeyStream can work in-place if the two arguments are the same.
 	stream.CryptBlocks(cipherText, cipherText)
 
-	decrypted = string(pkcs5UnPadding(cipherText))
+	plainText, err := pkcs5UnPadding(cipherText)
+	if err != nil {
+		return
+	}
+	decrypted = string(plainText)
 	return
 }
 
@@ -175,7 +180,10 @@ func pkcs5Padding(ciphertext []byte, blockSize int) []byte {
 	padtext := bytes.Repeat([]byte{byte(padding)}, padding)
 	return append(ciphertext, padtext...)
 }
-func pkcs5UnPadding(encrypt []byte) []byte {
-	padding := encrypt[len(encrypt)-1]
-	return encrypt[:len(encrypt)-int(padding)]
+func pkcs5UnPadding(encrypt []byte) ([]byte, error) {
+	padding := int(encrypt[len(encrypt)-1])
+	if padding == 0 || padding > aes.BlockSize {
+		return nil, errors.New("the padding of the plaintext is invalid")
+	}
+	return encrypt[:len(encrypt)-padding], nil
 }